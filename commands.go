@@ -0,0 +1,315 @@
+package main
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+
+  "github.com/wavesoft/docker-lb/utils"
+)
+
+const usage = `Usage: docker-lb [command]
+
+Without a command, docker-lb runs the load balancer.
+
+Commands:
+  account info [name]            Show the details of the ACME account
+  account update-contact [name]  Update the contact of the account to AUTOCERT_EMAIL
+  account rollover [name]        Replace the key of the account
+  account deactivate [name]      Deactivate the account on the CA
+  cert list [name]               List the certificates of the account
+  cert purge [--revoke] domain.. Archive (and revoke) the certificates of the domains
+  cert purge [--revoke] --orphaned
+                                 Archive (and revoke) all the orphaned certificates
+  keys rotate [passphrase-file]  Encrypt the data at rest with a new key, and
+                                 optionally with a new passphrase
+
+The [name] is one of the accounts in AUTOCERT_ACCOUNTS, or the default account
+if missing. The cert purge command accepts --account <name> for the same purpose.
+`
+
+// runCommand runs the given command line and returns the exit code
+func runCommand(args []string) int {
+  var err error
+
+  switch args[0] {
+  case "account":
+    err = accountCommand(args[1:])
+  case "cert":
+    err = certCommand(args[1:])
+  case "keys":
+    err = keysCommand(args[1:])
+  case "help", "-h", "--help":
+    fmt.Print(usage)
+    return 0
+  default:
+    err = fmt.Errorf("Unknown command '%s'", args[0])
+  }
+
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "Error: %s\n\n%s", err.Error(), usage)
+    return 1
+  }
+  return 0
+}
+
+// accountProvider creates the provider of the given ACME account, or the
+// default one if the name is empty. A read-only provider only loads the stored
+// state, so it can be inspected while the load balancer is running.
+func accountProvider(name string, readOnly bool) (*utils.DefaultCertificateProvider, error) {
+  cfg, err := acmeConfig()
+  if err != nil {
+    return nil, err
+  }
+  cfg.ReadOnly = readOnly
+  if name == "" || name == utils.IssuerACME {
+    return utils.CreateDefaultCertificateProvider(cfg)
+  }
+
+  names, err := namedAccounts()
+  if err != nil {
+    return nil, err
+  }
+  for _, n := range names {
+    if n == name {
+      return utils.CreateDefaultCertificateProvider(namedAccountConfig(cfg, name))
+    }
+  }
+  return nil, fmt.Errorf("Unknown account '%s'", name)
+}
+
+// pidFile returns the file where the running load balancer writes its
+// process ID, so the commands can tell that it is running
+func pidFile(cfg utils.DefaultCertificateProviderConfig) string {
+  return cfg.RuntimeDir + "/docker-lb.pid"
+}
+
+func writePidFile(filename string) error {
+  err := os.MkdirAll(filepath.Dir(filename), 0700)
+  if err == nil {
+    err = ioutil.WriteFile(filename, []byte(strconv.Itoa(os.Getpid())), 0600)
+  }
+  if err != nil {
+    return fmt.Errorf("Could not write pid file: %s", err.Error())
+  }
+  return nil
+}
+
+// checkDaemonStopped returns an error if the load balancer is running, either
+// on this host or, with the shared storage, on any of the nodes
+func checkDaemonStopped(cfg utils.DefaultCertificateProviderConfig) error {
+  if data, err := ioutil.ReadFile(pidFile(cfg)); err == nil {
+    pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+    if err == nil && pid != os.Getpid() {
+      err = syscall.Kill(pid, 0)
+      if err == nil || err == syscall.EPERM {
+        return fmt.Errorf("The load balancer is running (pid %d), stop it first", pid)
+      }
+    }
+  }
+
+  if os.Getenv("STORAGE_BACKEND") == "consul" {
+    locks := utils.CreateLockManager(utils.LockManagerConfig{Storage: cfg.Storage})
+    leader, err := locks.Leader()
+    if err != nil {
+      return err
+    }
+    if leader != "" {
+      return fmt.Errorf("The load balancer is running on node %s, stop all the nodes first", leader)
+    }
+  }
+  return nil
+}
+
+func accountCommand(args []string) error {
+  if len(args) < 1 || len(args) > 2 {
+    return fmt.Errorf("Expected an account action")
+  }
+  name := ""
+  if len(args) == 2 {
+    name = args[1]
+  }
+
+  switch args[0] {
+  case "info", "update-contact", "rollover", "deactivate":
+  default:
+    return fmt.Errorf("Unknown account action '%s'", args[0])
+  }
+
+  // The running load balancer keeps its own copy of the account, that would
+  // go out of sync with the changes
+  readOnly := args[0] == "info"
+  if !readOnly {
+    cfg, err := acmeConfig()
+    if err != nil {
+      return err
+    }
+    err = checkDaemonStopped(cfg)
+    if err != nil {
+      return err
+    }
+  }
+
+  p, err := accountProvider(name, readOnly)
+  if err != nil {
+    return err
+  }
+
+  switch args[0] {
+  case "info":
+    fmt.Println(p.AccountInfo())
+    return nil
+  case "update-contact":
+    return p.UpdateContact()
+  case "rollover":
+    return p.RolloverKey()
+  case "deactivate":
+    return p.Deactivate()
+  }
+  return fmt.Errorf("Unknown account action '%s'", args[0])
+}
+
+func certCommand(args []string) error {
+  if len(args) < 1 {
+    return fmt.Errorf("Expected a certificate action")
+  }
+
+  switch args[0] {
+  case "list":
+    name := ""
+    if len(args) > 1 {
+      name = args[1]
+    }
+    p, err := accountProvider(name, true)
+    if err != nil {
+      return err
+    }
+    for _, c := range p.ListCertificates() {
+      if c.ExpireDate.IsZero() {
+        fmt.Printf("%s\tnot issued\t%s\n", c.Domain, c.LastError)
+        continue
+      }
+      status := "active"
+      if !c.OrphanedSince.IsZero() {
+        status = "orphaned since " + c.OrphanedSince.Format(time.RFC3339)
+      }
+      if c.Pending {
+        status += ", renewal pending"
+        if c.LastError != "" {
+          status += " (" + c.LastError + ")"
+        }
+      }
+      fmt.Printf("%s\texpires %s\t%s\n", c.Domain, c.ExpireDate.Format(time.RFC3339), status)
+    }
+    return nil
+
+  case "purge":
+    var (
+      name     string
+      revoke   bool
+      orphaned bool
+      domains  []string
+    )
+    for i := 1; i < len(args); i++ {
+      switch args[i] {
+      case "--revoke":
+        revoke = true
+      case "--orphaned":
+        orphaned = true
+      case "--account":
+        if i+1 >= len(args) {
+          return fmt.Errorf("Expected an account name")
+        }
+        i++
+        name = args[i]
+      default:
+        domains = append(domains, args[i])
+      }
+    }
+
+    // The running load balancer would keep serving and renewing the purged
+    // certificates
+    cfg, err := acmeConfig()
+    if err != nil {
+      return err
+    }
+    err = checkDaemonStopped(cfg)
+    if err != nil {
+      return err
+    }
+
+    p, err := accountProvider(name, false)
+    if err != nil {
+      return err
+    }
+    if orphaned {
+      for _, c := range p.ListCertificates() {
+        if !c.OrphanedSince.IsZero() {
+          domains = append(domains, c.Domain)
+        }
+      }
+    }
+    if len(domains) == 0 {
+      return fmt.Errorf("No certificates to purge")
+    }
+    for _, domain := range domains {
+      err := p.Purge(domain, revoke)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  }
+  return fmt.Errorf("Unknown certificate action '%s'", args[0])
+}
+
+func keysCommand(args []string) error {
+  if len(args) < 1 || len(args) > 2 || args[0] != "rotate" {
+    return fmt.Errorf("Expected a key action")
+  }
+
+  cfg, err := acmeConfig()
+  if err != nil {
+    return err
+  }
+  if cfg.Encryption == nil {
+    return fmt.Errorf("Encryption is not enabled")
+  }
+
+  // The running load balancer would keep encrypting with the previous key,
+  // that is removed once the rotation is complete
+  err = checkDaemonStopped(cfg)
+  if err != nil {
+    return err
+  }
+
+  // The previous keys are only removed once everything is encrypted again,
+  // so an interrupted rotation can be safely repeated
+  id, err := cfg.Encryption.AddKey()
+  if err != nil {
+    return err
+  }
+  count, err := cfg.Encryption.Reseal()
+  if err != nil {
+    return err
+  }
+  err = cfg.Encryption.RemoveOldKeys()
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Encrypted %d files with the new key %s\n", count, id)
+
+  if len(args) == 2 {
+    err = cfg.Encryption.ChangePassphrase(args[1])
+    if err != nil {
+      return err
+    }
+    fmt.Printf("Changed the passphrase, update AUTOCERT_PASSPHRASE_FILE to use %s\n", args[1])
+  }
+  return nil
+}
@@ -9,8 +9,11 @@ require (
 	github.com/docker/go-units v0.4.0 // indirect
 	github.com/go-acme/lego/v3 v3.6.0
 	github.com/lithammer/dedent v1.1.0
+	github.com/miekg/dns v1.1.27
 	github.com/opencontainers/go-digest v1.0.0-rc1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 	golang.org/x/net v0.0.0-20200506145744-7e3656a0809f // indirect
+	gopkg.in/square/go-jose.v2 v2.3.1
 )
@@ -4,6 +4,8 @@ import (
   "fmt"
   "net/http"
   "os"
+  "strconv"
+  "strings"
   "time"
 
   log "github.com/sirupsen/logrus"
@@ -16,6 +18,26 @@ func httpServerThread(staticDir string, listenPort int) {
   http.ListenAndServe(fmt.Sprintf(":%d", listenPort), nil)
 }
 
+func metricsServerThread(listenAddr string) {
+  log.Infof("Serving metrics on %s/metrics", listenAddr)
+  mux := http.NewServeMux()
+  mux.Handle("/metrics", utils.DefaultMetrics)
+  err := http.ListenAndServe(listenAddr, mux)
+  if err != nil {
+    log.Errorf("Could not start metrics server: %s", err.Error())
+  }
+}
+
+func internalCAServerThread(listenAddr string, handler http.Handler) {
+  log.Infof("Serving the internal root CA on %s/root.pem", listenAddr)
+  mux := http.NewServeMux()
+  mux.Handle("/root.pem", handler)
+  err := http.ListenAndServe(listenAddr, mux)
+  if err != nil {
+    log.Errorf("Could not start internal CA server: %s", err.Error())
+  }
+}
+
 func dockerSyncThread(docker *utils.DockerMonitor, haproxy *utils.HAProxyManager) {
   var (
     crc  uint64 = 0
@@ -23,10 +45,16 @@ func dockerSyncThread(docker *utils.DockerMonitor, haproxy *utils.HAProxyManager
   )
 
   for {
+    start := time.Now()
     eps, err := docker.GetProxyEndpoints()
     if err != nil {
       log.Errorf("Could not get docker status: %s", err.Error())
+      utils.DefaultMetrics.AddCounter("dockerlb_sync_failures_total",
+        "Total number of failed docker sync iterations.", nil, 1)
     } else {
+      utils.DefaultMetrics.SetGauge("dockerlb_endpoints",
+        "Number of proxy endpoints discovered in the last docker sync.", nil, float64(len(eps)))
+
       ncrc = 0
       for _, ep := range eps {
         ncrc ^= ep.Hash()
@@ -36,7 +64,7 @@ func dockerSyncThread(docker *utils.DockerMonitor, haproxy *utils.HAProxyManager
       if ncrc != crc {
         crc = ncrc
         log.Infof("Endpoint configuration changed")
-        err = haproxy.SetState(&utils.HAProxyState{eps})
+        err = haproxy.SetState(&utils.HAProxyState{Endpoints: eps})
 
         if err != nil {
           log.Errorf("Could not apply configuration: %s", err.Error())
@@ -44,43 +72,39 @@ func dockerSyncThread(docker *utils.DockerMonitor, haproxy *utils.HAProxyManager
       }
     }
 
+    utils.DefaultMetrics.SetGauge("dockerlb_sync_duration_seconds",
+      "Duration of the last docker sync iteration.", nil, time.Since(start).Seconds())
+
     time.Sleep(30 * time.Second)
   }
 }
 
-func certificateRenewalThread(certs utils.CertificateProvider, haproxy *utils.HAProxyManager) {
+func certificateRenewalThread(certs utils.CertificateProvider, locks *utils.LockManager) {
   log.Info("Starting certificate renewal thread")
   for {
     time.Sleep(60 * time.Minute)
+
+    // Only the leader renews the certificates of a cluster
+    if locks != nil && !locks.IsLeader() {
+      continue
+    }
     log.Info("Checking for expired certificates")
 
-    reload := false
+    // Requesting the certificate queues it for renewal in the background,
+    // and the new certificate is pushed to HAProxy once available
     for _, domain := range certs.GetDomainsToReissue() {
       log.Infof("Certificate for domain %s is about to expire", domain)
-      _, err := certs.GetCertificateForDomain(domain)
+      _, err := certs.GetCertificateForDomain(domain, utils.CertificateOptions{})
       if err != nil {
         log.Errorf("Error renewing certificate: %s", err)
-      } else {
-        reload = true
-      }
-    }
-
-    if reload {
-      log.Infof("Certificate(s) have been changed, going to reload")
-      err := haproxy.Reload()
-      if err != nil {
-        log.Errorf("Error reloading HAProxy: %s", err)
       }
     }
   }
 }
 
-func main() {
-  docker, err := utils.CreateDockerMonitor()
-  if err != nil {
-    panic(err)
-  }
-
+// acmeConfig reads the configuration of the default ACME account from the
+// environment
+func acmeConfig() (utils.DefaultCertificateProviderConfig, error) {
   sslEmail := os.Getenv("AUTOCERT_EMAIL")
   if sslEmail == "" {
     sslEmail = "demo@example.com"
@@ -96,22 +120,425 @@ func main() {
     certDir = "/var/lib/docker-lb"
   }
 
-  haproxyBin := os.Getenv("HAPROXY_BIN")
-  if haproxyBin == "" {
-    haproxyBin = "/usr/local/sbin/haproxy"
+  acmeDirectory := os.Getenv("AUTOCERT_DIRECTORY")
+  if acmeDirectory == "staging" {
+    acmeDirectory = "https://acme-staging-v02.api.letsencrypt.org/directory"
   }
 
-  wwwDir := os.Getenv("STATIC_WWW_DIR")
+  var acmeRoots []string
+  if sv := os.Getenv("AUTOCERT_CA_CERTIFICATES"); sv != "" {
+    acmeRoots = strings.Split(sv, ",")
+  }
+
+  renewalFraction := 0.0
+  if sv := os.Getenv("AUTOCERT_RENEWAL_FRACTION"); sv != "" {
+    var err error
+    renewalFraction, err = strconv.ParseFloat(sv, 64)
+    if err != nil {
+      return utils.DefaultCertificateProviderConfig{}, fmt.Errorf("AUTOCERT_RENEWAL_FRACTION is not a number: %s", err.Error())
+    }
+  }
+
+  var dnsResolvers []string
+  for _, resolver := range strings.Split(os.Getenv("AUTOCERT_DNS_RESOLVERS"), ",") {
+    if resolver = strings.TrimSpace(resolver); resolver != "" {
+      dnsResolvers = append(dnsResolvers, resolver)
+    }
+  }
+
+  var wildcards []string
+  for _, domain := range strings.Split(os.Getenv("AUTOCERT_WILDCARDS"), ",") {
+    if domain = strings.TrimSpace(domain); domain != "" {
+      wildcards = append(wildcards, domain)
+    }
+  }
+
+  var orphanGracePeriod time.Duration
+  if sv := os.Getenv("AUTOCERT_ORPHAN_GRACE_PERIOD"); sv != "" {
+    var err error
+    orphanGracePeriod, err = time.ParseDuration(sv)
+    if err != nil {
+      return utils.DefaultCertificateProviderConfig{}, fmt.Errorf("AUTOCERT_ORPHAN_GRACE_PERIOD is not a valid duration: %s", err.Error())
+    }
+  }
+  issueWorkers := 0
+  if sv := os.Getenv("AUTOCERT_ISSUE_WORKERS"); sv != "" {
+    var err error
+    issueWorkers, err = strconv.Atoi(sv)
+    if err != nil {
+      return utils.DefaultCertificateProviderConfig{}, fmt.Errorf("AUTOCERT_ISSUE_WORKERS is not a number: %s", err.Error())
+    }
+  }
+
+  var publicIPs []string
+  if sv := os.Getenv("PUBLIC_IPS"); sv != "" {
+    publicIPs = strings.Split(sv, ",")
+  }
+
+  // The HTTP self-test goes through the HTTP frontend of HAProxy
+  selfTestAddr := "127.0.0.1:80"
+  if sv := os.Getenv("AUTOCERT_SELF_TEST"); sv == "no" || sv == "false" || sv == "off" || sv == "0" {
+    selfTestAddr = ""
+  }
+
+  revokeOrphaned := false
+  if sv := os.Getenv("AUTOCERT_REVOKE_ORPHANED"); sv == "yes" || sv == "true" || sv == "on" || sv == "1" {
+    revokeOrphaned = true
+  }
+
+  if sv := os.Getenv("STORAGE_BACKEND"); sv != "" && sv != "file" && sv != "consul" {
+    return utils.DefaultCertificateProviderConfig{}, fmt.Errorf("Unsupported storage backend '%s'", sv)
+  }
+  storage := certStorage(certDir, "")
+
+  encryption, err := secretBox(storage)
+  if err != nil {
+    return utils.DefaultCertificateProviderConfig{}, err
+  }
+  runtimeDir := os.Getenv("RUNTIME_DIR")
+  if runtimeDir == "" {
+    runtimeDir = "/dev/shm/docker-lb"
+  }
+
+  notifier, err := notifier()
+  if err != nil {
+    return utils.DefaultCertificateProviderConfig{}, err
+  }
+  var expiryWarning time.Duration
+  if sv := os.Getenv("AUTOCERT_EXPIRY_WARNING"); sv != "" {
+    expiryWarning, err = time.ParseDuration(sv)
+    if err != nil {
+      return utils.DefaultCertificateProviderConfig{}, fmt.Errorf("AUTOCERT_EXPIRY_WARNING is not a valid duration: %s", err.Error())
+    }
+  }
 
-  // Configure Certificate Manager
-  cfg := utils.DefaultCertificateProviderConfig{
+  return utils.DefaultCertificateProviderConfig{
     ConfigDir:     certDir,
     Email:         sslEmail,
     Organization:  sslOrg,
     AuthPortHTTP:  5002,
     AuthPortHTTPS: 5003,
+
+    CADirURL:       acmeDirectory,
+    CACertificates: acmeRoots,
+    EABKeyID:       os.Getenv("AUTOCERT_EAB_KID"),
+    EABHMACKey:     os.Getenv("AUTOCERT_EAB_HMAC"),
+    KeyType:        os.Getenv("AUTOCERT_KEY_TYPE"),
+
+    Challenge:    os.Getenv("AUTOCERT_CHALLENGE"),
+    DNSProvider:  os.Getenv("AUTOCERT_DNS_PROVIDER"),
+    DNSResolvers: dnsResolvers,
+    Wildcards:    wildcards,
+
+    RenewalFraction: renewalFraction,
+
+    OrphanGracePeriod: orphanGracePeriod,
+    RevokeOrphaned:    revokeOrphaned,
+
+    IssueWorkers: issueWorkers,
+
+    PublicIPs:    publicIPs,
+    SelfTestAddr: selfTestAddr,
+
+    Encryption: encryption,
+    RuntimeDir: runtimeDir,
+
+    Storage: storage,
+
+    Notifier:      notifier,
+    ExpiryWarning: expiryWarning,
+  }, nil
+}
+
+// notifier creates the notifier of the certificate events with the sinks
+// configured in the environment
+func notifier() (*utils.Notifier, error) {
+  var sinks []utils.NotificationSink
+  if sv := os.Getenv("NOTIFY_WEBHOOK_URL"); sv != "" {
+    sinks = append(sinks, &utils.WebhookSink{URL: sv})
+  }
+  if sv := os.Getenv("NOTIFY_SLACK_URL"); sv != "" {
+    sinks = append(sinks, &utils.SlackSink{URL: sv})
+  }
+  if sv := os.Getenv("NOTIFY_SMTP_ADDR"); sv != "" {
+    to := os.Getenv("NOTIFY_SMTP_TO")
+    if to == "" {
+      return nil, fmt.Errorf("NOTIFY_SMTP_TO is required with NOTIFY_SMTP_ADDR")
+    }
+    from := os.Getenv("NOTIFY_SMTP_FROM")
+    if from == "" {
+      from = "docker-lb@localhost"
+    }
+    sinks = append(sinks, &utils.SMTPSink{
+      Addr:     sv,
+      From:     from,
+      To:       strings.Split(to, ","),
+      Username: os.Getenv("NOTIFY_SMTP_USER"),
+      Password: os.Getenv("NOTIFY_SMTP_PASSWORD"),
+    })
+  }
+  if len(sinks) == 0 {
+    return nil, nil
+  }
+
+  rateLimit := 0
+  if sv := os.Getenv("NOTIFY_RATE_LIMIT"); sv != "" {
+    var err error
+    rateLimit, err = strconv.Atoi(sv)
+    if err != nil {
+      return nil, fmt.Errorf("NOTIFY_RATE_LIMIT is not a number: %s", err.Error())
+    }
+  }
+  return utils.CreateNotifier(utils.NotifierConfig{
+    Sinks:     sinks,
+    RateLimit: rateLimit,
+  }), nil
+}
+
+// certStorage creates the storage of the given sub-directory of the config
+// directory, or of the same prefix of the shared storage
+func certStorage(configDir string, sub string) utils.Storage {
+  if os.Getenv("STORAGE_BACKEND") == "consul" {
+    prefix := os.Getenv("CONSUL_PREFIX")
+    if prefix == "" {
+      prefix = "docker-lb"
+    }
+    if sub != "" {
+      prefix += "/" + sub
+    }
+    return utils.CreateConsulStorage(utils.ConsulStorageConfig{
+      Address: os.Getenv("CONSUL_HTTP_ADDR"),
+      Token:   os.Getenv("CONSUL_HTTP_TOKEN"),
+      Prefix:  prefix,
+    })
+  }
+
+  dir := configDir
+  if sub != "" {
+    dir += "/" + sub
+  }
+  return utils.CreateFileStorage(utils.FileStorageConfig{Dir: dir})
+}
+
+// passphraseFile returns the file with the passphrase used for encrypting the
+// data at rest, given either as a path or as the name of a docker secret
+func passphraseFile() string {
+  if sv := os.Getenv("AUTOCERT_PASSPHRASE_FILE"); sv != "" {
+    return sv
+  }
+  if sv := os.Getenv("AUTOCERT_PASSPHRASE_SECRET"); sv != "" {
+    secretsDir := os.Getenv("SECRETS_DIR")
+    if secretsDir == "" {
+      secretsDir = "/run/secrets"
+    }
+    return secretsDir + "/" + sv
   }
-  certPovider, err := utils.CreateDefaultCertificateProvider(cfg)
+  return ""
+}
+
+// secretBox opens the keyring in the storage, if encryption is enabled
+func secretBox(storage utils.Storage) (*utils.SecretBox, error) {
+  filename := passphraseFile()
+  if filename == "" {
+    return nil, nil
+  }
+  return utils.CreateSecretBox(utils.SecretBoxConfig{
+    Storage:        storage,
+    PassphraseFile: filename,
+  })
+}
+
+// namedAccounts returns the names of the additional ACME accounts
+func namedAccounts() ([]string, error) {
+  var names []string
+  if sv := os.Getenv("AUTOCERT_ACCOUNTS"); sv != "" {
+    for _, name := range strings.Split(sv, ",") {
+      name = strings.TrimSpace(name)
+      switch name {
+      case "", utils.IssuerACME, utils.IssuerSelfSigned, utils.IssuerInternal, utils.IssuerFile:
+        return nil, fmt.Errorf("AUTOCERT_ACCOUNTS contains an invalid account name '%s'", name)
+      }
+      names = append(names, name)
+    }
+  }
+  return names, nil
+}
+
+// namedAccountConfig derives the configuration of the named ACME account from
+// the default one
+func namedAccountConfig(cfg utils.DefaultCertificateProviderConfig, name string) utils.DefaultCertificateProviderConfig {
+  prefix := "AUTOCERT_" + strings.ToUpper(name) + "_"
+  accCfg := cfg
+  accCfg.ConfigDir = cfg.ConfigDir + "/accounts/" + name
+  accCfg.RuntimeDir = cfg.RuntimeDir + "/accounts/" + name
+  accCfg.Storage = certStorage(cfg.ConfigDir, "accounts/"+name)
+  if sv := os.Getenv(prefix + "EMAIL"); sv != "" {
+    accCfg.Email = sv
+  }
+  if sv := os.Getenv(prefix + "DIRECTORY"); sv != "" {
+    accCfg.CADirURL = sv
+    if sv == "staging" {
+      accCfg.CADirURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+    }
+  }
+  if sv := os.Getenv(prefix + "KEY_TYPE"); sv != "" {
+    accCfg.KeyType = sv
+  }
+  accCfg.EABKeyID = os.Getenv(prefix + "EAB_KID")
+  accCfg.EABHMACKey = os.Getenv(prefix + "EAB_HMAC")
+  return accCfg
+}
+
+func main() {
+  if len(os.Args) > 1 {
+    os.Exit(runCommand(os.Args[1:]))
+  }
+
+  docker, err := utils.CreateDockerMonitor()
+  if err != nil {
+    panic(err)
+  }
+
+  cfg, err := acmeConfig()
+  if err != nil {
+    panic(err)
+  }
+  certDir := cfg.ConfigDir
+  err = writePidFile(pidFile(cfg))
+  if err != nil {
+    panic(err)
+  }
+
+  // HAProxy loads the decrypted certificates from the runtime directory
+  certStoreDir := certDir
+  if cfg.Encryption != nil {
+    certStoreDir = cfg.RuntimeDir
+  }
+
+  haproxyBin := os.Getenv("HAPROXY_BIN")
+  if haproxyBin == "" {
+    haproxyBin = "/usr/local/sbin/haproxy"
+  }
+
+  wwwDir := os.Getenv("STATIC_WWW_DIR")
+
+  metricsListen := os.Getenv("METRICS_LISTEN")
+
+  errorPagesDir := os.Getenv("ERROR_PAGES_DIR")
+  if errorPagesDir == "" && wwwDir != "" {
+    errorPagesDir = wwwDir + "/errors"
+  }
+
+  haproxyConfigFile := os.Getenv("HAPROXY_CONFIG_FILE")
+  if haproxyConfigFile == "" {
+    haproxyConfigFile = certDir + "/haproxy.json"
+  }
+  tuning, err := utils.LoadHAProxyTuning(haproxyConfigFile)
+  if err != nil {
+    panic(err)
+  }
+
+  // The nodes sharing the storage elect a leader, and lock the domains they
+  // are issuing
+  var locks *utils.LockManager
+  if os.Getenv("STORAGE_BACKEND") == "consul" {
+    locks = utils.CreateLockManager(utils.LockManagerConfig{
+      Storage: cfg.Storage,
+      NodeID:  os.Getenv("NODE_ID"),
+    })
+    locks.Start()
+    cfg.Locks = locks
+  }
+
+  // Configure Certificate Manager. All the ACME accounts share the same
+  // challenge responder, since HAProxy forwards the challenges to fixed ports,
+  // that also answers the challenges of the orders started by other nodes
+  responderCfg := utils.ChallengeResponderConfig{
+    HTTPPort: cfg.AuthPortHTTP,
+    TLSPort:  cfg.AuthPortHTTPS,
+  }
+  if locks != nil {
+    responderCfg.Storage = cfg.Storage
+  }
+  cfg.Responder = utils.CreateChallengeResponder(responderCfg)
+  acmeProvider, err := utils.CreateDefaultCertificateProvider(cfg)
+  if err != nil {
+    panic(err)
+  }
+
+  // The issuer of every domain is picked through the `publish.ssl.issuer`
+  // label, and remembered in the state of the default ACME account
+  internalDomains := map[string]string{}
+  internalSuffixes := os.Getenv("INTERNAL_CA_DOMAINS")
+  if internalSuffixes == "" {
+    internalSuffixes = ".internal,.lan"
+  }
+  for _, suffix := range strings.Split(internalSuffixes, ",") {
+    if suffix = strings.TrimSpace(suffix); suffix != "" {
+      internalDomains["."+strings.TrimPrefix(suffix, ".")] = utils.IssuerInternal
+    }
+  }
+  certPovider := utils.CreateCompositeCertificateProvider(utils.CompositeCertificateProviderConfig{
+    DefaultIssuer:   utils.IssuerACME,
+    PriorityIssuers: []string{utils.IssuerFile},
+    SuffixIssuers:   internalDomains,
+    Store:           acmeProvider,
+  })
+  selfSignedProvider := utils.CreateSelfSignedCertificateProvider(acmeProvider)
+  certPovider.AddIssuer(utils.IssuerACME, acmeProvider)
+  certPovider.AddIssuer(utils.IssuerSelfSigned, selfSignedProvider)
+
+  // Private domains get certificates from a local CA
+  internalLifetime := 7 * 24 * time.Hour
+  if sv := os.Getenv("INTERNAL_CA_LIFETIME"); sv != "" {
+    internalLifetime, err = time.ParseDuration(sv)
+    if err != nil {
+      panic(fmt.Errorf("INTERNAL_CA_LIFETIME is not a valid duration: %s", err.Error()))
+    }
+  }
+  internalProvider, err := utils.CreateInternalCertificateProvider(utils.InternalCertificateProviderConfig{
+    Dir:          certDir + "/ca",
+    Storage:      certStorage(certDir, "ca"),
+    Encryption:   cfg.Encryption,
+    RuntimeDir:   cfg.RuntimeDir + "/ca",
+    Organization: cfg.Organization,
+    LeafLifetime: internalLifetime,
+  }, selfSignedProvider)
+  if err != nil {
+    panic(err)
+  }
+  certPovider.AddIssuer(utils.IssuerInternal, internalProvider)
+
+  // Certificates provided by the user take priority over any other issuer
+  customCertDir := os.Getenv("CUSTOM_CERTS_DIR")
+  if customCertDir == "" {
+    customCertDir = certDir + "/custom"
+  }
+  fileProvider, err := utils.CreateFileCertificateProvider(utils.FileCertificateProviderConfig{
+    Dir:        customCertDir,
+    SecretsDir: os.Getenv("SECRETS_DIR"),
+  }, selfSignedProvider)
+  if err != nil {
+    panic(err)
+  }
+  certPovider.AddIssuer(utils.IssuerFile, fileProvider)
+
+  // Additional ACME accounts, eg. for using a different CA on some domains
+  var namedProviders []*utils.DefaultCertificateProvider
+  accountNames, err := namedAccounts()
+  if err != nil {
+    panic(err)
+  }
+  for _, name := range accountNames {
+    p, err := utils.CreateDefaultCertificateProvider(namedAccountConfig(cfg, name))
+    if err != nil {
+      panic(fmt.Errorf("Could not create ACME account '%s': %s", name, err.Error()))
+    }
+    certPovider.AddIssuer(name, p)
+    namedProviders = append(namedProviders, p)
+  }
+
+  statsCfg, err := utils.LoadHAProxyStatsConfig(certDir)
   if err != nil {
     panic(err)
   }
@@ -121,11 +548,20 @@ func main() {
     Certificates:           certPovider,
     BinaryPath:             haproxyBin,
     DefaultLocalServerPort: 0,
+    ErrorPagesDir:          errorPagesDir,
+    Tuning:                 &tuning,
+    Stats:                  statsCfg,
   }
   if wwwDir != "" {
     haCfg.DefaultLocalServerPort = 8080
   }
   proxy := utils.CreateHAProxyManager(haCfg)
+  proxy.RegisterMetrics(utils.DefaultMetrics)
+  acmeProvider.RegisterMetrics(utils.DefaultMetrics, utils.IssuerACME)
+  for i, p := range namedProviders {
+    p.RegisterMetrics(utils.DefaultMetrics, accountNames[i])
+  }
+  fileProvider.RegisterMetrics(utils.DefaultMetrics)
   err = proxy.Start()
   if err != nil {
     panic(err)
@@ -134,14 +570,67 @@ func main() {
   // Start monitor thread
   go dockerSyncThread(docker, proxy)
 
+  // Keep the OCSP responses of the certificates up to date, unless disabled
+  var stapler *utils.OCSPStapler
+  if sv := os.Getenv("OCSP_STAPLING"); sv != "off" && sv != "false" && sv != "no" && sv != "0" {
+    stapler = utils.CreateOCSPStapler(utils.OCSPStaplerConfig{
+      Patterns: []string{
+        certStoreDir + "/cert/*.pem",
+        certStoreDir + "/cert/*.pem.ecdsa",
+        certStoreDir + "/cert/*.pem.rsa",
+        certStoreDir + "/accounts/*/cert/*.pem",
+        certStoreDir + "/accounts/*/cert/*.pem.ecdsa",
+        certStoreDir + "/accounts/*/cert/*.pem.rsa",
+        customCertDir + "/*.pem",
+      },
+    })
+    stapler.RegisterMetrics(utils.DefaultMetrics)
+    stapler.SetUpdateHandler(func(certFile string, response []byte) {
+      // HAProxy also loads the response from disk on the next reload
+      err := proxy.SetOCSPResponse(response)
+      if err != nil {
+        log.Warnf("Could not update the OCSP response of %s in HAProxy: %s", certFile, err.Error())
+      }
+    })
+    stapler.Start()
+  }
+
+  // Push the certificates issued in the background to HAProxy, without
+  // reloading it, and fetch their OCSP responses right away
+  certPovider.SetUpdateHandler(func(domain string) {
+    log.Infof("Certificate for domain %s has been changed, going to update HAProxy", domain)
+    err := proxy.UpdateCertificates()
+    if err != nil {
+      log.Errorf("Error updating the certificates of HAProxy: %s", err)
+    }
+    if stapler != nil {
+      stapler.Refresh()
+    }
+  })
+  acmeProvider.Start()
+  for _, p := range namedProviders {
+    p.Start()
+  }
+  fileProvider.Start()
+
   // Start certificate renewal thread
-  go certificateRenewalThread(certPovider, proxy)
+  go certificateRenewalThread(certPovider, locks)
 
   // Start default web thread, if enabled
   if wwwDir != "" {
     go httpServerThread(wwwDir, 8080)
   }
 
+  // Start the metrics listener, if enabled
+  if metricsListen != "" {
+    go metricsServerThread(metricsListen)
+  }
+
+  // Start the listener exporting the internal root CA, if enabled
+  if sv := os.Getenv("INTERNAL_CA_LISTEN"); sv != "" {
+    go internalCAServerThread(sv, internalProvider)
+  }
+
   // Wait forever
   select {}
 }
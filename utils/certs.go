@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -14,10 +15,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-acme/lego/v3/certcrypto"
+	"github.com/go-acme/lego/v3/lego"
 	"github.com/go-acme/lego/v3/registration"
 	log "github.com/sirupsen/logrus"
 )
@@ -28,30 +34,188 @@ type DefaultCertificateProviderConfig struct {
 	Organization  string
 	AuthPortHTTP  int
 	AuthPortHTTPS int
+
+	// The ACME server configuration. The directory URL defaults to the
+	// Let's Encrypt production server.
+	CADirURL       string
+	CACertificates []string
+	EABKeyID       string
+	EABHMACKey     string
+	KeyType        string
+
+	// The challenge used for validating the domains ("http-01" or "dns-01"),
+	// and the DNS provider used for the DNS-01 challenges
+	Challenge    string
+	DNSProvider  string
+	DNSResolvers []string
+
+	// The domains for which a wildcard certificate is issued and shared by
+	// all their sub-domains (eg. "example.com" for "*.example.com")
+	Wildcards []string
+
+	// The fraction of the certificate lifetime after which it is renewed,
+	// unless the CA suggests otherwise through ARI
+	RenewalFraction float64
+
+	// How long to keep renewing the certificates of domains that are no
+	// longer published before archiving them, and whether to also revoke them
+	OrphanGracePeriod time.Duration
+	RevokeOrphaned    bool
+
+	// The responder answering the HTTP-01 and TLS-ALPN-01 challenges, that
+	// can be shared by many providers, and how many certificates to issue in
+	// parallel
+	Responder    *ChallengeResponder
+	IssueWorkers int
+
+	// The pre-flight checks done before contacting the CA. The domains must
+	// resolve only to the public addresses of the node, when given, and the
+	// HTTP-01 challenges must be answered through the HTTP frontend listening
+	// on the self-test address, when given.
+	PublicIPs    []string
+	Resolver     DomainResolver
+	SelfTestAddr string
+
+	// When set, the state and the certificates are stored encrypted, and the
+	// certificates are decrypted for HAProxy into the runtime directory
+	Encryption *SecretBox
+	RuntimeDir string
+
+	// Where the state and the certificates are stored, by default the config
+	// directory. The certificates are copied from there into the directory
+	// HAProxy loads them from, and are shared by the nodes using the same
+	// storage.
+	Storage Storage
+
+	// The locks shared by the nodes using the same storage, that make sure
+	// only one node issues the certificate of a domain, and only the leader
+	// runs the periodic maintenance
+	Locks *LockManager
+
+	// Where to notify the certificate events, and how long before the expiry
+	// of a certificate to start warning about it
+	Notifier      *Notifier
+	ExpiryWarning time.Duration
+
+	// When set, the stored state is only read, eg. for listing the
+	// certificates while the load balancer is running. Nothing is saved, and
+	// no account key is generated when the state is missing.
+	ReadOnly bool
 }
 
 type DefaultCertificateProvider struct {
-	config           DefaultCertificateProviderConfig
-	userKey          crypto.PrivateKey
-	userRegistration *registration.Resource
-	certificates     map[string]*issuedCertificate
+	config        DefaultCertificateProviderConfig
+	userKey       crypto.PrivateKey
+	registrations map[string]*registration.Resource
+	contact       string
+	certificates  map[string]*issuedCertificate
+	pending       map[string]*pendingCertificate
+	inflight      map[string]bool
+	issuers       map[string]string
+	mutex         sync.Mutex
+	wakeup        chan struct{}
+	updateHandler func(domain string)
+	stateData     []byte
+	deleted       stateTombstones
 }
 
 type issuedCertificate struct {
 	IssueDate   time.Time `json:"issue_date"`
 	ExpireDate  time.Time `json:"expire_date"`
 	ReissueDate time.Time `json:"reissue_date"`
+	Challenge   string    `json:"challenge,omitempty"`
+	KeyType     string    `json:"key_type,omitempty"`
+
+	// Since when the domain is no longer published
+	OrphanedSince time.Time `json:"orphaned_since,omitempty"`
+
+	// When to check again for the ARI renewal window
+	RenewalInfoNextCheck time.Time `json:"renewal_info_next_check,omitempty"`
 }
 
 type persistenceFile struct {
-	PrivateKey   string                        `json:"private_key"`
-	Email        string                        `json:"email"`
-	Registration *registration.Resource        `json:"registration,omitempty"`
-	Certificates map[string]*issuedCertificate `json:"certificates"`
+	PrivateKey    string                            `json:"private_key"`
+	Email         string                            `json:"email"`
+	Registration  *registration.Resource            `json:"registration,omitempty"`
+	Registrations map[string]*registration.Resource `json:"registrations,omitempty"`
+	Certificates  map[string]*issuedCertificate     `json:"certificates"`
+	Pending       map[string]*pendingCertificate    `json:"pending,omitempty"`
+	Issuers       map[string]string                 `json:"issuers,omitempty"`
+	Deleted       *stateTombstones                  `json:"deleted,omitempty"`
 }
 
 func CreateDefaultCertificateProvider(config DefaultCertificateProviderConfig) (*DefaultCertificateProvider, error) {
-	inst := &DefaultCertificateProvider{config, nil, nil, make(map[string]*issuedCertificate)}
+	if config.CADirURL == "" {
+		config.CADirURL = lego.LEDirectoryProduction
+	}
+	if config.KeyType == "" {
+		config.KeyType = string(certcrypto.RSA2048)
+	}
+	if !IsValidKeyType(config.KeyType) {
+		return nil, fmt.Errorf("Unsupported key type '%s'", config.KeyType)
+	}
+	if (config.EABKeyID == "") != (config.EABHMACKey == "") {
+		return nil, fmt.Errorf("Both the EAB key ID and HMAC key must be specified")
+	}
+	if config.Challenge == "" {
+		config.Challenge = ChallengeHTTP01
+	}
+	if !IsValidChallenge(config.Challenge) {
+		return nil, fmt.Errorf("Unsupported challenge type '%s'", config.Challenge)
+	}
+	if config.DNSProvider == "" && (config.Challenge == ChallengeDNS01 || len(config.Wildcards) > 0) {
+		return nil, fmt.Errorf("A DNS provider is required for DNS-01 challenges and wildcard certificates")
+	}
+	if config.RenewalFraction == 0 {
+		config.RenewalFraction = defaultRenewalFraction
+	}
+	if config.RenewalFraction <= 0 || config.RenewalFraction >= 1 {
+		return nil, fmt.Errorf("The renewal fraction must be between 0 and 1")
+	}
+	if config.OrphanGracePeriod == 0 {
+		config.OrphanGracePeriod = defaultOrphanGracePeriod
+	}
+	if config.Responder == nil {
+		config.Responder = CreateChallengeResponder(ChallengeResponderConfig{
+			HTTPPort: config.AuthPortHTTP,
+			TLSPort:  config.AuthPortHTTPS,
+		})
+	}
+	if config.IssueWorkers <= 0 {
+		config.IssueWorkers = 4
+	}
+	if config.Resolver == nil {
+		config.Resolver = net.DefaultResolver
+	}
+	if config.Encryption != nil && config.RuntimeDir == "" {
+		return nil, fmt.Errorf("A runtime directory is required for decrypting the certificates")
+	}
+	if config.Storage == nil {
+		config.Storage = CreateFileStorage(FileStorageConfig{Dir: config.ConfigDir})
+	}
+	if config.ExpiryWarning == 0 {
+		config.ExpiryWarning = 14 * 24 * time.Hour
+	}
+
+	inst := &DefaultCertificateProvider{
+		config:        config,
+		registrations: make(map[string]*registration.Resource),
+		certificates:  make(map[string]*issuedCertificate),
+		pending:       make(map[string]*pendingCertificate),
+		inflight:      make(map[string]bool),
+		issuers:       make(map[string]string),
+		deleted:       newStateTombstones(),
+		wakeup:        make(chan struct{}, 1),
+	}
+
+	// The stored state is enough for inspecting the provider
+	if config.ReadOnly {
+		err := inst.loadState()
+		if err != nil {
+			return nil, err
+		}
+		return inst, nil
+	}
 
 	// Create mssing directories
 	if _, err := os.Stat(config.ConfigDir); os.IsNotExist(err) {
@@ -60,6 +224,9 @@ func CreateDefaultCertificateProvider(config DefaultCertificateProviderConfig) (
 	if _, err := os.Stat(config.ConfigDir + "/cert"); os.IsNotExist(err) {
 		os.MkdirAll(config.ConfigDir+"/cert", 0700)
 	}
+	if _, err := os.Stat(inst.certDir()); os.IsNotExist(err) {
+		os.MkdirAll(inst.certDir(), 0700)
+	}
 
 	// Load state
 	err := inst.loadState()
@@ -67,90 +234,259 @@ func CreateDefaultCertificateProvider(config DefaultCertificateProviderConfig) (
 		return nil, err
 	}
 
+	// Copy the certificates from the storage for HAProxy
+	_, err = inst.syncCertificates(true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the state matches the certificates we actually have
+	err = inst.reconcileCertificates()
+	if err != nil {
+		return nil, err
+	}
+
 	return inst, nil
 }
 
-func (p *DefaultCertificateProvider) loadState() error {
-	var (
-		stateFilePath string = fmt.Sprintf("%s/state.json", p.config.ConfigDir)
-		state         persistenceFile
-		certNames     []string = nil
-	)
+const stateKey = "state.json"
 
-	// If we are missing persistence, generate new key
-	if _, err := os.Stat(stateFilePath); os.IsNotExist(err) {
-		log.Warnf("State file %s is missing, assuming new installation", stateFilePath)
-		return p.generateNewKey()
-	}
+// How many times to retry saving the state when another node saves it at
+// the same time
+const stateSaveAttempts = 10
 
-	// Load state from persistence
-	data, err := ioutil.ReadFile(stateFilePath)
+// readState reads the persisted state, returning nil if there is none, along
+// with its decrypted contents, whether it was encrypted and its version
+func (p *DefaultCertificateProvider) readState() (*persistenceFile, []byte, bool, uint64, error) {
+	data, version, err := p.config.Storage.LoadVersion(stateKey)
+	if err == ErrKeyNotFound {
+		return nil, nil, false, 0, nil
+	}
 	if err != nil {
-		return fmt.Errorf("Could not read state file: %s", err.Error())
+		return nil, nil, false, 0, fmt.Errorf("Could not read state file: %s", err.Error())
+	}
+
+	sealed := IsSealed(data)
+	if sealed {
+		if p.config.Encryption == nil {
+			return nil, nil, false, 0, fmt.Errorf("State file is encrypted, but no passphrase is configured")
+		}
+		data, err = p.config.Encryption.Open(data)
+		if err != nil {
+			return nil, nil, false, 0, fmt.Errorf("Could not decrypt state file: %s", err.Error())
+		}
 	}
+
+	var state persistenceFile
 	err = json.Unmarshal(data, &state)
 	if err != nil {
-		return fmt.Errorf("Could not parse state file: %s", err.Error())
+		return nil, nil, false, 0, fmt.Errorf("Could not parse state file: %s", err.Error())
 	}
+	return &state, data, sealed, version, nil
+}
 
-	// If the persisted e-mail is different, bail early
-	if state.Email != p.config.Email {
-		return fmt.Errorf("The persisted e-mail (%s) is different than the one given (%s)",
-			state.Email, p.config.Email)
+// parseAccountKey parses the account key of the given state
+func parseAccountKey(state *persistenceFile) (crypto.PrivateKey, error) {
+	data, err := base64.StdEncoding.DecodeString(state.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load private key: %s", err.Error())
+	}
+	key, err := x509.ParseECPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse private key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// accountRegistrations returns the registrations of the given state
+func accountRegistrations(state *persistenceFile) map[string]*registration.Resource {
+	registrations := state.Registrations
+	if registrations == nil {
+		registrations = make(map[string]*registration.Resource)
+	}
+
+	// Earlier versions only stored a single registration, that was always
+	// made against the Let's Encrypt production server
+	if state.Registration != nil {
+		if _, ok := registrations[lego.LEDirectoryProduction]; !ok {
+			registrations[lego.LEDirectoryProduction] = state.Registration
+		}
 	}
+	return registrations
+}
 
-	// Load the private key from the file
-	data, err = base64.StdEncoding.DecodeString(state.PrivateKey)
+func (p *DefaultCertificateProvider) loadState() error {
+	var certNames []string = nil
+
+	state, data, sealed, _, err := p.readState()
 	if err != nil {
-		return fmt.Errorf("Could not load private key: %s", err.Error())
+		return err
 	}
-	key, err := x509.ParseECPrivateKey(data)
+
+	// Import the state of the config directory when switching to a shared
+	// storage, so the existing account is kept
+	if _, local := p.config.Storage.(*FileStorage); state == nil && !local && !p.config.ReadOnly {
+		if localData, err := ioutil.ReadFile(filepath.Join(p.config.ConfigDir, stateKey)); err == nil {
+			log.Infof("Importing state file into %s", p.config.Storage)
+			err = p.config.Storage.Store(stateKey, localData)
+			if err != nil {
+				return fmt.Errorf("Could not import state file: %s", err.Error())
+			}
+			state, data, sealed, _, err = p.readState()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// If we are missing persistence, generate new key
+	if state == nil && p.config.ReadOnly {
+		log.Warnf("State file is missing from %s", p.config.Storage)
+		return nil
+	}
+	if state == nil {
+		log.Warnf("State file is missing from %s, assuming new installation", p.config.Storage)
+		return p.generateNewKey()
+	}
+
+	// The contact of the existing registrations is updated when started
+	p.contact = state.Email
+	if state.Email != p.config.Email {
+		log.Warnf("The account e-mail has changed from %s to %s", state.Email, p.config.Email)
+	}
+
+	key, err := parseAccountKey(state)
 	if err != nil {
-		return fmt.Errorf("Could not parse private key: %s", err.Error())
+		return err
 	}
 
 	p.userKey = key
-	p.userRegistration = state.Registration
-	p.certificates = state.Certificates
+	p.registrations = accountRegistrations(state)
+	if state.Certificates != nil {
+		p.certificates = state.Certificates
+	}
+	if state.Pending != nil {
+		p.pending = state.Pending
+	}
+	if state.Issuers != nil {
+		p.issuers = state.Issuers
+	}
+	if state.Deleted != nil {
+		p.deleted.merge(state.Deleted)
+	}
+	p.stateData = data
 
 	for domain := range p.certificates {
 		certNames = append(certNames, domain)
 	}
 
 	log.Infof("Recovered state from %s (Known certificates: %s)",
-		stateFilePath, strings.Join(certNames, ", "),
+		p.config.Storage, strings.Join(certNames, ", "),
 	)
 
+	// Encrypt the state stored in plain text by earlier versions
+	if !sealed && p.config.Encryption != nil && !p.config.ReadOnly {
+		log.Infof("Encrypting state file")
+		return p.saveState()
+	}
+
 	return nil
 }
 
+// saveState persists the provider state, merging the changes saved by other
+// nodes since it was last read. It must be called while holding the mutex,
+// unless the provider is not yet shared.
 func (p *DefaultCertificateProvider) saveState() error {
-	var (
-		stateFilePath string = fmt.Sprintf("%s/state.json", p.config.ConfigDir)
-		state         persistenceFile
-	)
+	if p.config.ReadOnly {
+		return fmt.Errorf("The state was opened read-only")
+	}
 
-	state.Email = p.config.Email
-	state.Registration = p.userRegistration
+	for attempt := 0; attempt < stateSaveAttempts; attempt++ {
+		remote, data, _, version, err := p.readState()
+		if err != nil {
+			return err
+		}
+		if remote != nil && !bytes.Equal(data, p.stateData) {
+			log.Infof("State was changed by another node, merging")
+			err = p.mergeState(remote)
+			if err != nil {
+				return err
+			}
+			p.stateData = data
+		}
+
+		bt, err := p.marshalState()
+		if err != nil {
+			return err
+		}
+		sealed := bt
+		if p.config.Encryption != nil {
+			sealed, err = p.config.Encryption.Seal(bt)
+			if err != nil {
+				return fmt.Errorf("Could not encrypt state: %s", err.Error())
+			}
+		}
+
+		ok, err := p.config.Storage.CompareAndSwap(stateKey, sealed, version)
+		if err != nil {
+			return fmt.Errorf("Could not write state file: %s", err.Error())
+		}
+		if ok {
+			p.stateData = bt
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Could not write state file: it keeps being changed by other nodes")
+}
+
+// marshalState encodes the provider state. It must be called while holding
+// the mutex.
+func (p *DefaultCertificateProvider) marshalState() ([]byte, error) {
+	var state persistenceFile
+
+	state.Email = p.contact
+	if state.Email == "" {
+		state.Email = p.config.Email
+	}
+	state.Registrations = p.registrations
+	state.Registration = p.registrations[lego.LEDirectoryProduction]
 	state.Certificates = p.certificates
+	state.Pending = p.pending
+	state.Issuers = p.issuers
+
+	p.deleted.prune()
+	if !p.deleted.empty() {
+		state.Deleted = &p.deleted
+	}
 
 	pKey, err := x509.MarshalECPrivateKey(p.userKey.(*ecdsa.PrivateKey))
 	if err != nil {
-		return fmt.Errorf("Could not marshal private key: %s", err.Error())
+		return nil, fmt.Errorf("Could not marshal private key: %s", err.Error())
 	}
 
 	state.PrivateKey = base64.StdEncoding.EncodeToString(pKey)
 
 	bt, err := json.Marshal(state)
 	if err != nil {
-		return fmt.Errorf("Could not marshal state: %s", err.Error())
-	}
-	err = ioutil.WriteFile(stateFilePath, bt, 0600)
-	if err != nil {
-		return fmt.Errorf("Could not write state file: %s", err.Error())
+		return nil, fmt.Errorf("Could not marshal state: %s", err.Error())
 	}
+	return bt, nil
+}
 
-	return nil
+// GetDomainIssuer returns the issuer persisted for the given domain
+func (p *DefaultCertificateProvider) GetDomainIssuer(domain string) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.issuers[domain]
+}
+
+// SetDomainIssuer persists the issuer of the given domain
+func (p *DefaultCertificateProvider) SetDomainIssuer(domain string, issuer string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.issuers[domain] = issuer
+	return p.saveState()
 }
 
 func (p *DefaultCertificateProvider) generateNewKey() error {
@@ -166,7 +502,16 @@ func (p *DefaultCertificateProvider) generateNewKey() error {
 func (p *DefaultCertificateProvider) GetDomainsToReissue() []string {
 	var domains []string = nil
 
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	for domain, cert := range p.certificates {
+		if _, ok := p.pending[domain]; ok {
+			continue
+		}
+		if p.orphanExpired(cert) {
+			continue
+		}
 		if time.Now().After(cert.ReissueDate) {
 			domains = append(domains, domain)
 		}
@@ -175,6 +520,22 @@ func (p *DefaultCertificateProvider) GetDomainsToReissue() []string {
 	return domains
 }
 
+// RegisterMetrics registers a collector that exports the expiry timestamps of
+// the known certificates in the given registry, labelled with the name of the
+// issuer the provider is registered as
+func (p *DefaultCertificateProvider) RegisterMetrics(registry *MetricsRegistry, issuer string) {
+	registry.RegisterCollector(func(w *MetricsWriter) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		for domain, cert := range p.certificates {
+			w.Gauge("dockerlb_certificate_expiry_timestamp_seconds",
+				"The expiry timestamp of the certificate, in seconds since epoch.",
+				map[string]string{"domain": domain, "issuer": issuer}, float64(cert.ExpireDate.Unix()))
+		}
+	})
+}
+
 func (p *DefaultCertificateProvider) GetAuthServicePort(ssl bool) int {
 	if ssl {
 		return p.config.AuthPortHTTPS
@@ -184,11 +545,20 @@ func (p *DefaultCertificateProvider) GetAuthServicePort(ssl bool) int {
 
 func (p *DefaultCertificateProvider) GetSelfSigned(domain string) (string, error) {
 	var (
-		certFilePath string = fmt.Sprintf("%s/cert/selfsigned-%s.pem", p.config.ConfigDir, domain)
+		certFilePath string = fmt.Sprintf("%s/selfsigned-%s.pem", p.certDir(), strings.Replace(domain, "*", "_", 1))
+		isValid      bool   = true
 	)
 
+	// Certificates created by earlier versions are missing the SAN that is
+	// required by modern clients
+	if cert, err := readCertificateFile(certFilePath); err != nil {
+		isValid = false
+	} else if domain != "" && len(cert.DNSNames) == 0 {
+		isValid = false
+	}
+
 	// Crate if missing
-	if _, err := os.Stat(certFilePath); os.IsNotExist(err) {
+	if !isValid {
 		priv, err := rsa.GenerateKey(rand.Reader, 2048)
 		if err != nil {
 			return "", fmt.Errorf("Could not generate private key: %s", err.Error())
@@ -216,6 +586,9 @@ func (p *DefaultCertificateProvider) GetSelfSigned(domain string) (string, error
 			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 			BasicConstraintsValid: true,
 		}
+		if domain != "" {
+			template.DNSNames = []string{domain}
+		}
 
 		// fmt.Printf("%+v (%s)\n", priv, reflect.TypeOf(priv))
 		derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
@@ -249,16 +622,100 @@ func (p *DefaultCertificateProvider) GetSelfSigned(domain string) (string, error
 	return certFilePath, nil
 }
 
-func (p *DefaultCertificateProvider) GetCertificateForDomain(domain string) (string, error) {
+// matchWildcard returns the wildcard domain that covers the given domain, if
+// we are configured to issue wildcard certificates for it
+func (p *DefaultCertificateProvider) matchWildcard(domain string) string {
+	for _, base := range p.config.Wildcards {
+		if strings.HasSuffix(domain, "."+base) {
+			if !strings.Contains(strings.TrimSuffix(domain, "."+base), ".") {
+				return "*." + base
+			}
+		}
+	}
+	return ""
+}
+
+// challengeFor picks the challenge used for validating the given domain
+func (p *DefaultCertificateProvider) challengeFor(domain string, opts CertificateOptions) string {
+	// Wildcard certificates can only be validated through DNS
+	if strings.HasPrefix(domain, "*.") {
+		return ChallengeDNS01
+	}
+	if opts.Challenge != "" {
+		return opts.Challenge
+	}
+	if cert, ok := p.certificates[domain]; ok && cert.Challenge != "" {
+		return cert.Challenge
+	}
+	return p.config.Challenge
+}
+
+// keyTypeFor picks the key type of the certificate of the given domain
+func (p *DefaultCertificateProvider) keyTypeFor(domain string, opts CertificateOptions) string {
+	if opts.KeyType != "" {
+		return opts.KeyType
+	}
+	if cert, ok := p.certificates[domain]; ok && cert.KeyType != "" {
+		return cert.KeyType
+	}
+	return p.config.KeyType
+}
+
+// certFilePath returns the path of the certificate given to HAProxy. Dual
+// certificates are stored in the `.ecdsa` and `.rsa` files next to it, that
+// are given to HAProxy instead when the path itself does not exist.
+func (p *DefaultCertificateProvider) certFilePath(domain string) string {
+	return fmt.Sprintf("%s/%s.pem", p.certDir(), strings.Replace(domain, "*", "_", 1))
+}
+
+// certFiles returns the files that actually hold the certificates of the
+// given domain
+func (p *DefaultCertificateProvider) certFiles(domain string) []string {
+	var files []string
+
+	base := p.certFilePath(domain)
+	for _, filename := range []string{base, base + ".ecdsa", base + ".rsa"} {
+		if _, err := os.Stat(filename); err == nil {
+			files = append(files, filename)
+			if filename == base {
+				break
+			}
+		}
+	}
+
+	return files
+}
+
+// leafFilePath returns the file with the certificate used for tracking the
+// validity of the certificates of the given domain
+func (p *DefaultCertificateProvider) leafFilePath(domain string) string {
+	if files := p.certFiles(domain); len(files) > 0 {
+		return files[0]
+	}
+	return p.certFilePath(domain)
+}
+
+// GetCertificateForDomain returns the path to the certificate of the given
+// domain. If the certificate is missing it is queued for issuing and a
+// self-signed placeholder is returned until the real one is available.
+func (p *DefaultCertificateProvider) GetCertificateForDomain(domain string, opts CertificateOptions) (string, error) {
+	if wildcard := p.matchWildcard(domain); wildcard != "" {
+		domain = wildcard
+	}
+
 	var (
-		certFilePath string = fmt.Sprintf("%s/cert/%s.pem", p.config.ConfigDir, domain)
+		certFilePath string = p.certFilePath(domain)
 		isValid      bool   = true
+		exists       bool   = true
 	)
 
+	p.mutex.Lock()
+
 	// Check validity
-	if _, err := os.Stat(certFilePath); os.IsNotExist(err) {
+	if len(p.certFiles(domain)) == 0 {
 		log.Warnf("Certificate for domain %s is missing, going to re-issue", domain)
 		isValid = false
+		exists = false
 	}
 	if isValid {
 		if cert, ok := p.certificates[domain]; ok {
@@ -272,39 +729,126 @@ func (p *DefaultCertificateProvider) GetCertificateForDomain(domain string) (str
 		}
 	}
 
-	// Crate if missing
+	// Queue for issuing if missing
 	if !isValid {
-		cert, err := p.getCertificateLetsEncrypt(domain)
+		err := p.enqueue(domain, opts)
 		if err != nil {
-			return "", fmt.Errorf("Could not create cert for %s: %s", domain, err.Error())
+			p.mutex.Unlock()
+			return "", err
 		}
+	}
+
+	p.mutex.Unlock()
+
+	// Keep serving the existing certificate until the new one is issued,
+	// otherwise use a self-signed placeholder
+	if exists {
+		return certFilePath, nil
+	}
+	return p.GetSelfSigned(domain)
+}
+
+// issueCertificate requests the certificate for the given domain from the CA
+// and stores it, returning an error if this was not possible
+func (p *DefaultCertificateProvider) issueCertificate(domain string, opts CertificateOptions) error {
+	p.mutex.Lock()
+	challengeType := p.challengeFor(domain, opts)
+	keyType := p.keyTypeFor(domain, opts)
+	p.mutex.Unlock()
 
-		err = cert.WriteTo(certFilePath)
+	// Obtain all the certificates before replacing any of the existing ones
+	var (
+		certs    []*Certificate
+		suffixes []string
+	)
+	for _, kt := range keyTypeVariants(keyType) {
+		cert, err := p.getCertificateLetsEncrypt(domain, challengeType, kt)
 		if err != nil {
-			return "", fmt.Errorf("Could not write cert for %s: %s", domain, err.Error())
+			DefaultMetrics.AddCounter("dockerlb_acme_issuance_total", "Total number of ACME certificate requests.",
+				map[string]string{"domain": domain, "result": "failure"}, 1)
+			return fmt.Errorf("Could not create cert for %s: %s", domain, err.Error())
 		}
+		DefaultMetrics.AddCounter("dockerlb_acme_issuance_total", "Total number of ACME certificate requests.",
+			map[string]string{"domain": domain, "result": "success"}, 1)
 
-		// Let's encrypt issues 90-day certificates, so cache this result for
-		// future certificate re-issuing
-		p.certificates[domain] = &issuedCertificate{
-			IssueDate:   time.Now(),
-			ExpireDate:  time.Now().Add(90 * 24 * time.Hour),
-			ReissueDate: time.Now().Add(75 * 24 * time.Hour), // Leave 15 days to manually fix
+		certs = append(certs, cert)
+		if keyType == KeyTypeDual {
+			suffixes = append(suffixes, keyTypeSuffix(kt))
+		} else {
+			suffixes = append(suffixes, "")
 		}
-		err = p.saveState()
+	}
+
+	base := p.certFilePath(domain)
+	for i, cert := range certs {
+		err := p.writeCertFile(base+suffixes[i], cert.Bytes())
 		if err != nil {
-			return "", fmt.Errorf("Could not save state: %s", err.Error())
+			return fmt.Errorf("Could not write cert for %s: %s", domain, err.Error())
 		}
 	}
 
-	return certFilePath, nil
+	// Remove the files of the previous key types, since the bundle is only
+	// used when the plain file is missing, and the OCSP responses of the
+	// previous certificates that are no longer valid
+	for _, suffix := range []string{"", ".ecdsa", ".rsa"} {
+		written := false
+		for _, sv := range suffixes {
+			written = written || sv == suffix
+		}
+		if !written {
+			p.removeCertFile(base + suffix)
+		}
+		os.Remove(base + suffix + ".ocsp")
+	}
+
+	// Schedule the renewal based on the actual lifetime of the certificate
+	leaf, err := certcrypto.ParsePEMCertificate(certs[0].Certificate)
+	if err != nil {
+		return fmt.Errorf("Could not parse cert for %s: %s", domain, err.Error())
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	rec := p.newIssuedCertificate(leaf)
+	rec.Challenge = challengeType
+	rec.KeyType = keyType
+	p.certificates[domain] = rec
+	delete(p.pending, domain)
+	err = p.saveState()
+	if err != nil {
+		return fmt.Errorf("Could not save state: %s", err.Error())
+	}
+
+	return nil
+}
+
+// readCertificateFile parses the first certificate in the given PEM file
+func readCertificateFile(filename string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("No certificate found in %s", filename)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
 }
 
-func (c *Certificate) WriteTo(filename string) error {
+// Bytes returns the PEM bundle HAProxy loads, with the private key followed
+// by the certificate chain
+func (c *Certificate) Bytes() []byte {
 	var buf []byte
 
 	buf = append(buf, c.PrivateKey...)
 	buf = append(buf, c.Certificate...)
 
-	return ioutil.WriteFile(filename, buf, 0600)
+	return buf
 }
@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-acme/lego/v3/lego"
+	"github.com/go-acme/lego/v3/registration"
+	log "github.com/sirupsen/logrus"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// AccountInfo describes the ACME account of a provider
+type AccountInfo struct {
+	ConfigDir     string
+	Email         string
+	RegisteredAs  string
+	Registrations map[string]string
+}
+
+// AccountInfo returns the details of the ACME account
+func (p *DefaultCertificateProvider) AccountInfo() AccountInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	info := AccountInfo{
+		ConfigDir:     p.config.ConfigDir,
+		Email:         p.config.Email,
+		RegisteredAs:  p.contact,
+		Registrations: make(map[string]string),
+	}
+	for caURL, reg := range p.registrations {
+		info.Registrations[caURL] = reg.URI
+	}
+	return info
+}
+
+func (i AccountInfo) String() string {
+	var lines []string
+
+	lines = append(lines, fmt.Sprintf("Config:     %s", i.ConfigDir))
+	lines = append(lines, fmt.Sprintf("Contact:    %s", i.Email))
+	if i.RegisteredAs != "" && i.RegisteredAs != i.Email {
+		lines = append(lines, fmt.Sprintf("Registered: %s (outdated)", i.RegisteredAs))
+	}
+
+	var urls []string
+	for caURL := range i.Registrations {
+		urls = append(urls, caURL)
+	}
+	sort.Strings(urls)
+	for _, caURL := range urls {
+		lines = append(lines, fmt.Sprintf("Account:    %s (%s)", i.Registrations[caURL], caURL))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// accountClient creates a lego client for the existing registration on the
+// configured CA
+func (p *DefaultCertificateProvider) accountClient() (*lego.Client, *registration.Resource, error) {
+	p.mutex.Lock()
+	myUser := acmeUser{
+		Email:        p.config.Email,
+		Registration: p.registrations[p.config.CADirURL],
+		key:          p.userKey,
+	}
+	p.mutex.Unlock()
+
+	if myUser.Registration == nil {
+		return nil, nil, fmt.Errorf("There is no account registered on %s", p.config.CADirURL)
+	}
+
+	config := lego.NewConfig(&myUser)
+	config.CADirURL = p.config.CADirURL
+	httpClient, err := p.acmeHTTPClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	config.HTTPClient = httpClient
+
+	client, err := lego.NewClient(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not create lego client: %s", err.Error())
+	}
+
+	return client, myUser.Registration, nil
+}
+
+// UpdateContact updates the contact of the existing registration to the
+// configured e-mail
+func (p *DefaultCertificateProvider) UpdateContact() error {
+	client, _, err := p.accountClient()
+	if err != nil {
+		return err
+	}
+
+	reg, err := client.Registration.UpdateRegistration(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		return fmt.Errorf("Could not update account contact: %s", err.Error())
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if reg.URI == "" {
+		reg.URI = p.registrations[p.config.CADirURL].URI
+	}
+	p.registrations[p.config.CADirURL] = reg
+	p.contact = p.config.Email
+	log.Infof("Updated the contact of account %s to %s", reg.URI, p.config.Email)
+	return p.saveState()
+}
+
+// Deactivate deactivates the account on the configured CA. A new account is
+// registered with a new key the next time a certificate is issued.
+func (p *DefaultCertificateProvider) Deactivate() error {
+	client, reg, err := p.accountClient()
+	if err != nil {
+		return err
+	}
+
+	err = client.Registration.DeleteRegistration()
+	if err != nil {
+		return fmt.Errorf("Could not deactivate account: %s", err.Error())
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	log.Infof("Deactivated account %s", reg.URI)
+	delete(p.registrations, p.config.CADirURL)
+
+	// The key of a deactivated account cannot be used again
+	if len(p.registrations) > 0 {
+		log.Warnf("The accounts on other CAs share the same key and will be registered again")
+		p.registrations = make(map[string]*registration.Resource)
+	}
+	return p.generateNewKey()
+}
+
+// acmeNonceSource fetches fresh nonces from the ACME server
+type acmeNonceSource struct {
+	client *http.Client
+	url    string
+}
+
+func (s *acmeNonceSource) Nonce() (string, error) {
+	resp, err := s.client.Head(s.url)
+	if err != nil {
+		return "", fmt.Errorf("Could not fetch nonce: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("Server did not respond with a nonce")
+	}
+	return nonce, nil
+}
+
+// RolloverKey replaces the account key with a new one, keeping the account
+func (p *DefaultCertificateProvider) RolloverKey() error {
+	p.mutex.Lock()
+	reg := p.registrations[p.config.CADirURL]
+	oldKey := p.userKey.(*ecdsa.PrivateKey)
+	p.mutex.Unlock()
+
+	if reg == nil {
+		return fmt.Errorf("There is no account registered on %s", p.config.CADirURL)
+	}
+
+	client, err := p.acmeHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Get(p.config.CADirURL)
+	if err != nil {
+		return fmt.Errorf("Could not fetch ACME directory: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	var directory struct {
+		NewNonce  string `json:"newNonce"`
+		KeyChange string `json:"keyChange"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&directory)
+	if err != nil {
+		return fmt.Errorf("Could not parse ACME directory: %s", err.Error())
+	}
+	if directory.KeyChange == "" {
+		return fmt.Errorf("The CA does not support key rollover")
+	}
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Could not generate private key: %s", err.Error())
+	}
+
+	// The inner JWS is signed by the new key, and proves its ownership
+	innerSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: newKey}, &jose.SignerOptions{
+		EmbedJWK:     true,
+		ExtraHeaders: map[jose.HeaderKey]interface{}{"url": directory.KeyChange},
+	})
+	if err != nil {
+		return fmt.Errorf("Could not create signer: %s", err.Error())
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"account": reg.URI,
+		"oldKey":  jose.JSONWebKey{Key: oldKey.Public()},
+	})
+	if err != nil {
+		return fmt.Errorf("Could not marshal key change: %s", err.Error())
+	}
+	inner, err := innerSigner.Sign(payload)
+	if err != nil {
+		return fmt.Errorf("Could not sign key change: %s", err.Error())
+	}
+
+	// The outer JWS is signed by the account key, as every other request
+	outerSigner, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.ES256,
+		Key:       jose.JSONWebKey{Key: oldKey, KeyID: reg.URI},
+	}, &jose.SignerOptions{
+		NonceSource:  &acmeNonceSource{client, directory.NewNonce},
+		ExtraHeaders: map[jose.HeaderKey]interface{}{"url": directory.KeyChange},
+	})
+	if err != nil {
+		return fmt.Errorf("Could not create signer: %s", err.Error())
+	}
+	outer, err := outerSigner.Sign([]byte(inner.FullSerialize()))
+	if err != nil {
+		return fmt.Errorf("Could not sign key change: %s", err.Error())
+	}
+
+	resp, err = client.Post(directory.KeyChange, "application/jose+json", bytes.NewReader([]byte(outer.FullSerialize())))
+	if err != nil {
+		return fmt.Errorf("Could not change account key: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Could not change account key: %s", strings.TrimSpace(string(data)))
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	log.Infof("Rolled over the key of account %s", reg.URI)
+	if len(p.registrations) > 1 {
+		log.Warnf("The accounts on other CAs used the previous key and will be registered again")
+		p.registrations = map[string]*registration.Resource{p.config.CADirURL: reg}
+	}
+	p.userKey = newKey
+	return p.saveState()
+}
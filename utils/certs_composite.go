@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	IssuerACME       = "acme"
+	IssuerSelfSigned = "selfsigned"
+	IssuerInternal   = "internal"
+	IssuerFile       = "file"
+)
+
+// IssuerStore persists the issuer chosen for every domain
+type IssuerStore interface {
+	GetDomainIssuer(domain string) string
+	SetDomainIssuer(domain string, issuer string) error
+}
+
+// coveringProvider is implemented by the providers that have certificates
+// only for a specific set of domains (eg. the ones loaded from files)
+type coveringProvider interface {
+	Covers(domain string) bool
+}
+
+type CompositeCertificateProviderConfig struct {
+	// The issuer used when none is specified for a domain
+	DefaultIssuer string
+
+	// The issuers that are used for all the domains they cover, regardless
+	// of the issuer requested
+	PriorityIssuers []string
+
+	// The issuers used by default for the domains with the given suffixes
+	// (eg. ".internal")
+	SuffixIssuers map[string]string
+
+	// Where the per-domain issuer is persisted
+	Store IssuerStore
+}
+
+// CompositeCertificateProvider dispatches the certificate requests to the
+// provider of the issuer chosen for every domain
+type CompositeCertificateProvider struct {
+	config    CompositeCertificateProviderConfig
+	mutex     sync.Mutex
+	providers map[string]CertificateProvider
+}
+
+func CreateCompositeCertificateProvider(config CompositeCertificateProviderConfig) *CompositeCertificateProvider {
+	if config.DefaultIssuer == "" {
+		config.DefaultIssuer = IssuerACME
+	}
+
+	return &CompositeCertificateProvider{
+		config:    config,
+		providers: make(map[string]CertificateProvider),
+	}
+}
+
+// AddIssuer registers the provider for the issuer with the given name
+func (p *CompositeCertificateProvider) AddIssuer(name string, provider CertificateProvider) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.providers[name] = provider
+}
+
+func (p *CompositeCertificateProvider) defaultProvider() (CertificateProvider, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	provider, ok := p.providers[p.config.DefaultIssuer]
+	if !ok {
+		return nil, fmt.Errorf("The default issuer '%s' is not configured", p.config.DefaultIssuer)
+	}
+	return provider, nil
+}
+
+// issuerFor picks the issuer of the given domain. The providers are called
+// without holding the mutex, since they might call back into this provider.
+func (p *CompositeCertificateProvider) issuerFor(domain string, opts CertificateOptions) string {
+	if opts.CertSecret != "" {
+		return IssuerFile
+	}
+
+	p.mutex.Lock()
+	priority := make([]CertificateProvider, len(p.config.PriorityIssuers))
+	for i, name := range p.config.PriorityIssuers {
+		priority[i] = p.providers[name]
+	}
+	p.mutex.Unlock()
+
+	for i, provider := range priority {
+		if cp, ok := provider.(coveringProvider); ok && cp.Covers(domain) {
+			return p.config.PriorityIssuers[i]
+		}
+	}
+	if opts.Issuer != "" {
+		return opts.Issuer
+	}
+	if p.config.Store != nil {
+		if issuer := p.config.Store.GetDomainIssuer(domain); issuer != "" {
+			return issuer
+		}
+	}
+	if issuer, ok := suffixIssuer(p.config.SuffixIssuers, domain); ok {
+		return issuer
+	}
+	return p.config.DefaultIssuer
+}
+
+// suffixIssuer returns the issuer of the longest suffix of the domain in the
+// given suffix issuers
+func suffixIssuer(issuers map[string]string, domain string) (string, bool) {
+	var (
+		match string
+		found bool
+	)
+	for suffix := range issuers {
+		if strings.HasSuffix(domain, suffix) && (!found || len(suffix) > len(match)) {
+			match = suffix
+			found = true
+		}
+	}
+	return issuers[match], found
+}
+
+func (p *CompositeCertificateProvider) GetSelfSigned(domain string) (string, error) {
+	provider, err := p.defaultProvider()
+	if err != nil {
+		return "", err
+	}
+	return provider.GetSelfSigned(domain)
+}
+
+func (p *CompositeCertificateProvider) GetCertificateForDomain(domain string, opts CertificateOptions) (string, error) {
+	issuer := p.issuerFor(domain, opts)
+
+	p.mutex.Lock()
+	provider, ok := p.providers[issuer]
+	p.mutex.Unlock()
+
+	if !ok {
+		log.Warnf("Unknown certificate issuer '%s' for domain %s, using a self-signed certificate", issuer, domain)
+		return p.GetSelfSigned(domain)
+	}
+
+	if p.config.Store != nil && p.config.Store.GetDomainIssuer(domain) != issuer {
+		log.Infof("Using issuer '%s' for domain %s", issuer, domain)
+		err := p.config.Store.SetDomainIssuer(domain, issuer)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return provider.GetCertificateForDomain(domain, opts)
+}
+
+func (p *CompositeCertificateProvider) GetAuthServicePort(ssl bool) int {
+	provider, err := p.defaultProvider()
+	if err != nil {
+		return 0
+	}
+	return provider.GetAuthServicePort(ssl)
+}
+
+func (p *CompositeCertificateProvider) GetDomainsToReissue() []string {
+	var (
+		domains []string
+		seen    = make(map[string]bool)
+	)
+
+	p.mutex.Lock()
+	providers := make([]CertificateProvider, 0, len(p.providers))
+	for _, provider := range p.providers {
+		providers = append(providers, provider)
+	}
+	p.mutex.Unlock()
+
+	for _, provider := range providers {
+		for _, domain := range provider.GetDomainsToReissue() {
+			if !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
+	}
+
+	sort.Strings(domains)
+	return domains
+}
+
+// SetActiveDomains passes every provider the active domains it issues the
+// certificates of
+func (p *CompositeCertificateProvider) SetActiveDomains(domains []string) {
+	byIssuer := make(map[string][]string)
+	for _, domain := range domains {
+		issuer := p.issuerFor(domain, CertificateOptions{})
+		byIssuer[issuer] = append(byIssuer[issuer], domain)
+	}
+
+	p.mutex.Lock()
+	trackers := make(map[string]activeDomainsTracker)
+	for name, provider := range p.providers {
+		if t, ok := provider.(activeDomainsTracker); ok {
+			trackers[name] = t
+		}
+	}
+	p.mutex.Unlock()
+
+	for name, t := range trackers {
+		t.SetActiveDomains(byIssuer[name])
+	}
+}
+
+func (p *CompositeCertificateProvider) SetUpdateHandler(handler func(domain string)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, provider := range p.providers {
+		provider.SetUpdateHandler(handler)
+	}
+}
+
+// SelfSignedCertificateProvider serves self-signed certificates for every
+// domain, created by the given provider
+type SelfSignedCertificateProvider struct {
+	base CertificateProvider
+}
+
+func CreateSelfSignedCertificateProvider(base CertificateProvider) *SelfSignedCertificateProvider {
+	return &SelfSignedCertificateProvider{base}
+}
+
+func (p *SelfSignedCertificateProvider) GetSelfSigned(domain string) (string, error) {
+	return p.base.GetSelfSigned(domain)
+}
+
+func (p *SelfSignedCertificateProvider) GetCertificateForDomain(domain string, opts CertificateOptions) (string, error) {
+	return p.base.GetSelfSigned(domain)
+}
+
+func (p *SelfSignedCertificateProvider) GetAuthServicePort(ssl bool) int {
+	return p.base.GetAuthServicePort(ssl)
+}
+
+func (p *SelfSignedCertificateProvider) GetDomainsToReissue() []string {
+	return nil
+}
+
+func (p *SelfSignedCertificateProvider) SetUpdateHandler(handler func(domain string)) {
+}
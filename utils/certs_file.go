@@ -0,0 +1,307 @@
+package utils
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type FileCertificateProviderConfig struct {
+	// The directory with the PEM bundles, each containing the certificate
+	// chain and the private key
+	Dir string
+
+	// The directory where docker mounts the secrets
+	SecretsDir string
+
+	// How often to check the directory for changes
+	PollInterval time.Duration
+}
+
+// FileCertificateProvider serves certificates loaded from PEM bundles on disk,
+// using the given fallback provider for the domains not covered by them
+type FileCertificateProvider struct {
+	config        FileCertificateProviderConfig
+	fallback      CertificateProvider
+	mutex         sync.Mutex
+	domains       map[string]*fileCertificate
+	signature     string
+	updateHandler func(domain string)
+}
+
+type fileCertificate struct {
+	Path     string
+	ModTime  time.Time
+	NotAfter time.Time
+}
+
+func CreateFileCertificateProvider(config FileCertificateProviderConfig, fallback CertificateProvider) (*FileCertificateProvider, error) {
+	if config.SecretsDir == "" {
+		config.SecretsDir = "/run/secrets"
+	}
+	if config.PollInterval == 0 {
+		config.PollInterval = 30 * time.Second
+	}
+
+	inst := &FileCertificateProvider{
+		config:   config,
+		fallback: fallback,
+		domains:  make(map[string]*fileCertificate),
+	}
+
+	_, err := inst.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	return inst, nil
+}
+
+// parseCertificateBundle parses the PEM bundle in the given file, making sure
+// it contains both a certificate and a private key
+func parseCertificateBundle(filename string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s: %s", filename, err.Error())
+	}
+
+	var (
+		leaf   *x509.Certificate = nil
+		hasKey bool              = false
+	)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" && leaf == nil {
+			leaf, err = x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse certificate in %s: %s", filename, err.Error())
+			}
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			hasKey = true
+		}
+	}
+
+	if leaf == nil {
+		return nil, fmt.Errorf("No certificate found in %s", filename)
+	}
+	if !hasKey {
+		return nil, fmt.Errorf("No private key found in %s", filename)
+	}
+
+	return leaf, nil
+}
+
+// certificateNames returns the names the certificate is valid for
+func certificateNames(cert *x509.Certificate) []string {
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames
+	}
+	if cert.Subject.CommonName != "" {
+		return []string{cert.Subject.CommonName}
+	}
+	return nil
+}
+
+// scan reloads the certificates in the directory, if it has changed, and
+// returns the domains whose certificate has changed
+func (p *FileCertificateProvider) scan() ([]string, error) {
+	if p.config.Dir == "" {
+		return nil, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(p.config.Dir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not list certificates: %s", err.Error())
+	}
+	sort.Strings(files)
+
+	// Quickly check if something has changed since the last scan
+	var sig []string
+	for _, filename := range files {
+		if st, err := os.Stat(filename); err == nil {
+			sig = append(sig, fmt.Sprintf("%s:%d:%d", filename, st.Size(), st.ModTime().UnixNano()))
+		}
+	}
+	signature := strings.Join(sig, "|")
+
+	p.mutex.Lock()
+	if signature == p.signature {
+		p.mutex.Unlock()
+		return nil, nil
+	}
+	p.mutex.Unlock()
+
+	domains := make(map[string]*fileCertificate)
+	for _, filename := range files {
+		st, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		cert, err := parseCertificateBundle(filename)
+		if err != nil {
+			log.Warnf("Ignoring certificate bundle: %s", err.Error())
+			continue
+		}
+		if time.Now().After(cert.NotAfter) {
+			log.Warnf("Certificate in %s has expired", filename)
+		}
+
+		for _, name := range certificateNames(cert) {
+			domains[strings.ToLower(name)] = &fileCertificate{
+				Path:     filename,
+				ModTime:  st.ModTime(),
+				NotAfter: cert.NotAfter,
+			}
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var changed []string
+	for domain, fc := range domains {
+		if prev, ok := p.domains[domain]; !ok || prev.Path != fc.Path || !prev.ModTime.Equal(fc.ModTime) {
+			changed = append(changed, domain)
+		}
+	}
+	for domain := range p.domains {
+		if _, ok := domains[domain]; !ok {
+			changed = append(changed, domain)
+		}
+	}
+	sort.Strings(changed)
+
+	p.domains = domains
+	p.signature = signature
+	if len(changed) > 0 {
+		log.Infof("Loaded certificates from %s (Changed domains: %s)", p.config.Dir, strings.Join(changed, ", "))
+	}
+
+	return changed, nil
+}
+
+// Start starts the thread that watches the certificate directory for changes
+func (p *FileCertificateProvider) Start() {
+	go func() {
+		for {
+			time.Sleep(p.config.PollInterval)
+
+			changed, err := p.scan()
+			if err != nil {
+				log.Errorf("Could not reload certificates: %s", err.Error())
+				continue
+			}
+
+			p.mutex.Lock()
+			handler := p.updateHandler
+			p.mutex.Unlock()
+			if handler != nil {
+				for _, domain := range changed {
+					handler(domain)
+				}
+			}
+		}
+	}()
+}
+
+// lookup finds the certificate that covers the given domain, either
+// explicitly or through a wildcard
+func (p *FileCertificateProvider) lookup(domain string) *fileCertificate {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	domain = strings.ToLower(domain)
+	if fc, ok := p.domains[domain]; ok {
+		return fc
+	}
+	if idx := strings.Index(domain, "."); idx > 0 {
+		if fc, ok := p.domains["*"+domain[idx:]]; ok {
+			return fc
+		}
+	}
+	return nil
+}
+
+// Covers checks if there is a certificate on disk for the given domain
+func (p *FileCertificateProvider) Covers(domain string) bool {
+	return p.lookup(domain) != nil
+}
+
+func (p *FileCertificateProvider) GetSelfSigned(domain string) (string, error) {
+	return p.fallback.GetSelfSigned(domain)
+}
+
+func (p *FileCertificateProvider) GetCertificateForDomain(domain string, opts CertificateOptions) (string, error) {
+	// Certificates explicitly given as docker secrets
+	if opts.CertSecret != "" {
+		filename := filepath.Join(p.config.SecretsDir, filepath.Base(opts.CertSecret))
+		cert, err := parseCertificateBundle(filename)
+		if err != nil {
+			return "", fmt.Errorf("Could not load certificate secret for %s: %s", domain, err.Error())
+		}
+		if err := cert.VerifyHostname(domain); err != nil {
+			log.Warnf("Certificate secret %s is not valid for %s", opts.CertSecret, domain)
+		}
+		return filename, nil
+	}
+
+	if fc := p.lookup(domain); fc != nil {
+		return fc.Path, nil
+	}
+
+	return p.fallback.GetCertificateForDomain(domain, opts)
+}
+
+func (p *FileCertificateProvider) GetAuthServicePort(ssl bool) int {
+	return p.fallback.GetAuthServicePort(ssl)
+}
+
+func (p *FileCertificateProvider) GetDomainsToReissue() []string {
+	var domains []string
+
+	// Never renew through the fallback domains we have certificates for
+	for _, domain := range p.fallback.GetDomainsToReissue() {
+		if !p.Covers(domain) {
+			domains = append(domains, domain)
+		}
+	}
+
+	return domains
+}
+
+func (p *FileCertificateProvider) SetUpdateHandler(handler func(domain string)) {
+	p.mutex.Lock()
+	p.updateHandler = handler
+	p.mutex.Unlock()
+
+	p.fallback.SetUpdateHandler(handler)
+}
+
+// RegisterMetrics registers a collector that exports the expiry timestamps of
+// the certificates on disk in the given registry, under the "file" issuer
+func (p *FileCertificateProvider) RegisterMetrics(registry *MetricsRegistry) {
+	registry.RegisterCollector(func(w *MetricsWriter) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		for domain, fc := range p.domains {
+			w.Gauge("dockerlb_certificate_expiry_timestamp_seconds",
+				"The expiry timestamp of the certificate, in seconds since epoch.",
+				map[string]string{"domain": domain, "issuer": IssuerFile}, float64(fc.NotAfter.Unix()))
+		}
+	})
+}
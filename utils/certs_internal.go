@@ -0,0 +1,466 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	internalRootLifetime         = 10 * 365 * 24 * time.Hour
+	internalIntermediateLifetime = 365 * 24 * time.Hour
+)
+
+type InternalCertificateProviderConfig struct {
+	// The directory of the CA, where the issued certificates are written for
+	// HAProxy unless they are encrypted
+	Dir string
+
+	// The storage of the CA keys and the issued certificates. Defaults to the
+	// CA directory.
+	Storage Storage
+
+	// Encrypts the keys in the storage. The issued certificates are then
+	// decrypted into the runtime directory, that should be a tmpfs.
+	Encryption *SecretBox
+	RuntimeDir string
+
+	// The organization in the subject of the CA certificates
+	Organization string
+
+	// The validity period of the issued certificates
+	LeafLifetime time.Duration
+}
+
+// InternalCertificateProvider issues certificates from a local CA, for the
+// private domains that cannot be validated through ACME
+type InternalCertificateProvider struct {
+	config           InternalCertificateProviderConfig
+	mutex            sync.Mutex
+	root             *x509.Certificate
+	rootPEM          []byte
+	intermediate     *x509.Certificate
+	intermediatePEM  []byte
+	intermediateKey  crypto.Signer
+	updateHandler    func(domain string)
+	selfSignedSource CertificateProvider
+}
+
+func CreateInternalCertificateProvider(config InternalCertificateProviderConfig, selfSigned CertificateProvider) (*InternalCertificateProvider, error) {
+	if config.LeafLifetime == 0 {
+		config.LeafLifetime = 7 * 24 * time.Hour
+	}
+	if config.Encryption != nil && config.RuntimeDir == "" {
+		return nil, fmt.Errorf("A runtime directory is required for decrypting the internal certificates")
+	}
+	if config.Storage == nil {
+		config.Storage = CreateFileStorage(FileStorageConfig{Dir: config.Dir})
+	}
+
+	inst := &InternalCertificateProvider{
+		config:           config,
+		selfSignedSource: selfSigned,
+	}
+	if _, err := os.Stat(inst.certDir()); os.IsNotExist(err) {
+		os.MkdirAll(inst.certDir(), 0700)
+	}
+
+	err := inst.loadCA()
+	if err != nil {
+		return nil, err
+	}
+
+	return inst, nil
+}
+
+func generateSerialNumber() (*big.Int, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate serial number: %s", err.Error())
+	}
+	return serialNumber, nil
+}
+
+// loadKey reads the given key from the storage, decrypting it if needed. The
+// keys of earlier versions, that were kept in plain text in the CA directory,
+// are imported into the storage and encrypted.
+func (p *InternalCertificateProvider) loadKey(key string) ([]byte, error) {
+	data, err := p.config.Storage.Load(key)
+	if err == ErrKeyNotFound {
+		if _, local := p.config.Storage.(*FileStorage); local {
+			return nil, err
+		}
+		data, err = ioutil.ReadFile(filepath.Join(p.config.Dir, filepath.FromSlash(key)))
+		if os.IsNotExist(err) {
+			return nil, ErrKeyNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Importing %s of the internal CA into %s", key, p.config.Storage)
+		return data, p.storeKey(key, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if IsSealed(data) {
+		if p.config.Encryption == nil {
+			return nil, fmt.Errorf("%s is encrypted, but no passphrase is configured", key)
+		}
+		return p.config.Encryption.Open(data)
+	}
+	if p.config.Encryption != nil {
+		log.Infof("Encrypting %s of the internal CA", key)
+		return data, p.storeKey(key, data)
+	}
+	return data, nil
+}
+
+// storeKey writes the given key to the storage, encrypting it if needed
+func (p *InternalCertificateProvider) storeKey(key string, data []byte) error {
+	if p.config.Encryption != nil {
+		sealed, err := p.config.Encryption.Seal(data)
+		if err != nil {
+			return err
+		}
+		data = sealed
+	}
+	return p.config.Storage.Store(key, data)
+}
+
+// loadKeyPair reads the certificate and the private key with the given name
+// from the storage
+func (p *InternalCertificateProvider) loadKeyPair(name string) (*x509.Certificate, []byte, crypto.Signer, error) {
+	certPEM, err := p.loadKey(name + ".pem")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, nil, fmt.Errorf("No certificate found in %s.pem", name)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Could not parse %s.pem: %s", name, err.Error())
+	}
+
+	keyPEM, err := p.loadKey(name + ".key")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, nil, fmt.Errorf("No private key found in %s.key", name)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Could not parse %s.key: %s", name, err.Error())
+	}
+
+	return cert, certPEM, key, nil
+}
+
+// createKeyPair creates a CA certificate signed by the given parent, and
+// stores it with its private key under the given name
+func (p *InternalCertificateProvider) createKeyPair(template *x509.Certificate, parent *x509.Certificate, parentKey crypto.Signer, name string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Could not generate private key: %s", err.Error())
+	}
+	if parent == nil {
+		parent, parentKey = template, priv
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &priv.PublicKey, parentKey)
+	if err != nil {
+		return fmt.Errorf("Failed to create certificate: %s", err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal private key: %s", err.Error())
+	}
+
+	err = p.storeKey(name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	if err != nil {
+		return fmt.Errorf("Failed to write %s.key: %s", name, err.Error())
+	}
+	err = p.storeKey(name+".pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if err != nil {
+		return fmt.Errorf("Failed to write %s.pem: %s", name, err.Error())
+	}
+
+	return nil
+}
+
+// loadCA loads the root and intermediate CA from the storage, creating them
+// if they are missing. The intermediate is replaced when it is about to expire.
+func (p *InternalCertificateProvider) loadCA() error {
+	root, rootPEM, rootPriv, err := p.loadKeyPair("root")
+	if err == ErrKeyNotFound {
+		log.Infof("Creating internal root CA in %s", p.config.Storage)
+		var serial *big.Int
+		serial, err = generateSerialNumber()
+		if err != nil {
+			return err
+		}
+		err = p.createKeyPair(&x509.Certificate{
+			SerialNumber: serial,
+			Subject: pkix.Name{
+				Organization: []string{p.config.Organization},
+				CommonName:   p.config.Organization + " Internal Root CA",
+			},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(internalRootLifetime),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLen:            1,
+		}, nil, nil, "root")
+		if err != nil {
+			return err
+		}
+		root, rootPEM, rootPriv, err = p.loadKeyPair("root")
+	}
+	if err != nil {
+		return fmt.Errorf("Could not load internal root CA: %s", err.Error())
+	}
+
+	// Renew the intermediate when a third of its lifetime is left
+	intermediate, _, _, err := p.loadKeyPair("intermediate")
+	if err != nil || time.Now().After(intermediate.NotAfter.Add(-internalIntermediateLifetime/3)) {
+		log.Infof("Creating internal intermediate CA in %s", p.config.Storage)
+		serial, err := generateSerialNumber()
+		if err != nil {
+			return err
+		}
+		err = p.createKeyPair(&x509.Certificate{
+			SerialNumber: serial,
+			Subject: pkix.Name{
+				Organization: []string{p.config.Organization},
+				CommonName:   p.config.Organization + " Internal Intermediate CA",
+			},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(internalIntermediateLifetime),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}, root, rootPriv, "intermediate")
+		if err != nil {
+			return err
+		}
+	}
+
+	intermediate, intermediatePEM, intermediateKey, err := p.loadKeyPair("intermediate")
+	if err != nil {
+		return fmt.Errorf("Could not load internal intermediate CA: %s", err.Error())
+	}
+
+	p.root = root
+	p.rootPEM = rootPEM
+	p.intermediate = intermediate
+	p.intermediatePEM = intermediatePEM
+	p.intermediateKey = intermediateKey
+	return nil
+}
+
+// certDir returns the directory HAProxy loads the issued certificates from
+func (p *InternalCertificateProvider) certDir() string {
+	if p.config.Encryption != nil {
+		return filepath.Join(p.config.RuntimeDir, "cert")
+	}
+	return filepath.Join(p.config.Dir, "cert")
+}
+
+func (p *InternalCertificateProvider) certFilePath(domain string) string {
+	return filepath.Join(p.certDir(), strings.Replace(domain, "*", "_", 1)+".pem")
+}
+
+// writeCertFileAtomic writes the given certificate atomically, since HAProxy might
+// be reading the previous one
+func writeCertFileAtomic(filename string, data []byte) error {
+	err := ioutil.WriteFile(filename+".tmp", data, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %s", filename, err.Error())
+	}
+	err = os.Rename(filename+".tmp", filename)
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %s", filename, err.Error())
+	}
+	return nil
+}
+
+// restoreCertificate copies the issued certificate from the storage into the
+// certificate directory, eg. after a restart cleared the runtime directory
+func (p *InternalCertificateProvider) restoreCertificate(filename string) (*x509.Certificate, error) {
+	data, err := p.loadKey(storageKey(filename))
+	if err != nil {
+		return nil, err
+	}
+	err = writeCertFileAtomic(filename, data)
+	if err != nil {
+		return nil, err
+	}
+	return readCertificateFile(filename)
+}
+
+// renewalDate computes when the given certificate should be renewed
+func (p *InternalCertificateProvider) renewalDate(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(time.Duration(float64(lifetime) * defaultRenewalFraction))
+}
+
+// issueCertificate signs a new certificate for the given domain with the
+// intermediate CA. It must be called while holding the mutex.
+func (p *InternalCertificateProvider) issueCertificate(domain string) error {
+	if time.Now().After(p.intermediate.NotAfter.Add(-internalIntermediateLifetime / 3)) {
+		err := p.loadCA()
+		if err != nil {
+			return err
+		}
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Could not generate private key: %s", err.Error())
+	}
+	serial, err := generateSerialNumber()
+	if err != nil {
+		return err
+	}
+
+	notAfter := time.Now().Add(p.config.LeafLifetime)
+	if notAfter.After(p.intermediate.NotAfter) {
+		notAfter = p.intermediate.NotAfter
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{p.config.Organization},
+			CommonName:   domain,
+		},
+		DNSNames:              []string{domain},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, p.intermediate, &priv.PublicKey, p.intermediateKey)
+	if err != nil {
+		return fmt.Errorf("Failed to create certificate: %s", err.Error())
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal private key: %s", err.Error())
+	}
+
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	bundle = append(bundle, p.intermediatePEM...)
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})...)
+
+	filename := p.certFilePath(domain)
+	err = p.storeKey(storageKey(filename), bundle)
+	if err != nil {
+		return fmt.Errorf("Failed to store %s: %s", filename, err.Error())
+	}
+	err = writeCertFileAtomic(filename, bundle)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Issued internal certificate for domain %s", domain)
+	DefaultMetrics.AddCounter("dockerlb_internal_certificates_issued_total",
+		"Total number of certificates issued by the internal CA.", nil, 1)
+	return nil
+}
+
+func (p *InternalCertificateProvider) GetSelfSigned(domain string) (string, error) {
+	return p.selfSignedSource.GetSelfSigned(domain)
+}
+
+func (p *InternalCertificateProvider) GetCertificateForDomain(domain string, opts CertificateOptions) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	filename := p.certFilePath(domain)
+	cert, err := readCertificateFile(filename)
+	if err != nil {
+		cert, err = p.restoreCertificate(filename)
+	}
+	if err == nil && time.Now().Before(p.renewalDate(cert)) {
+		return filename, nil
+	}
+
+	err = p.issueCertificate(domain)
+	if err != nil {
+		return "", fmt.Errorf("Could not issue internal certificate for %s: %s", domain, err.Error())
+	}
+
+	// Renewed certificates must be picked up by HAProxy
+	if cert != nil && p.updateHandler != nil {
+		go p.updateHandler(domain)
+	}
+
+	return filename, nil
+}
+
+func (p *InternalCertificateProvider) GetAuthServicePort(ssl bool) int {
+	return p.selfSignedSource.GetAuthServicePort(ssl)
+}
+
+func (p *InternalCertificateProvider) GetDomainsToReissue() []string {
+	var domains []string
+
+	files, err := filepath.Glob(filepath.Join(p.certDir(), "*.pem"))
+	if err != nil {
+		return nil
+	}
+	for _, filename := range files {
+		cert, err := readCertificateFile(filename)
+		if err != nil {
+			continue
+		}
+		if time.Now().After(p.renewalDate(cert)) {
+			domain := strings.TrimSuffix(filepath.Base(filename), ".pem")
+			if strings.HasPrefix(domain, "_.") {
+				domain = "*" + domain[1:]
+			}
+			domains = append(domains, domain)
+		}
+	}
+
+	sort.Strings(domains)
+	return domains
+}
+
+func (p *InternalCertificateProvider) SetUpdateHandler(handler func(domain string)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.updateHandler = handler
+}
+
+// ServeHTTP serves the root certificate, so it can be installed in the trust
+// store of the machines accessing the internal domains
+func (p *InternalCertificateProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"root.pem\"")
+	w.Write(p.rootPEM)
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultOrphanGracePeriod = 7 * 24 * time.Hour
+
+// activeDomainsTracker is implemented by the providers that clean up the
+// certificates of the domains that are no longer published
+type activeDomainsTracker interface {
+	SetActiveDomains(domains []string)
+}
+
+// CertificateStatus describes a certificate managed by a provider
+type CertificateStatus struct {
+	Domain        string
+	ExpireDate    time.Time
+	ReissueDate   time.Time
+	OrphanedSince time.Time
+	Pending       bool
+	LastError     string
+}
+
+// orphanExpired checks if the grace period of an orphaned certificate has
+// passed, so it should no longer be renewed
+func (p *DefaultCertificateProvider) orphanExpired(rec *issuedCertificate) bool {
+	return !rec.OrphanedSince.IsZero() && time.Now().After(rec.OrphanedSince.Add(p.config.OrphanGracePeriod))
+}
+
+// SetActiveDomains marks the certificates of the domains that are not in the
+// given list as orphaned, and the ones that are as active again
+func (p *DefaultCertificateProvider) SetActiveDomains(domains []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	active := make(map[string]bool)
+	for _, domain := range domains {
+		active[domain] = true
+		if wildcard := p.matchWildcard(domain); wildcard != "" {
+			active[wildcard] = true
+		}
+	}
+
+	changed := false
+	for domain, rec := range p.certificates {
+		if active[domain] && !rec.OrphanedSince.IsZero() {
+			log.Infof("Certificate for domain %s is in use again", domain)
+			rec.OrphanedSince = time.Time{}
+			changed = true
+		}
+		if !active[domain] && rec.OrphanedSince.IsZero() {
+			log.Infof("Certificate for domain %s is no longer in use, going to archive it after %s",
+				domain, p.config.OrphanGracePeriod)
+			rec.OrphanedSince = time.Now()
+			changed = true
+		}
+	}
+
+	// There is no point issuing certificates nobody is going to use
+	for domain := range p.pending {
+		if !active[domain] {
+			log.Infof("Domain %s is no longer in use, cancelling the pending certificate", domain)
+			delete(p.pending, domain)
+			p.deleted.Pending[domain] = time.Now()
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := p.saveState(); err != nil {
+			log.Errorf("Could not save state: %s", err.Error())
+		}
+	}
+}
+
+// ListCertificates returns the status of the managed certificates
+func (p *DefaultCertificateProvider) ListCertificates() []CertificateStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var list []CertificateStatus
+	for domain, rec := range p.certificates {
+		status := CertificateStatus{
+			Domain:        domain,
+			ExpireDate:    rec.ExpireDate,
+			ReissueDate:   rec.ReissueDate,
+			OrphanedSince: rec.OrphanedSince,
+		}
+		if pc, ok := p.pending[domain]; ok {
+			status.Pending = true
+			status.LastError = pc.LastError
+		}
+		list = append(list, status)
+	}
+
+	// The domains that were never issued are only pending
+	for domain, pc := range p.pending {
+		if _, ok := p.certificates[domain]; !ok {
+			list = append(list, CertificateStatus{
+				Domain:    domain,
+				Pending:   true,
+				LastError: pc.LastError,
+			})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+	return list
+}
+
+// archiveOrphans archives the orphaned certificates whose grace period has
+// passed
+func (p *DefaultCertificateProvider) archiveOrphans() {
+	var domains []string
+
+	p.mutex.Lock()
+	for domain, rec := range p.certificates {
+		if p.orphanExpired(rec) {
+			domains = append(domains, domain)
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, domain := range domains {
+		err := p.Purge(domain, p.config.RevokeOrphaned)
+		if err != nil {
+			log.Errorf("Could not archive certificate of %s: %s", domain, err.Error())
+		}
+	}
+}
+
+// revokeCertificate revokes the certificates of the given domain on the CA
+func (p *DefaultCertificateProvider) revokeCertificate(domain string) error {
+	client, _, err := p.accountClient()
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range p.certFiles(domain) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("Could not read %s: %s", filename, err.Error())
+		}
+		err = client.Certificate.Revoke(data)
+		if err != nil {
+			return fmt.Errorf("Could not revoke %s: %s", filename, err.Error())
+		}
+		log.Infof("Revoked certificate %s", filename)
+	}
+
+	return nil
+}
+
+// Purge removes the certificate of the given domain from the store, moving
+// its files to the archive directory, and optionally revokes it
+func (p *DefaultCertificateProvider) Purge(domain string, revoke bool) error {
+	if revoke {
+		err := p.revokeCertificate(domain)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	archivePrefix := "archive/" + strings.Replace(domain, "*", "_", 1) + "-" + time.Now().UTC().Format("20060102150405") + "/"
+	for _, filename := range p.certFiles(domain) {
+		// The stored copy is archived, that is encrypted when encryption is
+		// enabled, along with the OCSP response
+		data, err := p.config.Storage.Load(storageKey(filename))
+		if err != nil && err != ErrKeyNotFound {
+			return fmt.Errorf("Could not read %s: %s", storageKey(filename), err.Error())
+		}
+		if err == nil {
+			if err := p.config.Storage.Store(archivePrefix+filepath.Base(filename), data); err != nil {
+				return fmt.Errorf("Could not archive %s: %s", filename, err.Error())
+			}
+		}
+		if data, err := ioutil.ReadFile(filename + ".ocsp"); err == nil {
+			if err := p.config.Storage.Store(archivePrefix+filepath.Base(filename)+".ocsp", data); err != nil {
+				return fmt.Errorf("Could not archive %s.ocsp: %s", filename, err.Error())
+			}
+		}
+
+		p.removeCertFile(filename)
+		os.Remove(filename + ".ocsp")
+	}
+
+	// The removal is recorded, so merging the state of another node does not
+	// bring the domain back
+	now := time.Now()
+	delete(p.certificates, domain)
+	delete(p.pending, domain)
+	delete(p.issuers, domain)
+	p.deleted.Certificates[domain] = now
+	p.deleted.Pending[domain] = now
+	p.deleted.Issuers[domain] = now
+
+	log.Infof("Archived certificate for domain %s", domain)
+	DefaultMetrics.AddCounter("dockerlb_certificates_archived_total",
+		"Total number of certificates archived.", nil, 1)
+	return p.saveState()
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge/http01"
+)
+
+// Pre-flight failures do not cost anything on the CA, so they are retried
+// more often than the actual issuing failures
+const preflightRetryMax = 15 * time.Minute
+
+// DomainResolver resolves the addresses of a domain. It is implemented by
+// net.Resolver, and replaced in the tests.
+type DomainResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// preflightError is returned when a domain fails the pre-flight checks, and
+// was therefore not sent to the CA
+type preflightError struct {
+	reason string
+}
+
+func (e *preflightError) Error() string {
+	return "Pre-flight check failed: " + e.reason
+}
+
+// preflightCheck makes sure the CA is going to be able to validate the given
+// domain before requesting its certificate, to avoid burning the rate limits
+// on domains that do not point to us yet
+func (p *DefaultCertificateProvider) preflightCheck(domain string, opts CertificateOptions) error {
+	p.mutex.Lock()
+	challengeType := p.challengeFor(domain, opts)
+	p.mutex.Unlock()
+
+	// The DNS-01 challenges do not depend on where the domain points to
+	if challengeType == ChallengeDNS01 {
+		return nil
+	}
+
+	if len(p.config.PublicIPs) > 0 {
+		err := p.checkDomainAddresses(domain)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.config.SelfTestAddr != "" && challengeType == ChallengeHTTP01 {
+		err := p.checkSelfTest(domain)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkDomainAddresses checks that all the addresses of the domain are public
+// addresses of this node, since the CA may validate against any of them
+func (p *DefaultCertificateProvider) checkDomainAddresses(domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addrs, err := p.config.Resolver.LookupHost(ctx, domain)
+	if err != nil {
+		return &preflightError{fmt.Sprintf("could not resolve %s: %s", domain, err.Error())}
+	}
+	if len(addrs) == 0 {
+		return &preflightError{fmt.Sprintf("%s has no addresses", domain)}
+	}
+
+	public := make(map[string]bool)
+	for _, ip := range p.config.PublicIPs {
+		if parsed := net.ParseIP(strings.TrimSpace(ip)); parsed != nil {
+			public[parsed.String()] = true
+		}
+	}
+
+	var foreign []string
+	for _, addr := range addrs {
+		parsed := net.ParseIP(addr)
+		if parsed == nil || !public[parsed.String()] {
+			foreign = append(foreign, addr)
+		}
+	}
+	if len(foreign) > 0 {
+		sort.Strings(foreign)
+		return &preflightError{fmt.Sprintf("%s points to %s, which is not a public address of this node",
+			domain, strings.Join(foreign, ", "))}
+	}
+
+	return nil
+}
+
+// checkSelfTest serves a random token through the challenge responder and
+// fetches it through our own HTTP frontend, making sure the challenges of the
+// domain are routed to us
+func (p *DefaultCertificateProvider) checkSelfTest(domain string) error {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("Could not generate self-test token: %s", err.Error())
+	}
+	token := "self-test-" + hex.EncodeToString(buf)
+	expected := token + "." + domain
+
+	provider := p.config.Responder.HTTP01()
+	provider.Present(domain, token, expected)
+	defer provider.CleanUp(domain, token, expected)
+
+	req, err := http.NewRequest("GET", "http://"+p.config.SelfTestAddr+http01.ChallengePath(token), nil)
+	if err != nil {
+		return fmt.Errorf("Could not create self-test request: %s", err.Error())
+	}
+	req.Host = domain
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &preflightError{fmt.Sprintf("HTTP self-test of %s failed: %s", domain, err.Error())}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &preflightError{fmt.Sprintf("HTTP self-test of %s failed: %s", domain, err.Error())}
+	}
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != expected {
+		return &preflightError{fmt.Sprintf("HTTP self-test of %s failed: the challenge was not answered (HTTP %d)",
+			domain, resp.StatusCode)}
+	}
+
+	return nil
+}
@@ -0,0 +1,274 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	issueRetryMin = 1 * time.Minute
+	issueRetryMax = 24 * time.Hour
+
+	// How long to wait for another node issuing the same certificate
+	issueLockRetry = 5 * time.Minute
+
+	// After how many consecutive failures a renewal is notified
+	renewalFailuresNotify = 3
+)
+
+// pendingCertificate is a certificate waiting to be issued. It is persisted in
+// the state, so the retry back-off survives restarts.
+type pendingCertificate struct {
+	Options     CertificateOptions `json:"options"`
+	Failures    int                `json:"failures"`
+	NextAttempt time.Time          `json:"next_attempt"`
+	LastError   string             `json:"last_error,omitempty"`
+}
+
+// retryBackoff returns the time to wait before retrying after the given
+// number of consecutive failures
+func retryBackoff(failures int) time.Duration {
+	delay := issueRetryMin
+	for i := 1; i < failures && delay < issueRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > issueRetryMax {
+		delay = issueRetryMax
+	}
+	return delay
+}
+
+// SetUpdateHandler registers the function to call every time a certificate
+// is issued or renewed in the background
+func (p *DefaultCertificateProvider) SetUpdateHandler(handler func(domain string)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.updateHandler = handler
+}
+
+// Start starts the background thread that issues the queued certificates
+func (p *DefaultCertificateProvider) Start() {
+	p.mutex.Lock()
+	contactChanged := p.contact != p.config.Email && p.registrations[p.config.CADirURL] != nil
+	p.mutex.Unlock()
+
+	p.config.Responder.Start()
+	p.config.Storage.Watch(stateKey, p.storageChanged)
+	go func() {
+		if contactChanged {
+			err := p.UpdateContact()
+			if err != nil {
+				log.Errorf("Could not update the account contact: %s", err.Error())
+			}
+		}
+		p.issueThread()
+	}()
+}
+
+// isLeader checks if this node runs the periodic maintenance of the
+// certificates, that is always the case without locks
+func (p *DefaultCertificateProvider) isLeader() bool {
+	return p.config.Locks == nil || p.config.Locks.IsLeader()
+}
+
+// enqueue queues the domain for issuing. It must be called while holding the
+// mutex.
+func (p *DefaultCertificateProvider) enqueue(domain string, opts CertificateOptions) error {
+	if pc, ok := p.pending[domain]; ok {
+		// The renewal thread requests the certificates without any options,
+		// which must not override the ones of the route
+		if opts != (CertificateOptions{}) && opts != pc.Options {
+			pc.Options = opts
+			return p.saveState()
+		}
+		return nil
+	}
+
+	p.pending[domain] = &pendingCertificate{
+		Options:     opts,
+		NextAttempt: time.Now(),
+	}
+	err := p.saveState()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dueDomains returns the pending domains whose next attempt is due
+func (p *DefaultCertificateProvider) dueDomains() []string {
+	var domains []string
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	for domain, pc := range p.pending {
+		if !now.Before(pc.NextAttempt) {
+			domains = append(domains, domain)
+		}
+	}
+
+	sort.Strings(domains)
+	return domains
+}
+
+func (p *DefaultCertificateProvider) issueThread() {
+	log.Info("Starting certificate issuing thread")
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	// Issue up to the configured number of certificates in parallel
+	workers := make(chan struct{}, p.config.IssueWorkers)
+
+	for {
+		for _, domain := range p.dueDomains() {
+			p.mutex.Lock()
+			busy := p.inflight[domain]
+			p.inflight[domain] = true
+			p.mutex.Unlock()
+			if busy {
+				continue
+			}
+
+			workers <- struct{}{}
+			go func(domain string) {
+				defer func() {
+					p.mutex.Lock()
+					delete(p.inflight, domain)
+					p.mutex.Unlock()
+					<-workers
+				}()
+				p.issuePending(domain)
+			}(domain)
+		}
+
+		select {
+		case <-p.wakeup:
+		case <-ticker.C:
+			if p.isLeader() {
+				p.refreshRenewalInfo()
+				p.archiveOrphans()
+				p.checkExpiry()
+			}
+		}
+	}
+}
+
+func (p *DefaultCertificateProvider) issuePending(domain string) {
+	p.mutex.Lock()
+	pc, ok := p.pending[domain]
+	if !ok {
+		p.mutex.Unlock()
+		return
+	}
+	opts := pc.Options
+	_, renewal := p.certificates[domain]
+	p.mutex.Unlock()
+
+	if p.config.Locks != nil {
+		locked, err := p.config.Locks.TryLock("issue/" + domain)
+		if err != nil || !locked {
+			if err != nil {
+				log.Errorf("Could not lock domain %s: %s", domain, err.Error())
+			} else {
+				log.Infof("Certificate for domain %s is being issued by another node", domain)
+			}
+			p.mutex.Lock()
+			if pc, ok := p.pending[domain]; ok {
+				pc.NextAttempt = time.Now().Add(issueLockRetry)
+			}
+			p.mutex.Unlock()
+			return
+		}
+		defer p.config.Locks.Unlock("issue/" + domain)
+
+		// Pick up the certificate if another node issued it meanwhile
+		p.storageChanged()
+		p.mutex.Lock()
+		_, ok := p.pending[domain]
+		p.mutex.Unlock()
+		if !ok {
+			return
+		}
+	}
+
+	err := p.preflightCheck(domain, opts)
+	if err == nil {
+		log.Infof("Issuing certificate for domain %s", domain)
+		err = p.issueCertificate(domain, opts)
+	}
+	if err != nil {
+		_, preflight := err.(*preflightError)
+		if preflight {
+			DefaultMetrics.AddCounter("dockerlb_preflight_failures_total",
+				"Total number of domains that failed the pre-flight checks.", map[string]string{"domain": domain}, 1)
+		}
+
+		// The entry might have been replaced while issuing, by merging the
+		// state of another node, or removed if the domain is no longer used
+		p.mutex.Lock()
+		pc, ok = p.pending[domain]
+		if !ok {
+			p.mutex.Unlock()
+			log.Errorf("Error issuing certificate for domain %s, that is no longer pending: %s", domain, err.Error())
+			return
+		}
+		pc.Failures++
+		delay := retryBackoff(pc.Failures)
+		if preflight && delay > preflightRetryMax {
+			delay = preflightRetryMax
+		}
+		pc.NextAttempt = time.Now().Add(delay)
+		pc.LastError = err.Error()
+		failures, nextAttempt := pc.Failures, pc.NextAttempt
+		current := p.certificates[domain]
+		if err := p.saveState(); err != nil {
+			log.Errorf("Could not save state: %s", err.Error())
+		}
+		p.mutex.Unlock()
+
+		log.Errorf("Error issuing certificate (attempt %d, retrying at %s): %s",
+			failures, nextAttempt.Format(time.RFC3339), err.Error())
+		if !renewal {
+			p.config.Notifier.Notify(EventIssueFailed, domain, fmt.Sprintf(
+				"Could not issue the certificate (attempt %d, retrying at %s): %s",
+				failures, nextAttempt.Format(time.RFC3339), err.Error()))
+		} else if failures >= renewalFailuresNotify && current != nil {
+			p.config.Notifier.Notify(EventRenewalFailed, domain, fmt.Sprintf(
+				"Could not renew the certificate that expires at %s (attempt %d, retrying at %s): %s",
+				current.ExpireDate.Format(time.RFC3339), failures, nextAttempt.Format(time.RFC3339), err.Error()))
+		}
+		return
+	}
+
+	log.Infof("Certificate for domain %s was issued", domain)
+
+	p.mutex.Lock()
+	handler := p.updateHandler
+	var expireDate time.Time
+	if rec, ok := p.certificates[domain]; ok {
+		expireDate = rec.ExpireDate
+	}
+	p.mutex.Unlock()
+
+	if renewal {
+		p.config.Notifier.Notify(EventRenewed, domain, fmt.Sprintf(
+			"The certificate was renewed, and expires at %s", expireDate.Format(time.RFC3339)))
+	} else {
+		p.config.Notifier.Notify(EventIssued, domain, fmt.Sprintf(
+			"The certificate was issued, and expires at %s", expireDate.Format(time.RFC3339)))
+	}
+
+	if handler != nil {
+		handler(domain)
+	}
+}
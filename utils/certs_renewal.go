@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRenewalFraction = 2.0 / 3.0
+	renewalInfoInterval    = 6 * time.Hour
+)
+
+// renewalInfo is the response of the ACME Renewal Information (ARI) endpoint
+type renewalInfo struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+}
+
+// renewalDate computes the time the given certificate should be renewed, at
+// the configured fraction of its lifetime
+func (p *DefaultCertificateProvider) renewalDate(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(time.Duration(float64(lifetime) * p.config.RenewalFraction))
+}
+
+// newIssuedCertificate creates the state record of the given certificate,
+// based on its actual validity period
+func (p *DefaultCertificateProvider) newIssuedCertificate(cert *x509.Certificate) *issuedCertificate {
+	return &issuedCertificate{
+		IssueDate:   cert.NotBefore,
+		ExpireDate:  cert.NotAfter,
+		ReissueDate: p.renewalDate(cert),
+	}
+}
+
+// reconcileCertificates updates the state with the certificates actually found
+// in the certificate directory. It must be called while holding the mutex,
+// unless the provider is not yet shared.
+func (p *DefaultCertificateProvider) reconcileCertificates() error {
+	files, err := filepath.Glob(filepath.Join(p.certDir(), "*"))
+	if err != nil {
+		return fmt.Errorf("Could not list certificates: %s", err.Error())
+	}
+
+	found := make(map[string]bool)
+	for _, filename := range files {
+		// Dual certificates are stored in two files
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(filename), ".ecdsa"), ".rsa")
+		if strings.HasPrefix(name, "selfsigned-") || !strings.HasSuffix(name, ".pem") {
+			continue
+		}
+		domain := strings.TrimSuffix(name, ".pem")
+		if strings.HasPrefix(domain, "_.") {
+			domain = "*" + domain[1:]
+		}
+		if found[domain] {
+			continue
+		}
+
+		filename = p.leafFilePath(domain)
+		cert, err := readCertificateFile(filename)
+		if err != nil {
+			log.Warnf("Could not parse certificate %s: %s", filename, err.Error())
+			continue
+		}
+		found[domain] = true
+
+		rec, ok := p.certificates[domain]
+		if !ok {
+			log.Infof("Found untracked certificate for domain %s", domain)
+			p.certificates[domain] = p.newIssuedCertificate(cert)
+			continue
+		}
+		if !rec.ExpireDate.Equal(cert.NotAfter) || !rec.IssueDate.Equal(cert.NotBefore) {
+			log.Infof("Updating the validity of the certificate for domain %s", domain)
+			updated := p.newIssuedCertificate(cert)
+			updated.Challenge = rec.Challenge
+			updated.KeyType = rec.KeyType
+			updated.OrphanedSince = rec.OrphanedSince
+			p.certificates[domain] = updated
+		}
+	}
+
+	for domain := range p.certificates {
+		if !found[domain] {
+			log.Warnf("Certificate for domain %s is missing from the store", domain)
+			delete(p.certificates, domain)
+		}
+	}
+
+	return p.saveState()
+}
+
+// ariCertID computes the certificate identifier used by the ARI endpoint
+func ariCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", fmt.Errorf("Certificate has no authority key identifier")
+	}
+
+	// The serial is encoded as a DER integer, without the tag and length
+	serial := cert.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// fetchRenewalInfo queries the ARI endpoint of the CA, if there is one, for
+// the suggested renewal window of the certificate. It returns nil if the CA
+// does not support ARI.
+func (p *DefaultCertificateProvider) fetchRenewalInfo(cert *x509.Certificate) (*renewalInfo, time.Duration, error) {
+	client, err := p.acmeHTTPClient()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := client.Get(p.config.CADirURL)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not fetch ACME directory: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	var directory struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&directory)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not parse ACME directory: %s", err.Error())
+	}
+	if directory.RenewalInfo == "" {
+		return nil, 0, nil
+	}
+
+	certID, err := ariCertID(cert)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err = client.Get(strings.TrimSuffix(directory.RenewalInfo, "/") + "/" + certID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not fetch renewal info: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not read renewal info: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("Renewal info request failed with status %d", resp.StatusCode)
+	}
+
+	var info renewalInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not parse renewal info: %s", err.Error())
+	}
+
+	retryAfter := renewalInfoInterval
+	if sv := resp.Header.Get("Retry-After"); sv != "" {
+		if secs, err := strconv.Atoi(sv); err == nil && secs > 0 {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+	}
+
+	return &info, retryAfter, nil
+}
+
+// refreshRenewalInfo updates the renewal date of the certificates from the
+// ARI window suggested by the CA, for all the certificates that are due for
+// a check
+func (p *DefaultCertificateProvider) refreshRenewalInfo() {
+	var domains []string
+
+	p.mutex.Lock()
+	now := time.Now()
+	for domain, rec := range p.certificates {
+		if now.After(rec.RenewalInfoNextCheck) {
+			domains = append(domains, domain)
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, domain := range domains {
+		cert, err := readCertificateFile(p.leafFilePath(domain))
+		if err != nil {
+			continue
+		}
+
+		info, retryAfter, err := p.fetchRenewalInfo(cert)
+		if err != nil {
+			log.Warnf("Could not check the renewal info of %s: %s", domain, err.Error())
+			retryAfter = renewalInfoInterval
+		}
+
+		p.mutex.Lock()
+		if rec, ok := p.certificates[domain]; ok {
+			rec.RenewalInfoNextCheck = time.Now().Add(retryAfter)
+
+			// Pick a random time in the suggested window
+			if info != nil && info.SuggestedWindow.End.After(info.SuggestedWindow.Start) {
+				window := info.SuggestedWindow.End.Sub(info.SuggestedWindow.Start)
+				date := info.SuggestedWindow.Start.Add(time.Duration(rand.Int63n(int64(window))))
+				if rec.ReissueDate.Before(info.SuggestedWindow.Start) || rec.ReissueDate.After(info.SuggestedWindow.End) {
+					log.Infof("CA suggests renewing the certificate of %s at %s", domain, date.Format(time.RFC3339))
+					rec.ReissueDate = date
+				}
+			}
+		}
+		if err := p.saveState(); err != nil {
+			log.Errorf("Could not save state: %s", err.Error())
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// checkExpiry notifies about the certificates close to expiry, which can only
+// happen if their renewal keeps failing. Orphaned certificates are skipped,
+// since they are not renewed on purpose.
+func (p *DefaultCertificateProvider) checkExpiry() {
+	if p.config.Notifier == nil {
+		return
+	}
+
+	expiring := make(map[string]time.Time)
+	p.mutex.Lock()
+	for domain, rec := range p.certificates {
+		if rec.OrphanedSince.IsZero() && time.Until(rec.ExpireDate) < p.config.ExpiryWarning {
+			expiring[domain] = rec.ExpireDate
+		}
+	}
+	p.mutex.Unlock()
+
+	for domain, expireDate := range expiring {
+		days := int(time.Until(expireDate).Hours() / 24)
+		p.config.Notifier.Notify(EventExpiring, domain, fmt.Sprintf(
+			"The certificate expires in %d days, at %s", days, expireDate.Format(time.RFC3339)))
+	}
+}
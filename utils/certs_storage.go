@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certDir returns the directory HAProxy loads the certificates from. When
+// encryption is enabled, the certificates are stored encrypted and decrypted
+// into the runtime directory, that should be a tmpfs.
+func (p *DefaultCertificateProvider) certDir() string {
+	if p.config.Encryption != nil {
+		return filepath.Join(p.config.RuntimeDir, "cert")
+	}
+	return filepath.Join(p.config.ConfigDir, "cert")
+}
+
+// storageKey returns the key of the given file of the certificate directory
+// in the storage
+func storageKey(filename string) string {
+	return "cert/" + filepath.Base(filename)
+}
+
+// isStoredCertFile checks if the given file of the certificate directory is
+// kept in the storage. Placeholders are created again when needed, and the
+// OCSP responses are fetched by every node.
+func isStoredCertFile(name string) bool {
+	return !strings.HasPrefix(name, "selfsigned-") && !strings.HasSuffix(name, ".ocsp") && !strings.HasSuffix(name, ".tmp")
+}
+
+// writeLocalFile writes the given file unless it already has the given
+// contents, returning whether it was changed
+func writeLocalFile(filename string, data []byte) (bool, error) {
+	if current, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	return true, ioutil.WriteFile(filename, data, 0600)
+}
+
+// writeCertFile writes the given file of the certificate directory, and its
+// (encrypted) copy in the storage
+func (p *DefaultCertificateProvider) writeCertFile(filename string, data []byte) error {
+	_, err := writeLocalFile(filename, data)
+	if err != nil {
+		return err
+	}
+
+	if p.config.Encryption != nil {
+		data, err = p.config.Encryption.Seal(data)
+		if err != nil {
+			return err
+		}
+	}
+	return p.config.Storage.Store(storageKey(filename), data)
+}
+
+// removeCertFile removes the given file of the certificate directory, and its
+// copy in the storage
+func (p *DefaultCertificateProvider) removeCertFile(filename string) {
+	os.Remove(filename)
+	err := p.config.Storage.Delete(storageKey(filename))
+	if err != nil {
+		log.Warnf("Could not delete %s: %s", storageKey(filename), err.Error())
+	}
+}
+
+// syncCertificates copies the certificates from the storage into the
+// certificate directory, and returns the domains whose certificates changed.
+// Initially, the certificates missing from the storage are imported, and the
+// ones stored in plain text are encrypted. Afterwards, they are removed since
+// another node purged them.
+func (p *DefaultCertificateProvider) syncCertificates(initial bool) ([]string, error) {
+	var changed []string
+
+	keys, err := p.config.Storage.List("cert/")
+	if err != nil {
+		return nil, fmt.Errorf("Could not list certificates: %s", err.Error())
+	}
+
+	stored := make(map[string]bool)
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, "cert/")
+		if !isStoredCertFile(name) || strings.Contains(name, "/") {
+			continue
+		}
+		stored[name] = true
+
+		data, err := p.config.Storage.Load(key)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %s", key, err.Error())
+		}
+
+		filename := filepath.Join(p.certDir(), name)
+		if IsSealed(data) {
+			if p.config.Encryption == nil {
+				return nil, fmt.Errorf("Certificate %s is encrypted, but no passphrase is configured", key)
+			}
+			data, err = p.config.Encryption.Open(data)
+			if err != nil {
+				return nil, fmt.Errorf("Could not decrypt %s: %s", key, err.Error())
+			}
+		} else if p.config.Encryption != nil {
+			log.Infof("Encrypting certificate %s", key)
+			err = p.writeCertFile(filename, data)
+			if err != nil {
+				return nil, fmt.Errorf("Could not encrypt %s: %s", key, err.Error())
+			}
+		}
+
+		wrote, err := writeLocalFile(filename, data)
+		if err != nil {
+			return nil, fmt.Errorf("Could not write %s: %s", filename, err.Error())
+		}
+		if wrote {
+			changed = append(changed, certFileDomain(name))
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(p.certDir(), "*"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not list certificates: %s", err.Error())
+	}
+	for _, filename := range files {
+		name := filepath.Base(filename)
+		if !isStoredCertFile(name) || stored[name] {
+			continue
+		}
+
+		if initial {
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read %s: %s", filename, err.Error())
+			}
+			log.Infof("Importing certificate %s into %s", filename, p.config.Storage)
+			err = p.writeCertFile(filename, data)
+			if err != nil {
+				return nil, fmt.Errorf("Could not import %s: %s", filename, err.Error())
+			}
+		} else {
+			log.Infof("Certificate %s was removed from %s", filename, p.config.Storage)
+			os.Remove(filename)
+			os.Remove(filename + ".ocsp")
+			changed = append(changed, certFileDomain(name))
+		}
+	}
+
+	return changed, nil
+}
+
+// certFileDomain returns the domain of the given certificate file name
+func certFileDomain(name string) string {
+	domain := strings.TrimSuffix(strings.TrimSuffix(name, ".ecdsa"), ".rsa")
+	domain = strings.TrimSuffix(domain, ".pem")
+	if strings.HasPrefix(domain, "_.") {
+		domain = "*" + domain[1:]
+	}
+	return domain
+}
+
+// How long to remember the removed entries of the state, that must be longer
+// than a node can go without saving or reloading the state
+const tombstoneRetention = 30 * 24 * time.Hour
+
+// stateTombstones records when the certificates, the pending certificates and
+// the issuers of the domains were removed from the state, so that merging the
+// state of a node that has not seen the removal yet does not bring them back
+type stateTombstones struct {
+	Certificates map[string]time.Time `json:"certificates,omitempty"`
+	Pending      map[string]time.Time `json:"pending,omitempty"`
+	Issuers      map[string]time.Time `json:"issuers,omitempty"`
+}
+
+func newStateTombstones() stateTombstones {
+	return stateTombstones{
+		Certificates: make(map[string]time.Time),
+		Pending:      make(map[string]time.Time),
+		Issuers:      make(map[string]time.Time),
+	}
+}
+
+// merge keeps the most recent removal of every entry of the given tombstones
+func (t *stateTombstones) merge(other *stateTombstones) {
+	mergeRemovals(t.Certificates, other.Certificates)
+	mergeRemovals(t.Pending, other.Pending)
+	mergeRemovals(t.Issuers, other.Issuers)
+}
+
+func mergeRemovals(removals map[string]time.Time, other map[string]time.Time) {
+	for domain, removed := range other {
+		if removed.After(removals[domain]) {
+			removals[domain] = removed
+		}
+	}
+}
+
+// prune forgets the removals older than the retention period
+func (t *stateTombstones) prune() {
+	for _, removals := range []map[string]time.Time{t.Certificates, t.Pending, t.Issuers} {
+		for domain, removed := range removals {
+			if time.Since(removed) > tombstoneRetention {
+				delete(removals, domain)
+			}
+		}
+	}
+}
+
+func (t *stateTombstones) empty() bool {
+	return len(t.Certificates) == 0 && len(t.Pending) == 0 && len(t.Issuers) == 0
+}
+
+// knowsRemoval checks if the removals of a state include the last removal of
+// the domain in the other ones, so its entry in that state came afterwards
+func knowsRemoval(removals map[string]time.Time, other map[string]time.Time, domain string) bool {
+	removed, ok := other[domain]
+	return !ok || !removals[domain].Before(removed)
+}
+
+// mergeState merges the state persisted by another node into ours. The
+// account is shared, and the most recent certificate of every domain wins.
+// The entries removed by one of the nodes are dropped, unless they were added
+// again after the removal. It must be called while holding the mutex.
+func (p *DefaultCertificateProvider) mergeState(state *persistenceFile) error {
+	key, err := parseAccountKey(state)
+	if err != nil {
+		return err
+	}
+	p.userKey = key
+	p.registrations = accountRegistrations(state)
+	p.contact = state.Email
+
+	deleted := state.Deleted
+	if deleted == nil {
+		empty := newStateTombstones()
+		deleted = &empty
+	}
+
+	for domain, rec := range state.Certificates {
+		if !knowsRemoval(deleted.Certificates, p.deleted.Certificates, domain) {
+			continue
+		}
+		if current, ok := p.certificates[domain]; ok && current.IssueDate.After(rec.IssueDate) {
+			continue
+		}
+		p.certificates[domain] = rec
+
+		// Another node issued the certificate we were waiting for
+		if _, ok := p.pending[domain]; ok && time.Now().Before(rec.ReissueDate) {
+			delete(p.pending, domain)
+		}
+	}
+	for domain := range p.certificates {
+		if _, ok := state.Certificates[domain]; !ok && !knowsRemoval(p.deleted.Certificates, deleted.Certificates, domain) {
+			delete(p.certificates, domain)
+		}
+	}
+
+	for domain, pc := range state.Pending {
+		if _, ok := p.pending[domain]; ok || !knowsRemoval(deleted.Pending, p.deleted.Pending, domain) {
+			continue
+		}
+
+		// We issued the certificate the other node was waiting for
+		if current, ok := p.certificates[domain]; ok {
+			if theirs, ok := state.Certificates[domain]; !ok || current.IssueDate.After(theirs.IssueDate) {
+				continue
+			}
+		}
+		p.pending[domain] = pc
+	}
+	for domain := range p.pending {
+		if _, ok := state.Pending[domain]; !ok && !knowsRemoval(p.deleted.Pending, deleted.Pending, domain) {
+			delete(p.pending, domain)
+		}
+	}
+
+	for domain, issuer := range state.Issuers {
+		if knowsRemoval(deleted.Issuers, p.deleted.Issuers, domain) {
+			p.issuers[domain] = issuer
+		}
+	}
+	for domain := range p.issuers {
+		if _, ok := state.Issuers[domain]; !ok && !knowsRemoval(p.deleted.Issuers, deleted.Issuers, domain) {
+			delete(p.issuers, domain)
+		}
+	}
+
+	p.deleted.merge(deleted)
+	return nil
+}
+
+// storageChanged picks up the changes made to the storage by other nodes
+func (p *DefaultCertificateProvider) storageChanged() {
+	p.mutex.Lock()
+
+	// The state is read while holding the mutex, so it is not older than the
+	// one we saved in the meantime. Our own changes are notified as well.
+	state, data, _, _, err := p.readState()
+	if err != nil {
+		p.mutex.Unlock()
+		log.Errorf("Could not reload state: %s", err.Error())
+		return
+	}
+	if state != nil && !bytes.Equal(data, p.stateData) {
+		log.Infof("State was changed by another node, reloading")
+		err = p.mergeState(state)
+		if err != nil {
+			log.Errorf("Could not reload state: %s", err.Error())
+		}
+		p.stateData = data
+	}
+
+	changed, err := p.syncCertificates(false)
+	if err != nil {
+		log.Errorf("Could not sync certificates: %s", err.Error())
+	}
+	if len(changed) > 0 {
+		err = p.reconcileCertificates()
+		if err != nil {
+			log.Errorf("Could not reconcile certificates: %s", err.Error())
+		}
+	}
+	handler := p.updateHandler
+	p.mutex.Unlock()
+
+	if handler != nil {
+		for _, domain := range changed {
+			handler(domain)
+		}
+	}
+}
@@ -0,0 +1,734 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v3/registration"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func createTestCertificateProvider(t *testing.T) (*DefaultCertificateProvider, func()) {
+	configDir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := CreateDefaultCertificateProvider(DefaultCertificateProviderConfig{
+		ConfigDir:    configDir,
+		Email:        "test@example.com",
+		Organization: "Test",
+	})
+	if err != nil {
+		os.RemoveAll(configDir)
+		t.Fatal(err)
+	}
+
+	return p, func() { os.RemoveAll(configDir) }
+}
+
+func TestPlaceholderCertificate(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	certPath, err := p.GetCertificateForDomain("foo.com", CertificateOptions{Challenge: ChallengeTLSALPN01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certPath == p.certFilePath("foo.com") {
+		t.Fatalf("Expected a placeholder certificate, got %s", certPath)
+	}
+
+	cert, err := readCertificateFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "foo.com" {
+		t.Errorf("Expected the placeholder to have the domain as SAN, got %+v", cert.DNSNames)
+	}
+
+	pc, ok := p.pending["foo.com"]
+	if !ok {
+		t.Fatalf("Expected the domain to be queued for issuing")
+	}
+	if pc.Options.Challenge != ChallengeTLSALPN01 {
+		t.Errorf("Expected the certificate options to be kept, got %+v", pc.Options)
+	}
+
+	// Later changes of the route options apply to the pending domain, but the
+	// renewal thread does not reset them
+	p.GetCertificateForDomain("foo.com", CertificateOptions{Challenge: ChallengeTLSALPN01, KeyType: "P256"})
+	p.GetCertificateForDomain("foo.com", CertificateOptions{})
+	if pc.Options.KeyType != "P256" {
+		t.Errorf("Expected the certificate options to be updated, got %+v", pc.Options)
+	}
+
+	// The queue must survive restarts
+	p2, err := CreateDefaultCertificateProvider(p.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p2.pending["foo.com"]; !ok {
+		t.Errorf("Expected the pending certificate to be persisted")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		5:  16 * time.Minute,
+		20: 24 * time.Hour,
+	}
+	for failures, expect := range cases {
+		if v := retryBackoff(failures); v != expect {
+			t.Errorf("Expected %s after %d failures, got %s", expect, failures, v)
+		}
+	}
+}
+
+func writeTestCertificate(t *testing.T, filename string, notBefore, notAfter time.Time) *x509.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:   big.NewInt(0x87654321),
+		Subject:        pkix.Name{CommonName: "foo.com"},
+		DNSNames:       []string{"foo.com"},
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+		AuthorityKeyId: []byte{1, 2, 3, 4},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestReconcileCertificates(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	notBefore := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	notAfter := notBefore.Add(30 * 24 * time.Hour)
+	writeTestCertificate(t, p.certFilePath("foo.com"), notBefore, notAfter)
+
+	p.certificates["missing.com"] = &issuedCertificate{}
+	p.saveState()
+
+	p2, err := CreateDefaultCertificateProvider(p.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, ok := p2.certificates["foo.com"]
+	if !ok {
+		t.Fatalf("Expected the certificate found on disk to be tracked")
+	}
+	if !rec.ExpireDate.Equal(notAfter) {
+		t.Errorf("Expected expiry %s, got %s", notAfter, rec.ExpireDate)
+	}
+	if expect := notBefore.Add(20 * 24 * time.Hour); !rec.ReissueDate.Equal(expect) {
+		t.Errorf("Expected renewal at %s, got %s", expect, rec.ReissueDate)
+	}
+	if _, ok := p2.certificates["missing.com"]; ok {
+		t.Errorf("Expected the missing certificate to be removed from the state")
+	}
+}
+
+func TestRenewalInfo(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	windowStart := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	windowEnd := windowStart.Add(time.Hour)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/directory":
+			fmt.Fprintf(w, `{"renewalInfo": "%s/ari"}`, server.URL)
+		case "/ari/AQIDBA.AIdlQyE":
+			w.Header().Set("Retry-After", "3600")
+			fmt.Fprintf(w, `{"suggestedWindow": {"start": "%s", "end": "%s"}}`,
+				windowStart.Format(time.RFC3339), windowEnd.Format(time.RFC3339))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	p.config.CADirURL = server.URL + "/directory"
+
+	writeTestCertificate(t, p.certFilePath("foo.com"), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour))
+	if err := p.reconcileCertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.refreshRenewalInfo()
+
+	rec := p.certificates["foo.com"]
+	if rec.ReissueDate.Before(windowStart) || rec.ReissueDate.After(windowEnd) {
+		t.Errorf("Expected the renewal date to be in the ARI window, got %s", rec.ReissueDate)
+	}
+	if rec.RenewalInfoNextCheck.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("Expected the Retry-After header to be honored, got %s", rec.RenewalInfoNextCheck)
+	}
+}
+
+func TestFileCertificateProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"corp.com", "*.corp.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	keyDer, _ := x509.MarshalPKCS8PrivateKey(priv)
+	bundle := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})...)
+	ioutil.WriteFile(dir+"/corp.pem", bundle, 0600)
+
+	// Bundles without a private key are ignored
+	ioutil.WriteFile(dir+"/nokey.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	p, err := CreateFileCertificateProvider(FileCertificateProviderConfig{
+		Dir:        dir,
+		SecretsDir: dir,
+	}, &TestCertificateProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"corp.com":       dir + "/corp.pem",
+		"www.corp.com":   dir + "/corp.pem",
+		"a.www.corp.com": "<letsencrypt:a.www.corp.com>",
+		"other.com":      "<letsencrypt:other.com>",
+	}
+	for domain, expect := range cases {
+		v, err := p.GetCertificateForDomain(domain, CertificateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != expect {
+			t.Errorf("Expected '%s' for %s, got '%s'", expect, domain, v)
+		}
+	}
+
+	v, err := p.GetCertificateForDomain("corp.com", CertificateOptions{CertSecret: "corp.pem"})
+	if err != nil || v != dir+"/corp.pem" {
+		t.Errorf("Expected the certificate secret to be used, got '%s' (%v)", v, err)
+	}
+	if _, err := p.GetCertificateForDomain("corp.com", CertificateOptions{CertSecret: "nokey.pem"}); err == nil {
+		t.Errorf("Expected an error for a secret without a private key")
+	}
+}
+
+func TestCompositeCertificateProvider(t *testing.T) {
+	store, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	p := CreateCompositeCertificateProvider(CompositeCertificateProviderConfig{
+		Store: store,
+	})
+	p.AddIssuer(IssuerACME, &TestCertificateProvider{})
+	p.AddIssuer(IssuerSelfSigned, CreateSelfSignedCertificateProvider(&TestCertificateProvider{}))
+
+	cases := []struct {
+		domain string
+		opts   CertificateOptions
+		expect string
+	}{
+		{"foo.com", CertificateOptions{}, "<letsencrypt:foo.com>"},
+		{"bar.com", CertificateOptions{Issuer: IssuerSelfSigned}, "<self:bar.com>"},
+		// The issuer is remembered for renewals
+		{"bar.com", CertificateOptions{}, "<self:bar.com>"},
+		{"baz.com", CertificateOptions{Issuer: "unknown"}, "<self:baz.com>"},
+	}
+	for _, c := range cases {
+		v, err := p.GetCertificateForDomain(c.domain, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != c.expect {
+			t.Errorf("Expected '%s' for %s, got '%s'", c.expect, c.domain, v)
+		}
+	}
+
+	// The choice must survive restarts
+	p2, err := CreateDefaultCertificateProvider(store.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := p2.GetDomainIssuer("bar.com"); v != IssuerSelfSigned {
+		t.Errorf("Expected the issuer to be persisted, got '%s'", v)
+	}
+
+	// The longest suffix wins, and the persisted issuer takes precedence
+	p = CreateCompositeCertificateProvider(CompositeCertificateProviderConfig{
+		SuffixIssuers: map[string]string{".internal": IssuerSelfSigned, ".acme.internal": IssuerACME},
+		Store:         store,
+	})
+	p.AddIssuer(IssuerACME, &TestCertificateProvider{})
+	p.AddIssuer(IssuerSelfSigned, CreateSelfSignedCertificateProvider(&TestCertificateProvider{}))
+	store.SetDomainIssuer("kept.internal", IssuerACME)
+	for domain, expect := range map[string]string{
+		"foo.internal":      IssuerSelfSigned,
+		"foo.acme.internal": IssuerACME,
+		"kept.internal":     IssuerACME,
+		"foo.com":           IssuerACME,
+	} {
+		for i := 0; i < 10; i++ {
+			if v := p.issuerFor(domain, CertificateOptions{}); v != expect {
+				t.Fatalf("Expected issuer '%s' for %s, got '%s'", expect, domain, v)
+			}
+		}
+	}
+}
+
+// testCoveringProvider covers the domains its callback accepts
+type testCoveringProvider struct {
+	TestCertificateProvider
+	covers func(domain string) bool
+}
+
+func (p *testCoveringProvider) Covers(domain string) bool {
+	return p.covers(domain)
+}
+
+func TestCompositeProviderCallbacks(t *testing.T) {
+	p := CreateCompositeCertificateProvider(CompositeCertificateProviderConfig{
+		PriorityIssuers: []string{IssuerFile},
+	})
+	p.AddIssuer(IssuerACME, &TestCertificateProvider{})
+
+	// The providers can call back into the composite provider while it picks
+	// the issuer
+	p.AddIssuer(IssuerFile, &testCoveringProvider{covers: func(domain string) bool {
+		p.GetSelfSigned(domain)
+		return domain == "file.com"
+	}})
+
+	done := make(chan string, 2)
+	go func() {
+		for _, domain := range []string{"file.com", "foo.com"} {
+			done <- p.issuerFor(domain, CertificateOptions{})
+		}
+	}()
+	for _, expect := range []string{IssuerFile, IssuerACME} {
+		select {
+		case v := <-done:
+			if v != expect {
+				t.Errorf("Expected issuer '%s', got '%s'", expect, v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Picking the issuer deadlocked")
+		}
+	}
+}
+
+func TestInternalCertificateProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := InternalCertificateProviderConfig{Dir: dir, Organization: "Test"}
+	p, err := CreateInternalCertificateProvider(config, &TestCertificateProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, err := p.GetCertificateForDomain("app.internal", CertificateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseCertificateBundle(certPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The leaf must chain up to the exported root through the bundled
+	// intermediate
+	data, _ := ioutil.ReadFile(certPath)
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chain = append(chain, cert)
+		}
+	}
+	if len(chain) != 2 {
+		t.Fatalf("Expected the leaf and the intermediate in the bundle, got %d certificates", len(chain))
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/root.pem", nil))
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(w.Body.Bytes()) {
+		t.Fatalf("Could not parse the exported root certificate")
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(chain[1])
+	_, err = chain[0].Verify(x509.VerifyOptions{
+		DNSName:       "app.internal",
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		t.Errorf("Could not verify the issued certificate: %s", err.Error())
+	}
+
+	// The CA must survive restarts
+	p2, err := CreateInternalCertificateProvider(config, &TestCertificateProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p2.root.Equal(p.root) || !p2.intermediate.Equal(p.intermediate) {
+		t.Errorf("Expected the CA to be loaded from disk")
+	}
+	if domains := p2.GetDomainsToReissue(); len(domains) != 0 {
+		t.Errorf("Expected no certificates to renew, got %+v", domains)
+	}
+}
+
+func TestDualCertificates(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	notBefore := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	notAfter := notBefore.Add(30 * 24 * time.Hour)
+	writeTestCertificate(t, p.certFilePath("foo.com")+".ecdsa", notBefore, notAfter)
+	writeTestCertificate(t, p.certFilePath("foo.com")+".rsa", notBefore, notAfter)
+	if err := p.reconcileCertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := p.certificates["foo.com"]; !ok {
+		t.Fatalf("Expected the dual certificate to be tracked")
+	}
+	if len(p.certificates) != 1 {
+		t.Errorf("Expected a single tracked certificate, got %d", len(p.certificates))
+	}
+
+	// HAProxy is given the bundle name, that does not exist on disk
+	certPath, err := p.GetCertificateForDomain("foo.com", CertificateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certPath != p.certFilePath("foo.com") {
+		t.Errorf("Expected the bundle path, got %s", certPath)
+	}
+	if _, ok := p.pending["foo.com"]; ok {
+		t.Errorf("Expected the existing certificate not to be re-issued")
+	}
+
+	if v := p.keyTypeFor("foo.com", CertificateOptions{}); v != "2048" {
+		t.Errorf("Expected RSA 2048 certificates by default, got %s", v)
+	}
+	if v := p.keyTypeFor("foo.com", CertificateOptions{KeyType: KeyTypeDual}); v != KeyTypeDual {
+		t.Errorf("Expected dual certificates when requested, got %s", v)
+	}
+	if v := p.keyTypeFor("foo.com", CertificateOptions{KeyType: "4096"}); v != "4096" {
+		t.Errorf("Expected the per-domain key type to be used, got %s", v)
+	}
+}
+
+func TestRolloverKey(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	oldKey := p.userKey.(*ecdsa.PrivateKey)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/directory":
+			fmt.Fprintf(w, `{"newNonce": "%s/nonce", "keyChange": "%s/key-change"}`, server.URL, server.URL)
+		case "/nonce":
+			w.Header().Set("Replay-Nonce", "nonce")
+		case "/key-change":
+			data, _ := ioutil.ReadAll(r.Body)
+			outer, err := jose.ParseSigned(string(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outer.Signatures[0].Protected.KeyID != server.URL+"/acct/1" {
+				t.Errorf("Expected the outer JWS to refer to the account, got %+v", outer.Signatures[0].Protected)
+			}
+			innerData, err := outer.Verify(&oldKey.PublicKey)
+			if err != nil {
+				t.Fatalf("Expected the outer JWS to be signed by the old key: %s", err.Error())
+			}
+			inner, err := jose.ParseSigned(string(innerData))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := inner.Verify(inner.Signatures[0].Protected.JSONWebKey); err != nil {
+				t.Fatalf("Expected the inner JWS to be signed by the new key: %s", err.Error())
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	p.config.CADirURL = server.URL + "/directory"
+	p.registrations[p.config.CADirURL] = &registration.Resource{URI: server.URL + "/acct/1"}
+
+	if err := p.RolloverKey(); err != nil {
+		t.Fatal(err)
+	}
+	if p.userKey.(*ecdsa.PrivateKey).Equal(oldKey) {
+		t.Errorf("Expected the account key to be replaced")
+	}
+}
+
+func TestContactChange(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	// Changing the e-mail must not prevent starting
+	config := p.config
+	config.Email = "other@example.com"
+	p2, err := CreateDefaultCertificateProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := p2.AccountInfo(); info.RegisteredAs != "test@example.com" {
+		t.Errorf("Expected the registered contact to be kept, got %s", info.RegisteredAs)
+	}
+}
+
+func TestReadOnlyProvider(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	// Nothing is created for a new installation
+	emptyDir := filepath.Join(p.config.ConfigDir, "empty")
+	ro, err := CreateDefaultCertificateProvider(DefaultCertificateProviderConfig{
+		ConfigDir: emptyDir,
+		Email:     "test@example.com",
+		ReadOnly:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(emptyDir); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be created for a read-only provider")
+	}
+	if info := ro.AccountInfo(); len(info.Registrations) != 0 {
+		t.Errorf("Unexpected registrations %v", info.Registrations)
+	}
+
+	// The stored state is loaded as it is, even if out of sync with the
+	// certificates
+	p.mutex.Lock()
+	p.certificates["foo.com"] = &issuedCertificate{IssueDate: time.Now(), ExpireDate: time.Now().Add(time.Hour)}
+	p.saveState()
+	p.mutex.Unlock()
+	state, _ := ioutil.ReadFile(filepath.Join(p.config.ConfigDir, stateKey))
+
+	config := p.config
+	config.ReadOnly = true
+	ro, err = CreateDefaultCertificateProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := ro.ListCertificates(); len(list) != 1 || list[0].Domain != "foo.com" {
+		t.Errorf("Expected the stored certificate to be listed, got %v", list)
+	}
+	if err := ro.SetDomainIssuer("foo.com", IssuerACME); err == nil {
+		t.Errorf("Expected the read-only state not to be saved")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(p.config.ConfigDir, stateKey)); string(data) != string(state) {
+		t.Errorf("Expected the state file not to be changed")
+	}
+}
+
+func TestOrphanedCertificates(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	notBefore := time.Now().Add(-60 * 24 * time.Hour)
+	writeTestCertificate(t, p.certFilePath("foo.com"), notBefore, notBefore.Add(90*24*time.Hour))
+	writeTestCertificate(t, p.certFilePath("bar.com"), notBefore, notBefore.Add(90*24*time.Hour))
+	if err := p.reconcileCertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.SetActiveDomains([]string{"foo.com"})
+	if p.certificates["bar.com"].OrphanedSince.IsZero() {
+		t.Fatalf("Expected the unused certificate to be marked orphaned")
+	}
+	if !p.certificates["foo.com"].OrphanedSince.IsZero() {
+		t.Fatalf("Expected the used certificate not to be marked orphaned")
+	}
+	if len(p.GetDomainsToReissue()) != 2 {
+		t.Errorf("Expected the orphaned certificate to be renewed during the grace period")
+	}
+
+	p.certificates["bar.com"].OrphanedSince = time.Now().Add(-p.config.OrphanGracePeriod - time.Hour)
+	if domains := p.GetDomainsToReissue(); len(domains) != 1 || domains[0] != "foo.com" {
+		t.Errorf("Expected the orphaned certificate not to be renewed after the grace period, got %+v", domains)
+	}
+
+	p.archiveOrphans()
+	if _, ok := p.certificates["bar.com"]; ok {
+		t.Errorf("Expected the orphaned certificate to be removed from the state")
+	}
+	if _, err := os.Stat(p.certFilePath("bar.com")); !os.IsNotExist(err) {
+		t.Errorf("Expected the orphaned certificate to be moved to the archive")
+	}
+	archived, _ := filepath.Glob(p.config.ConfigDir + "/archive/bar.com-*/bar.com.pem")
+	if len(archived) != 1 {
+		t.Errorf("Expected the orphaned certificate in the archive, got %+v", archived)
+	}
+}
+
+type testResolver map[string][]string
+
+func (r testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("no such host")
+}
+
+func TestPreflightCheck(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	// The HTTP frontend routes the challenges to the responder
+	frontend := httptest.NewServer(p.config.Responder)
+	defer frontend.Close()
+
+	p.config.PublicIPs = []string{"192.0.2.1", "2001:db8::1"}
+	p.config.SelfTestAddr = strings.TrimPrefix(frontend.URL, "http://")
+	p.config.Resolver = testResolver{
+		"ok.example.com":      {"192.0.2.1", "2001:db8:0::1"},
+		"foreign.example.com": {"192.0.2.1", "198.51.100.1"},
+	}
+
+	if err := p.preflightCheck("ok.example.com", CertificateOptions{}); err != nil {
+		t.Fatalf("Expected ok.example.com to pass, got %s", err.Error())
+	}
+	if err := p.preflightCheck("foreign.example.com", CertificateOptions{}); err == nil || !strings.Contains(err.Error(), "198.51.100.1") {
+		t.Fatalf("Expected foreign.example.com to fail, got %v", err)
+	}
+	if err := p.preflightCheck("missing.example.com", CertificateOptions{}); err == nil {
+		t.Fatalf("Expected missing.example.com to fail")
+	}
+	if err := p.preflightCheck("missing.example.com", CertificateOptions{Challenge: ChallengeDNS01}); err != nil {
+		t.Fatalf("Expected the DNS-01 challenge to skip the checks, got %s", err.Error())
+	}
+
+	// The self-test fails when the challenges are not routed to us
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	p.config.SelfTestAddr = strings.TrimPrefix(other.URL, "http://")
+	if err := p.preflightCheck("ok.example.com", CertificateOptions{}); err == nil {
+		t.Fatalf("Expected the self-test to fail")
+	}
+
+	// Failing domains are not sent to the CA, and report the reason
+	p.config.CADirURL = "http://127.0.0.1:1/directory"
+	p.mutex.Lock()
+	p.enqueue("foreign.example.com", CertificateOptions{})
+	p.mutex.Unlock()
+	p.issuePending("foreign.example.com")
+
+	list := p.ListCertificates()
+	if len(list) != 1 || !list[0].Pending || !strings.HasPrefix(list[0].LastError, "Pre-flight check failed") {
+		t.Fatalf("Unexpected status %+v", list)
+	}
+	if delay := time.Until(p.pending["foreign.example.com"].NextAttempt); delay > preflightRetryMax {
+		t.Fatalf("Unexpected retry delay %s", delay)
+	}
+}
+
+// testLookupFunc resolves the domains with a callback
+type testLookupFunc func(host string) ([]string, error)
+
+func (f testLookupFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f(host)
+}
+
+func TestPendingChangedWhileIssuing(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	p.config.PublicIPs = []string{"192.0.2.1"}
+	p.config.SelfTestAddr = ""
+	p.mutex.Lock()
+	p.enqueue("foo.example.com", CertificateOptions{})
+	p.mutex.Unlock()
+
+	// The failure is recorded on the entry that replaced the one being issued
+	var replaced *pendingCertificate
+	p.config.Resolver = testLookupFunc(func(host string) ([]string, error) {
+		p.mutex.Lock()
+		replaced = &pendingCertificate{NextAttempt: time.Now()}
+		p.pending[host] = replaced
+		p.mutex.Unlock()
+		return nil, fmt.Errorf("no such host")
+	})
+	p.issuePending("foo.example.com")
+	if replaced.Failures != 1 || replaced.LastError == "" || !replaced.NextAttempt.After(time.Now()) {
+		t.Errorf("Expected the failure to be recorded on the current entry, got %+v", replaced)
+	}
+
+	// A removed entry is not brought back
+	p.config.Resolver = testLookupFunc(func(host string) ([]string, error) {
+		p.mutex.Lock()
+		delete(p.pending, host)
+		p.mutex.Unlock()
+		return nil, fmt.Errorf("no such host")
+	})
+	p.issuePending("foo.example.com")
+	if list := p.ListCertificates(); len(list) != 0 {
+		t.Errorf("Expected the domain to stay removed, got %+v", list)
+	}
+}
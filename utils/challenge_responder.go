@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/challenge/http01"
+	"github.com/go-acme/lego/v3/challenge/tlsalpn01"
+	log "github.com/sirupsen/logrus"
+)
+
+// The tokens of the HTTP-01 challenges are base64url strings, which makes
+// sure the unauthenticated requests cannot reach other keys of the storage
+var challengeTokenFormat = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type ChallengeResponderConfig struct {
+	// The ports HAProxy forwards the HTTP-01 and TLS-ALPN-01 challenges to
+	HTTPPort int
+	TLSPort  int
+
+	// The storage shared with the other nodes, so the challenges of the
+	// orders started by any node are answered by all of them
+	Storage Storage
+
+	// How long to wait for the TLS handshake of a validation request
+	HandshakeTimeout time.Duration
+}
+
+// ChallengeResponder is a long-lived server that answers the HTTP-01 and
+// TLS-ALPN-01 challenges of many in-flight orders at once
+type ChallengeResponder struct {
+	config    ChallengeResponderConfig
+	mutex     sync.Mutex
+	startOnce sync.Once
+	tokens    map[string]string
+	certs     map[string]*tls.Certificate
+}
+
+func CreateChallengeResponder(config ChallengeResponderConfig) *ChallengeResponder {
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = 10 * time.Second
+	}
+	return &ChallengeResponder{
+		config: config,
+		tokens: make(map[string]string),
+		certs:  make(map[string]*tls.Certificate),
+	}
+}
+
+// Start starts listening for challenges. It is safe to call many times, eg.
+// by every provider sharing the responder.
+func (r *ChallengeResponder) Start() {
+	r.startOnce.Do(func() {
+		go r.serveHTTP()
+		go r.serveTLS()
+	})
+}
+
+func (r *ChallengeResponder) serveHTTP() {
+	err := http.ListenAndServe(fmt.Sprintf(":%d", r.config.HTTPPort), r)
+	if err != nil {
+		log.Errorf("Could not start HTTP-01 challenge responder: %s", err.Error())
+	}
+}
+
+func (r *ChallengeResponder) serveTLS() {
+	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", r.config.TLSPort), &tls.Config{
+		NextProtos:     []string{tlsalpn01.ACMETLS1Protocol},
+		GetCertificate: r.getCertificate,
+	})
+	if err != nil {
+		log.Errorf("Could not start TLS-ALPN-01 challenge responder: %s", err.Error())
+		return
+	}
+
+	r.acceptTLS(listener)
+}
+
+// acceptTLS answers the TLS-ALPN-01 challenges on the given listener, until it
+// is closed. Temporary errors (eg. running out of file descriptors) are
+// retried with a backoff, as in net/http.
+func (r *ChallengeResponder) acceptTLS(listener net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Errorf("Could not accept TLS-ALPN-01 connection (Retrying in %s): %s", delay, err.Error())
+				time.Sleep(delay)
+				continue
+			}
+			log.Errorf("TLS-ALPN-01 challenge responder stopped: %s", err.Error())
+			return
+		}
+		delay = 0
+
+		// The validation is complete once the handshake is done, and clients
+		// that never finish it must not hold the connection forever
+		go func(conn net.Conn) {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(r.config.HandshakeTimeout))
+			conn.(*tls.Conn).Handshake()
+		}(conn)
+	}
+}
+
+// ServeHTTP answers the HTTP-01 challenges
+func (r *ChallengeResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.URL.Path, http01.ChallengePath(""))
+	if token == req.URL.Path || !challengeTokenFormat.MatchString(token) {
+		http.NotFound(w, req)
+		return
+	}
+
+	r.mutex.Lock()
+	keyAuth, ok := r.tokens[token]
+	r.mutex.Unlock()
+	if !ok {
+		keyAuth, ok = r.sharedChallenge("http-01/" + token)
+	}
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+}
+
+func (r *ChallengeResponder) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	domain := strings.ToLower(hello.ServerName)
+	if domain == "" || strings.Contains(domain, "/") || strings.Contains(domain, "..") {
+		return nil, fmt.Errorf("Invalid server name '%s'", hello.ServerName)
+	}
+
+	r.mutex.Lock()
+	cert, ok := r.certs[domain]
+	r.mutex.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	if keyAuth, ok := r.sharedChallenge("tls-alpn-01/" + domain); ok {
+		return tlsalpn01.ChallengeCert(domain, keyAuth)
+	}
+	return nil, fmt.Errorf("No challenge pending for %s", hello.ServerName)
+}
+
+// sharedChallenge looks up the key authorization of a challenge presented by
+// another node
+func (r *ChallengeResponder) sharedChallenge(name string) (string, bool) {
+	if r.config.Storage == nil {
+		return "", false
+	}
+	data, err := r.config.Storage.Load("challenges/" + name)
+	if err != nil {
+		if err != ErrKeyNotFound {
+			log.Warnf("Could not load challenge %s: %s", name, err.Error())
+		}
+		return "", false
+	}
+	return string(data), true
+}
+
+// shareChallenge makes the challenge available to the other nodes, or removes
+// it if the key authorization is empty
+func (r *ChallengeResponder) shareChallenge(name string, keyAuth string) error {
+	if r.config.Storage == nil {
+		return nil
+	}
+	if keyAuth == "" {
+		return r.config.Storage.Delete("challenges/" + name)
+	}
+	return r.config.Storage.Store("challenges/"+name, []byte(keyAuth))
+}
+
+// HTTP01 returns the provider that presents HTTP-01 challenges through the
+// responder
+func (r *ChallengeResponder) HTTP01() challenge.Provider {
+	return &httpChallengeProvider{r}
+}
+
+// TLSALPN01 returns the provider that presents TLS-ALPN-01 challenges through
+// the responder
+func (r *ChallengeResponder) TLSALPN01() challenge.Provider {
+	return &tlsALPNChallengeProvider{r}
+}
+
+type httpChallengeProvider struct {
+	responder *ChallengeResponder
+}
+
+func (p *httpChallengeProvider) Present(domain, token, keyAuth string) error {
+	p.responder.mutex.Lock()
+	p.responder.tokens[token] = keyAuth
+	p.responder.mutex.Unlock()
+	return p.responder.shareChallenge("http-01/"+token, keyAuth)
+}
+
+func (p *httpChallengeProvider) CleanUp(domain, token, keyAuth string) error {
+	p.responder.mutex.Lock()
+	delete(p.responder.tokens, token)
+	p.responder.mutex.Unlock()
+	return p.responder.shareChallenge("http-01/"+token, "")
+}
+
+type tlsALPNChallengeProvider struct {
+	responder *ChallengeResponder
+}
+
+func (p *tlsALPNChallengeProvider) Present(domain, token, keyAuth string) error {
+	cert, err := tlsalpn01.ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return fmt.Errorf("Could not create challenge certificate: %s", err.Error())
+	}
+
+	p.responder.mutex.Lock()
+	p.responder.certs[strings.ToLower(domain)] = cert
+	p.responder.mutex.Unlock()
+	return p.responder.shareChallenge("tls-alpn-01/"+strings.ToLower(domain), keyAuth)
+}
+
+func (p *tlsALPNChallengeProvider) CleanUp(domain, token, keyAuth string) error {
+	p.responder.mutex.Lock()
+	delete(p.responder.certs, strings.ToLower(domain))
+	p.responder.mutex.Unlock()
+	return p.responder.shareChallenge("tls-alpn-01/"+strings.ToLower(domain), "")
+}
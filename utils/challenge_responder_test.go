@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge/tlsalpn01"
+)
+
+func TestChallengeResponder(t *testing.T) {
+	r := CreateChallengeResponder(ChallengeResponderConfig{})
+
+	// Many orders can be in-flight at once
+	r.HTTP01().Present("foo.com", "token1", "auth1")
+	r.HTTP01().Present("bar.com", "token2", "auth2")
+	for token, expect := range map[string]string{"token1": "auth1", "token2": "auth2"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/acme-challenge/"+token, nil))
+		if w.Code != 200 || w.Body.String() != expect {
+			t.Errorf("Expected '%s' for %s, got %d '%s'", expect, token, w.Code, w.Body.String())
+		}
+	}
+
+	r.HTTP01().CleanUp("foo.com", "token1", "auth1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/acme-challenge/token1", nil))
+	if w.Code != 404 {
+		t.Errorf("Expected the cleaned up token not to be served, got %d", w.Code)
+	}
+
+	if err := r.TLSALPN01().Present("foo.com", "token1", "auth1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.getCertificate(&tls.ClientHelloInfo{ServerName: "FOO.com"}); err != nil {
+		t.Errorf("Expected a challenge certificate for foo.com: %s", err.Error())
+	}
+	if _, err := r.getCertificate(&tls.ClientHelloInfo{ServerName: "bar.com"}); err == nil {
+		t.Errorf("Expected no challenge certificate for bar.com")
+	}
+}
+
+func TestSharedChallenges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := CreateFileStorage(FileStorageConfig{Dir: dir})
+	r1 := CreateChallengeResponder(ChallengeResponderConfig{Storage: storage})
+	r2 := CreateChallengeResponder(ChallengeResponderConfig{Storage: storage})
+
+	// The challenges presented by one node are answered by the other
+	r1.HTTP01().Present("foo.com", "token1", "auth1")
+	w := httptest.NewRecorder()
+	r2.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/acme-challenge/token1", nil))
+	if w.Code != 200 || w.Body.String() != "auth1" {
+		t.Errorf("Expected the other node to answer the challenge, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	if err := r1.TLSALPN01().Present("foo.com", "token1", "auth1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r2.getCertificate(&tls.ClientHelloInfo{ServerName: "foo.com"}); err != nil {
+		t.Errorf("Expected the other node to answer the challenge: %s", err.Error())
+	}
+
+	r1.HTTP01().CleanUp("foo.com", "token1", "auth1")
+	w = httptest.NewRecorder()
+	r2.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/acme-challenge/token1", nil))
+	if w.Code != 404 {
+		t.Errorf("Expected the cleaned up token not to be served, got %d", w.Code)
+	}
+
+	// The requests cannot reach the other keys of the storage
+	ioutil.WriteFile(filepath.Join(dir, "state.json"), []byte("secret"), 0600)
+	for _, path := range []string{"../../state.json", "..%2F..%2Fstate.json", "token1/../../../state.json"} {
+		w = httptest.NewRecorder()
+		r2.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/acme-challenge/"+path, nil))
+		if w.Code != 404 {
+			t.Errorf("Expected %s not to be served, got %d '%s'", path, w.Code, w.Body.String())
+		}
+	}
+	if _, err := r2.getCertificate(&tls.ClientHelloInfo{ServerName: "../../state.json"}); err == nil {
+		t.Errorf("Expected an invalid server name to be rejected")
+	}
+}
+
+func TestTLSChallengeListener(t *testing.T) {
+	r := CreateChallengeResponder(ChallengeResponderConfig{HandshakeTimeout: 200 * time.Millisecond})
+	if err := r.TLSALPN01().Present("foo.com", "token1", "auth1"); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := tls.NewListener(l, &tls.Config{
+		NextProtos:     []string{tlsalpn01.ACMETLS1Protocol},
+		GetCertificate: r.getCertificate,
+	})
+	done := make(chan struct{})
+	go func() {
+		r.acceptTLS(listener)
+		close(done)
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         "foo.com",
+		NextProtos:         []string{tlsalpn01.ACMETLS1Protocol},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("Expected the challenge handshake to succeed: %s", err.Error())
+	}
+	conn.Close()
+
+	// The clients that never complete the handshake are dropped
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected the idle connection to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("Expected the idle connection to be closed by the server")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the idle connection to be closed after the timeout, took %s", elapsed)
+	}
+
+	// Closing the listener stops the responder
+	listener.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the responder to stop once the listener is closed")
+	}
+}
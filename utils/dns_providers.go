@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/providers/dns"
+)
+
+// NewDNSChallengeProviderByName creates the DNS-01 challenge provider with the
+// given name from the lego registry. Every provider reads its credentials from
+// its own environment variables (eg. `RFC2136_TSIG_SECRET`), or from the file
+// pointed by the same variable with a `_FILE` suffix, so they can be passed as
+// docker secrets.
+func NewDNSChallengeProviderByName(name string) (challenge.Provider, error) {
+	provider, err := dns.NewDNSChallengeProviderByName(strings.ToLower(name))
+	if err != nil {
+		return nil, fmt.Errorf("Could not create DNS provider '%s': %s", name, err.Error())
+	}
+
+	return provider, nil
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRFC2136Provider(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		records = make(map[string]string)
+	)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A minimal authoritative server for example.com that accepts
+	// TSIG-signed dynamic updates
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		if r.Opcode == dns.OpcodeUpdate {
+			if r.IsTsig() == nil || w.TsigStatus() != nil {
+				m.Rcode = dns.RcodeRefused
+			} else {
+				mutex.Lock()
+				for _, rr := range r.Ns {
+					if txt, ok := rr.(*dns.TXT); ok && rr.Header().Class == dns.ClassINET {
+						records[txt.Hdr.Name] = txt.Txt[0]
+					}
+				}
+				mutex.Unlock()
+				m.SetTsig("docker-lb.", dns.HmacSHA256, 300, time.Now().Unix())
+			}
+		} else if len(r.Question) > 0 && r.Question[0].Name == "example.com." && r.Question[0].Qtype == dns.TypeSOA {
+			soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")
+			m.Answer = append(m.Answer, soa)
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+
+		w.WriteMsg(m)
+	})
+
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler:    handler,
+		TsigSecret: map[string]string{"docker-lb.": "c2VjcmV0LWtleS1mb3ItZG9ja2VyLWxi"},
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	os.Setenv("RFC2136_NAMESERVER", pc.LocalAddr().String())
+	os.Setenv("RFC2136_TSIG_KEY", "docker-lb")
+	os.Setenv("RFC2136_TSIG_SECRET", "c2VjcmV0LWtleS1mb3ItZG9ja2VyLWxi")
+	os.Setenv("RFC2136_TSIG_ALGORITHM", dns.HmacSHA256)
+	defer func() {
+		for _, name := range []string{"RFC2136_NAMESERVER", "RFC2136_TSIG_KEY", "RFC2136_TSIG_SECRET", "RFC2136_TSIG_ALGORITHM"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	provider, err := NewDNSChallengeProviderByName("RFC2136")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = provider.Present("www.example.com", "token", "key-authorization")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := records["_acme-challenge.www.example.com."]; !ok {
+		t.Errorf("Expected the challenge record to be created, got %+v", records)
+	}
+
+	if _, err := NewDNSChallengeProviderByName("missing"); err == nil {
+		t.Errorf("Expected an error for an unknown provider")
+	}
+}
+
+func TestWildcardMatching(t *testing.T) {
+	p := &DefaultCertificateProvider{
+		config: DefaultCertificateProviderConfig{
+			Wildcards: []string{"example.com"},
+		},
+	}
+
+	cases := map[string]string{
+		"www.example.com":   "*.example.com",
+		"a.b.example.com":   "",
+		"example.com":       "",
+		"www.example.org":   "",
+		"www.myexample.com": "",
+	}
+	for domain, expect := range cases {
+		if v := p.matchWildcard(domain); v != expect {
+			t.Errorf("Expected '%s' for %s, got '%s'", expect, domain, v)
+		}
+	}
+}
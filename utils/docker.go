@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"hash/crc64"
 	"strconv"
+	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
@@ -71,6 +72,48 @@ func (m *DockerMonitor) GetProxyEndpoints() ([]ProxyEndpoint, error) {
 				}
 			}
 
+			// Get the challenge used for validating the domain
+			challenge := ""
+			if sv, ok := container.Labels["publish.ssl.challenge"]; ok {
+				if IsValidChallenge(sv) {
+					challenge = sv
+				} else {
+					log.Warnf("[c-%s] 'publish.ssl.challenge' is not a valid challenge type", cid)
+				}
+			}
+
+			// Get the docker secret with the certificate to use, if any
+			certSecret := ""
+			if sv, ok := container.Labels["publish.ssl.cert"]; ok {
+				certSecret = sv
+				autoCert = true
+			}
+
+			// Get the issuer of the certificate, if not the default one
+			issuer := ""
+			if sv, ok := container.Labels["publish.ssl.issuer"]; ok {
+				issuer = sv
+				autoCert = true
+			}
+
+			// Get the key type of the certificate, if not the default one
+			keyType := ""
+			if sv, ok := container.Labels["publish.ssl.keytype"]; ok {
+				if IsValidKeyType(sv) {
+					keyType = sv
+				} else {
+					log.Warnf("[c-%s] 'publish.ssl.keytype' is not a valid key type", cid)
+				}
+			}
+
+			// Get the TLS policy of the domain, if not the global one. Policy
+			// names are checked when generating the configuration, since the
+			// custom ones are part of the HAProxy tuning.
+			tlsPolicy := ""
+			if sv, ok := container.Labels["publish.ssl.policy"]; ok {
+				tlsPolicy = sv
+			}
+
 			// Get order flag
 			order := -1
 			if sv, ok := container.Labels["publish.order"]; ok {
@@ -79,6 +122,36 @@ func (m *DockerMonitor) GetProxyEndpoints() ([]ProxyEndpoint, error) {
 				}
 			}
 
+			// Get the directory with the custom error pages
+			errorPages := ""
+			if sv, ok := container.Labels["publish.errorpages"]; ok {
+				errorPages = sv
+			}
+
+			// Get the per-route timeout overrides
+			timeouts := map[string]string{}
+			for _, name := range []string{"server", "connect", "tunnel"} {
+				if sv, ok := container.Labels["publish.timeout."+name]; ok {
+					if IsValidTimeout(sv) {
+						timeouts[name] = sv
+					} else {
+						log.Warnf("[c-%s] 'publish.timeout.%s' is not a valid timeout", cid, name)
+					}
+				}
+			}
+
+			// Get the container and service names, used for naming the backends
+			name := cid
+			if len(container.Names) > 0 {
+				name = strings.TrimPrefix(container.Names[0], "/")
+			}
+			service := name
+			if sv, ok := container.Labels["com.docker.swarm.service.name"]; ok {
+				service = sv
+			} else if sv, ok := container.Labels["com.docker.compose.service"]; ok {
+				service = sv
+			}
+
 			if container.NetworkSettings != nil {
 				for _, netInfo := range container.NetworkSettings.Networks {
 					log.Debugf("[c-%s] Exposing %s:%d%s -> %s%s ", cid,
@@ -90,7 +163,18 @@ func (m *DockerMonitor) GetProxyEndpoints() ([]ProxyEndpoint, error) {
 						BackendPort:    port,
 						BackendPath:    pathTo,
 						SSLAutoCert:    autoCert,
+						SSLChallenge:   challenge,
+						SSLCertSecret:  certSecret,
+						SSLIssuer:      issuer,
+						SSLKeyType:     keyType,
+						SSLPolicy:      tlsPolicy,
 						Order:          order,
+						ErrorPages:     errorPages,
+						TimeoutServer:  timeouts["server"],
+						TimeoutConnect: timeouts["connect"],
+						TimeoutTunnel:  timeouts["tunnel"],
+						ContainerName:  name,
+						ServiceName:    service,
 					})
 				}
 			}
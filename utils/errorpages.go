@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// The HTTP status codes for which we are generating error pages
+var errorPageCodes = []int{403, 404, 429, 502, 503, 504}
+
+var errorPageMessages = map[int]string{
+	403: "You are not allowed to access this resource.",
+	404: "The page you are looking for could not be found.",
+	429: "Too many requests. Please slow down and try again in a while.",
+	502: "The service responded with an invalid response. Please try again later.",
+	503: "The service is currently unavailable. Please try again later.",
+	504: "The service did not respond in time. Please try again later.",
+}
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>{{.Code}} {{.Title}}</title>
+  <style>
+    body { margin: 0; font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; background: #f4f5f7; color: #333; }
+    main { max-width: 480px; margin: 15vh auto; padding: 2em; background: #fff; border-radius: 6px; box-shadow: 0 1px 3px rgba(0,0,0,0.15); text-align: center; }
+    h1 { margin: 0; font-size: 4em; color: #2d7dd2; }
+    h2 { margin: 0.2em 0 1em; font-weight: normal; }
+    footer { margin-top: 2em; font-size: 0.8em; color: #999; }
+  </style>
+</head>
+<body>
+  <main>
+    <h1>{{.Code}}</h1>
+    <h2>{{.Title}}</h2>
+    <p>{{.Message}}</p>
+    <footer>{{if .Domain}}{{.Domain}} &middot; {{end}}docker-lb</footer>
+  </main>
+</body>
+</html>
+`))
+
+// renderBuiltinErrorPage renders the built-in branded error page for the given code
+func renderBuiltinErrorPage(code int, domain string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := errorPageTemplate.Execute(&buf, struct {
+		Code    int
+		Title   string
+		Message string
+		Domain  string
+	}{code, http.StatusText(code), errorPageMessages[code], domain})
+	if err != nil {
+		return nil, fmt.Errorf("Could not render error page %d: %s", code, err.Error())
+	}
+
+	return buf.Bytes(), nil
+}
+
+// findErrorPage looks for a user-provided error page for the given code in the
+// list of directories given, in order.
+func findErrorPage(code int, dirs []string) ([]byte, error) {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.html", code)))
+		if err == nil {
+			return data, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Could not read error page: %s", err.Error())
+		}
+	}
+
+	return nil, nil
+}
+
+// writeErrorFiles composes the raw HTTP responses HAProxy expects in the
+// `errorfile` directives and writes them in the given directory. It returns
+// a map with the filename for every status code.
+func writeErrorFiles(outDir string, domain string, searchDirs []string) (map[int]string, error) {
+	files := make(map[int]string)
+
+	err := os.MkdirAll(outDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create error page directory: %s", err.Error())
+	}
+
+	for _, code := range errorPageCodes {
+		body, err := findErrorPage(code, searchDirs)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			body, err = renderBuiltinErrorPage(code, domain)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "HTTP/1.0 %d %s\r\n", code, http.StatusText(code))
+		buf.WriteString("Cache-Control: no-cache\r\n")
+		buf.WriteString("Connection: close\r\n")
+		buf.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n", len(body))
+		buf.WriteString("\r\n")
+		buf.Write(body)
+
+		filename := filepath.Join(outDir, fmt.Sprintf("%d.http", code))
+		err = ioutil.WriteFile(filename, buf.Bytes(), 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Could not write error page: %s", err.Error())
+		}
+
+		files[code] = filename
+	}
+
+	return files, nil
+}
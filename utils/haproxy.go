@@ -2,13 +2,17 @@ package utils
 
 import (
 	"fmt"
+	"hash/crc64"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,23 +24,47 @@ type HAProxyManagerConfig struct {
 	Certificates           CertificateProvider
 	BinaryPath             string
 	DefaultLocalServerPort int
+	ErrorPagesDir          string
+	Tuning                 *HAProxyTuning
+	Stats                  *HAProxyStatsConfig
 }
 
 type HAProxyManager struct {
-	state       *HAProxyState
-	config      HAProxyManagerConfig
-	certManager CertificateProvider
-	cfgPath     string
-	proc        *exec.Cmd
+	state         *HAProxyState
+	config        HAProxyManagerConfig
+	certManager   CertificateProvider
+	cfgPath       string
+	errorsPath    string
+	socketPath    string
+	proc          *exec.Cmd
+	crtListPath   string
+	crtList       []crtListEntry
+	runtime       *HAProxyRuntime
+	loadedConfig  []byte
+	loadedCrtList []crtListEntry
+	loadedCerts   map[string][]byte
+	mutex         sync.Mutex
+	reloadMutex   sync.Mutex
+	backendLabels map[string]map[string]string
 }
 
 func CreateHAProxyManager(config HAProxyManagerConfig) *HAProxyManager {
+	if config.Tuning == nil {
+		tuning := DefaultHAProxyTuning()
+		config.Tuning = &tuning
+	}
+
+	socketPath := "/var/run/haproxy.sock"
 	return &HAProxyManager{
 		state:       &HAProxyState{},
 		config:      config,
 		certManager: config.Certificates,
 		cfgPath:     "/tmp/haproxy.conf",
+		crtListPath: "/tmp/haproxy-crt-list.txt",
+		errorsPath:  "/tmp/haproxy-errors",
+		socketPath:  socketPath,
 		proc:        nil,
+		runtime:     CreateHAProxyRuntime(socketPath),
 	}
 }
 
@@ -111,6 +139,26 @@ func (h *HAProxyManager) Stop() error {
 }
 
 func (h *HAProxyManager) Reload() error {
+	h.reloadMutex.Lock()
+	defer h.reloadMutex.Unlock()
+
+	err := h.reload()
+	DefaultMetrics.AddCounter("dockerlb_haproxy_reloads_total",
+		"Total number of HAProxy reloads.", nil, 1)
+	if err != nil {
+		DefaultMetrics.AddCounter("dockerlb_haproxy_reload_failures_total",
+			"Total number of failed HAProxy reloads.", nil, 1)
+	}
+	return err
+}
+
+// SetOCSPResponse updates the OCSP response stapled by the running HAProxy,
+// without reloading it
+func (h *HAProxyManager) SetOCSPResponse(response []byte) error {
+	return h.runtime.SetOCSPResponse(response)
+}
+
+func (h *HAProxyManager) reload() error {
 	if h.proc == nil {
 		return h.Start()
 	}
@@ -133,8 +181,24 @@ func (h *HAProxyManager) Reload() error {
 }
 
 func (h *HAProxyManager) SetState(cfg *HAProxyState) error {
+	h.reloadMutex.Lock()
 	h.state = cfg
-	return h.Reload()
+	h.reloadMutex.Unlock()
+	err := h.Reload()
+
+	// Let the certificate provider clean up the certificates of the domains
+	// that are no longer published
+	if t, ok := h.certManager.(activeDomainsTracker); ok {
+		var domains []string
+		for _, ep := range cfg.Endpoints {
+			if ep.SSLAutoCert {
+				domains = append(domains, ep.FrontendDomain)
+			}
+		}
+		t.SetActiveDomains(domains)
+	}
+
+	return err
 }
 
 func (h *HAProxyManager) writeConfig() error {
@@ -143,8 +207,34 @@ func (h *HAProxyManager) writeConfig() error {
 		return err
 	}
 
+	// The certificates are listed in a crt-list next to the config
+	h.mutex.Lock()
+	crtList := h.crtList
+	h.mutex.Unlock()
+	err = h.writeCrtList(crtList)
+	if err != nil {
+		return err
+	}
+
 	log.Infof("Updating HAProxy configuration")
-	return ioutil.WriteFile(h.cfgPath, contents, 0600)
+	err = ioutil.WriteFile(h.cfgPath, contents, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Remember what HAProxy is going to load, so the certificates can be
+	// updated later on through the runtime API
+	h.mutex.Lock()
+	h.loadedConfig = contents
+	h.loadedCrtList = crtList
+	h.loadedCerts = make(map[string][]byte)
+	for _, entry := range crtList {
+		if data, err := ioutil.ReadFile(entry.CertPath); err == nil {
+			h.loadedCerts[entry.CertPath] = data
+		}
+	}
+	h.mutex.Unlock()
+	return nil
 }
 
 func normalizePath(p string) string {
@@ -159,55 +249,193 @@ func normalizePath(p string) string {
 	return p
 }
 
+var (
+	invalidNameChars    = regexp.MustCompile("[^a-zA-Z0-9_]+")
+	multipleUnderscores = regexp.MustCompile("_+")
+)
+
+// sanitizeName converts the given string into something that can be used as
+// a section or ACL name in the HAProxy config
+func sanitizeName(name string) string {
+	return invalidNameChars.ReplaceAllString(name, "_")
+}
+
+func errorSectionName(domain string) string {
+	if domain == "" {
+		return "errors_default"
+	}
+	return "errors_" + sanitizeName(domain)
+}
+
+// errorSectionNames returns the names of the error page sections of the given
+// domains, that are unique even if two domains end up with the same name after
+// sanitization (eg. "foo-bar.com" and "foo.bar.com")
+func errorSectionNames(domains []string) map[string]string {
+	names := make(map[string]string)
+	counts := make(map[string]int)
+	for _, domain := range domains {
+		names[domain] = errorSectionName(domain)
+		counts[names[domain]]++
+	}
+	for _, domain := range domains {
+		if counts[names[domain]] > 1 && domain != "" {
+			names[domain] = fmt.Sprintf("%s_%08x", names[domain], crc64.Checksum([]byte(domain), crc64Table)&0xffffffff)
+		}
+	}
+	return names
+}
+
+// backendName builds a human-readable backend name out of the domain, the
+// path and the service name of the endpoint
+func backendName(ep *ProxyEndpoint) string {
+	path := strings.Trim(ep.FrontendPath, "/")
+	if path == "" {
+		path = "root"
+	}
+	name := strings.Join([]string{"be", ep.FrontendDomain, path, ep.ServiceName}, "_")
+	return strings.Trim(multipleUnderscores.ReplaceAllString(sanitizeName(name), "_"), "_")
+}
+
 func getBackend(list *[]*HAPBackendRecord, ep *ProxyEndpoint) *HAPBackendRecord {
+	var rec *HAPBackendRecord
 	for _, r := range *list {
-		if r.Host == ep.BackendIP && r.Port == ep.BackendPort &&
+		if r.Domain == ep.FrontendDomain && r.Service == ep.ServiceName &&
 			r.PathBe == normalizePath(ep.BackendPath) &&
 			r.PathFe == normalizePath(ep.FrontendPath) {
-			return r
+			rec = r
+			break
 		}
 	}
 
-	var order int
-	if ep.Order != -1 {
-		order = ep.Order
-	} else {
-		// Unless explicitly overriden, the order the backends are processed depends
-		// on the length of the path. Shorter paths get lower the order.
-		pathLen := len(ep.FrontendPath)
-		order = 500 - pathLen
+	if rec == nil {
+		var order int
+		if ep.Order != -1 {
+			order = ep.Order
+		} else {
+			// Unless explicitly overriden, the order the backends are processed depends
+			// on the length of the path. Shorter paths get lower the order.
+			pathLen := len(ep.FrontendPath)
+			order = 500 - pathLen
+		}
+
+		rec = &HAPBackendRecord{
+			Name:    backendName(ep),
+			Domain:  ep.FrontendDomain,
+			Service: ep.ServiceName,
+			PathBe:  normalizePath(ep.BackendPath),
+			PathFe:  normalizePath(ep.FrontendPath),
+			Order:   order,
+		}
+		*list = append(*list, rec)
 	}
 
-	rec := &HAPBackendRecord{
-		Index:  len(*list) + 1,
-		Host:   ep.BackendIP,
-		Port:   ep.BackendPort,
-		PathBe: normalizePath(ep.BackendPath),
-		PathFe: normalizePath(ep.FrontendPath),
-		Order:  order,
+	// Every instance of the service becomes a server in the backend
+	found := false
+	for _, srv := range rec.Servers {
+		if srv.Host == ep.BackendIP && srv.Port == ep.BackendPort {
+			found = true
+			break
+		}
 	}
-	*list = append(*list, rec)
+	if !found {
+		name := sanitizeName(ep.ContainerName)
+		if name == "" {
+			name = sanitizeName(fmt.Sprintf("%s_%d", ep.BackendIP, ep.BackendPort))
+		}
+		for _, srv := range rec.Servers {
+			if srv.Name == name {
+				name = sanitizeName(fmt.Sprintf("%s_%s_%d", name, ep.BackendIP, ep.BackendPort))
+				break
+			}
+		}
+		rec.Servers = append(rec.Servers, &HAPServerRecord{
+			Name:      name,
+			Container: ep.ContainerName,
+			Host:      ep.BackendIP,
+			Port:      ep.BackendPort,
+		})
+	}
+
+	rec.mergeTimeouts(ep)
 	return rec
 }
 
+// disambiguateBackends makes sure that the backend names are unique, even if
+// two different endpoints end up with the same name after sanitization
+func disambiguateBackends(list []*HAPBackendRecord) {
+	counts := make(map[string]int)
+	for _, r := range list {
+		counts[r.Name]++
+	}
+	for _, r := range list {
+		if counts[r.Name] > 1 {
+			key := strings.Join([]string{r.Domain, r.PathFe, r.PathBe, r.Service}, "|")
+			r.Name = fmt.Sprintf("%s_%08x", r.Name, crc64.Checksum([]byte(key), crc64Table)&0xffffffff)
+		}
+	}
+}
+
+// mergeTimeouts applies the per-route timeout overrides of the endpoint, if
+// they were not already defined by another endpoint of the same backend
+func (r *HAPBackendRecord) mergeTimeouts(ep *ProxyEndpoint) {
+	if r.TimeoutServer == "" {
+		r.TimeoutServer = ep.TimeoutServer
+	}
+	if r.TimeoutConnect == "" {
+		r.TimeoutConnect = ep.TimeoutConnect
+	}
+	if r.TimeoutTunnel == "" {
+		r.TimeoutTunnel = ep.TimeoutTunnel
+	}
+}
+
 func getFrontend(list *[]*HAPFrontendRecord, ep *ProxyEndpoint, ssl bool) *HAPFrontendRecord {
 	for _, r := range *list {
 		if r.Domain == ep.FrontendDomain && r.SSL == ssl {
+			if r.ErrorPages == "" {
+				r.ErrorPages = ep.ErrorPages
+			}
+			if r.Challenge == "" {
+				r.Challenge = ep.SSLChallenge
+			}
+			if r.CertSecret == "" {
+				r.CertSecret = ep.SSLCertSecret
+			}
+			if r.Issuer == "" {
+				r.Issuer = ep.SSLIssuer
+			}
+			if r.KeyType == "" {
+				r.KeyType = ep.SSLKeyType
+			}
+			if r.TLSPolicy == "" {
+				r.TLSPolicy = ep.SSLPolicy
+			}
 			return r
 		}
 	}
 
 	rec := &HAPFrontendRecord{
-		Index:   len(*list) + 1,
-		Domain:  ep.FrontendDomain,
-		SSL:     ssl,
-		Mapping: nil,
+		Index:      len(*list) + 1,
+		Domain:     ep.FrontendDomain,
+		SSL:        ssl,
+		ErrorPages: ep.ErrorPages,
+		Challenge:  ep.SSLChallenge,
+		CertSecret: ep.SSLCertSecret,
+		Issuer:     ep.SSLIssuer,
+		KeyType:    ep.SSLKeyType,
+		TLSPolicy:  ep.SSLPolicy,
+		Mapping:    nil,
 	}
 	*list = append(*list, rec)
 	return rec
 }
 
 func (f *HAPFrontendRecord) addMapping(path string, be *HAPBackendRecord) {
+	for _, m := range f.Mapping {
+		if m.Backend == be {
+			return
+		}
+	}
 	f.Mapping = append(f.Mapping, &HAPMappingRecord{
 		Index:   len(f.Mapping) + 1,
 		Path:    normalizePath(path),
@@ -219,16 +447,24 @@ func (h *HAProxyManager) computeConfig() ([]byte, error) {
 	var (
 		backends  []*HAPBackendRecord  = nil
 		frontends []*HAPFrontendRecord = nil
-		feCerts   []string
+		crtList   []crtListEntry
 		feHttp    []string
 		feHttps   []string
 		feBeHttp  []string
 		feBeHttps []string
 		beAll     []string
+		errAll    []string
+		beLabels  = make(map[string]map[string]string)
 	)
 
+	// Process the endpoints in a stable order, so the same state always
+	// produces the same configuration
+	endpoints := make([]ProxyEndpoint, len(h.state.Endpoints))
+	copy(endpoints, h.state.Endpoints)
+	sort.Sort(byEndpoint(endpoints))
+
 	// Map the endpoint state to frontends + backends
-	for _, e := range h.state.Endpoints {
+	for _, e := range endpoints {
 		be := getBackend(&backends, &e)
 
 		// Add the non-SSL front-end
@@ -242,18 +478,77 @@ func (h *HAProxyManager) computeConfig() ([]byte, error) {
 		}
 	}
 
+	disambiguateBackends(backends)
+	sort.Sort(byName(backends))
+	sort.Sort(byDomain(frontends))
+
+	// Compose the error pages, first the default ones and then one set for
+	// every domain we are serving
+	errDomains := []string{""}
+	errSources := map[string][]string{
+		"": []string{h.config.ErrorPagesDir},
+	}
+	for _, fe := range frontends {
+		if _, ok := errSources[fe.Domain]; ok {
+			continue
+		}
+		errDomains = append(errDomains, fe.Domain)
+		errSources[fe.Domain] = []string{fe.ErrorPages}
+		if h.config.ErrorPagesDir != "" {
+			errSources[fe.Domain] = append(errSources[fe.Domain],
+				filepath.Join(h.config.ErrorPagesDir, fe.Domain),
+				h.config.ErrorPagesDir,
+			)
+		}
+	}
+	errNames := errorSectionNames(errDomains)
+	for _, domain := range errDomains {
+		name := errNames[domain]
+		files, err := writeErrorFiles(filepath.Join(h.errorsPath, name), domain, errSources[domain])
+		if err != nil {
+			return nil, err
+		}
+
+		errAll = append(errAll, "http-errors "+name)
+		for _, code := range errorPageCodes {
+			errAll = append(errAll, fmt.Sprintf("  errorfile %d %s", code, files[code]))
+		}
+		errAll = append(errAll, "")
+	}
+
 	// Initial configuration for http backend that implements the
 	// HTTP-01 challenge
 	feHttp = append(feHttp,
 		"frontend http-in",
 		"  mode http",
+		"  option httplog",
+		"  option http-server-close",
+		"  option forwardfor",
 		"  bind 0.0.0.0:80",
+		"  errorfiles errors_default",
 		"  acl url_challenge path_beg /.well-known/acme-challenge",
 	)
 	feBeHttp = append(feBeHttp,
 		"  use_backend be_challenge_http if url_challenge",
 	)
 
+	// The public HTTPS port is terminated by a TCP frontend that forwards the
+	// TLS-ALPN-01 challenges (`acme-tls/1` ALPN) to the local responder and
+	// everything else to the actual HTTPS frontend, preserving the client
+	// address through the proxy protocol. The HTTP options are therefore set
+	// on the HTTP frontends instead of the defaults.
+	feTls := []string{
+		"frontend tls-in",
+		"  mode tcp",
+		"  option tcplog",
+		"  bind 0.0.0.0:443",
+		"  tcp-request inspect-delay 5s",
+		"  tcp-request content accept if { req_ssl_hello_type 1 }",
+		"  use_backend be_challenge_tlsalpn if { req.ssl_alpn acme-tls/1 }",
+		"  default_backend be_https_loopback",
+		"",
+	}
+
 	// Initial configuration for https backend
 	feHttps = append(feHttps,
 		"frontend https-in",
@@ -261,27 +556,63 @@ func (h *HAProxyManager) computeConfig() ([]byte, error) {
 	)
 	for _, fe := range frontends {
 		if fe.SSL {
-			certPath, err := h.config.Certificates.GetCertificateForDomain(fe.Domain)
+			certPath, err := h.config.Certificates.GetCertificateForDomain(fe.Domain, CertificateOptions{
+				Challenge:  fe.Challenge,
+				CertSecret: fe.CertSecret,
+				Issuer:     fe.Issuer,
+				KeyType:    fe.KeyType,
+			})
 			if err != nil {
 				return nil, err
 			}
-			feCerts = append(feCerts, fmt.Sprintf("crt %s", certPath))
+
+			// The domains with a TLS policy get an entry of their own, that
+			// only matches their SNI
+			var entry crtListEntry
+			if fe.TLSPolicy != "" {
+				if p, ok := h.config.Tuning.tlsPolicy(fe.TLSPolicy); ok {
+					entry.Options = p.crtListOptions()
+					entry.SNI = fe.Domain
+				} else {
+					log.Warnf("Unknown TLS policy '%s' of domain %s, using the default one", fe.TLSPolicy, fe.Domain)
+				}
+			}
+
+			// Wildcard certificates are shared by many domains, so make sure
+			// we are including them only once
+			for _, filename := range certBundleFiles(certPath) {
+				entry.CertPath = filename
+				found := false
+				for _, c := range crtList {
+					if c == entry {
+						found = true
+						break
+					}
+				}
+				if !found {
+					crtList = append(crtList, entry)
+				}
+			}
 		}
 	}
 
 	// Make sure we have a self-signed fallback certificates if there are no
 	// certificates defined
-	if len(feCerts) == 0 {
+	if len(crtList) == 0 {
 		certPath, err := h.config.Certificates.GetSelfSigned("")
 		if err != nil {
 			return nil, err
 		}
-		feCerts = append(feCerts, fmt.Sprintf("crt %s", certPath))
+		crtList = append(crtList, crtListEntry{CertPath: certPath})
 	}
 
 	feHttps = append(feHttps,
 		"  mode http",
-		"  bind 0.0.0.0:443 ssl "+strings.Join(feCerts, " "),
+		"  option httplog",
+		"  option http-server-close",
+		"  option forwardfor",
+		"  bind abns@https-in accept-proxy ssl crt-list "+h.crtListPath,
+		"  errorfiles errors_default",
 	)
 
 	// Process frontend records
@@ -319,7 +650,7 @@ func (h *HAProxyManager) computeConfig() ([]byte, error) {
 			aclList := make([]string, len(aclCommon))
 			copy(aclList, aclCommon)
 
-			log.Infof("Mapping [#%d] Backend 'be%d' for path '%s'", m.Backend.Order, m.Backend.Index, m.Path)
+			log.Infof("Mapping [#%d] Backend '%s' for path '%s'", m.Backend.Order, m.Backend.Name, m.Path)
 
 			// Add path-specific acl
 			if m.Path != "/" {
@@ -334,26 +665,53 @@ func (h *HAProxyManager) computeConfig() ([]byte, error) {
 			// Create the backend record to append after we are done with the ALCs
 			if len(aclList) > 0 {
 				*targetBEs = append(*targetBEs,
-					fmt.Sprintf("  use_backend be%d if %s", m.Backend.Index, strings.Join(aclList, " ")),
+					fmt.Sprintf("  use_backend %s if %s", m.Backend.Name, strings.Join(aclList, " ")),
 				)
 			} else {
 				*targetBEs = append(*targetBEs,
-					fmt.Sprintf("  use_backend be%d", m.Backend.Index),
+					fmt.Sprintf("  use_backend %s", m.Backend.Name),
 				)
 			}
 		}
 	}
 
 	// Process backend records
-	for idx, be := range backends {
+	for _, be := range backends {
+		beLabels[be.Name] = map[string]string{
+			"domain":  be.Domain,
+			"path":    be.PathFe,
+			"service": be.Service,
+		}
+
 		beAll = append(beAll,
-			fmt.Sprintf("backend be%d", be.Index),
+			"backend "+be.Name,
 			"  mode http",
 			"  option httpclose",
 			"  option forwardfor",
-			fmt.Sprintf("  server service%d %s:%d", idx, be.Host, be.Port),
+			"  errorfiles "+errNames[be.Domain],
 		)
 
+		sort.Sort(byServerName(be.Servers))
+		for _, srv := range be.Servers {
+			beLabels[be.Name+"/"+srv.Name] = map[string]string{
+				"container": srv.Container,
+			}
+			beAll = append(beAll,
+				fmt.Sprintf("  server %s %s:%d", srv.Name, srv.Host, srv.Port),
+			)
+		}
+
+		// Add per-route timeout overrides
+		if be.TimeoutConnect != "" {
+			beAll = append(beAll, "  timeout connect "+be.TimeoutConnect)
+		}
+		if be.TimeoutServer != "" {
+			beAll = append(beAll, "  timeout server "+be.TimeoutServer)
+		}
+		if be.TimeoutTunnel != "" {
+			beAll = append(beAll, "  timeout tunnel "+be.TimeoutTunnel)
+		}
+
 		// Add rewrite rule if paths mismatch
 		if be.PathFe != be.PathBe {
 			beAll = append(beAll,
@@ -383,40 +741,54 @@ func (h *HAProxyManager) computeConfig() ([]byte, error) {
 		feBeHttps = append(feBeHttps,
 			"  use_backend be_local",
 		)
+	} else {
+		// Otherwise use a catch-all backend that replies with the 404 page of
+		// the domain requested
+		beAll = append(beAll,
+			"backend be_notfound",
+			"  mode http",
+		)
+		for di, domain := range errDomains {
+			if domain == "" {
+				continue
+			}
+			aclName := fmt.Sprintf("host_nf%d", di)
+			beAll = append(beAll,
+				fmt.Sprintf("  acl %s req.hdr(Host),regsub(:[0-9]+$,) -i %s", aclName, domain),
+				fmt.Sprintf("  http-request return status 404 errorfiles %s if %s", errNames[domain], aclName),
+			)
+		}
+		beAll = append(beAll,
+			"  http-request return status 404 errorfiles errors_default",
+			"",
+		)
+
+		feBeHttp = append(feBeHttp,
+			"  default_backend be_notfound",
+		)
+		feBeHttps = append(feBeHttps,
+			"  default_backend be_notfound",
+		)
 	}
 
 	// Compose final config
-	config := []string{
-		"global",
-		"  log stdout local0 info",
-		"  maxconn 4096",
-		"  tune.ssl.default-dh-param 2048",
-		"  stats socket /var/run/haproxy.sock mode 600 expose-fd listeners level user",
+	config := []string{"global"}
+	config = append(config, h.config.Tuning.globalLines()...)
+	config = append(config,
+		"  stats socket "+h.socketPath+" mode 600 expose-fd listeners level admin",
 		"",
 		"defaults",
-		"  log     global",
-		"  timeout connect          5s",
-		"  timeout client          60s",
-		"  timeout server          60s",
-		"  timeout tunnel        3600s",
-		"  timeout http-keep-alive  1s",
-		"  timeout http-request    60s",
-		"  timeout queue           80s",
-		"  timeout tarpit          30s",
-		"  option  httplog",
-		"  option  dontlognull",
-		"  option  http-server-close",
-		"  option  forwardfor",
-		"  backlog 10000",
-		"  default-server inter 3s rise 2 fall 3",
-		"  stats   enable",
-		"  stats   auth  haproxy:st@tspassw0rd",
-		"  stats   uri   /__ha_stats",
-		"",
+	)
+	config = append(config, h.config.Tuning.defaultsLines()...)
+	config = append(config, "")
+	if h.config.Stats != nil && h.config.Stats.Enabled {
+		config = append(config, h.config.Stats.listenLines()...)
 	}
+	config = append(config, errAll...)
 	config = append(config, feHttp...)
 	config = append(config, feBeHttp...)
 	config = append(config, "")
+	config = append(config, feTls...)
 	config = append(config, feHttps...)
 	config = append(config, feBeHttps...)
 	config = append(config, "")
@@ -426,7 +798,20 @@ func (h *HAProxyManager) computeConfig() ([]byte, error) {
 		"  mode http",
 		"  server local1 127.0.0.1:"+strconv.Itoa(h.config.Certificates.GetAuthServicePort(false)),
 		"",
+		"backend be_challenge_tlsalpn",
+		"  mode tcp",
+		"  server local2 127.0.0.1:"+strconv.Itoa(h.config.Certificates.GetAuthServicePort(true)),
+		"",
+		"backend be_https_loopback",
+		"  mode tcp",
+		"  server https-in abns@https-in send-proxy-v2",
+		"",
 	)
 
+	h.mutex.Lock()
+	h.backendLabels = beLabels
+	h.crtList = crtList
+	h.mutex.Unlock()
+
 	return []byte(strings.Join(config, "\n")), nil
 }
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errConfigChanged is returned when the certificates cannot be updated
+// without reloading HAProxy
+var errConfigChanged = errors.New("The configuration has changed")
+
+// certBundleFiles returns the files of the given certificate path, which is a
+// multi-cert bundle of `.ecdsa` and `.rsa` files when the path itself does not
+// exist. The files are listed separately in the crt-list, since the runtime
+// API can only update them one by one.
+func certBundleFiles(certPath string) []string {
+	if _, err := os.Stat(certPath); err == nil {
+		return []string{certPath}
+	}
+
+	var files []string
+	for _, suffix := range []string{".ecdsa", ".rsa"} {
+		if _, err := os.Stat(certPath + suffix); err == nil {
+			files = append(files, certPath+suffix)
+		}
+	}
+	if len(files) == 0 {
+		return []string{certPath}
+	}
+	return files
+}
+
+func (h *HAProxyManager) writeCrtList(crtList []crtListEntry) error {
+	var lines []string
+	for _, entry := range crtList {
+		lines = append(lines, entry.String())
+	}
+	err := ioutil.WriteFile(h.crtListPath, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("Could not write crt-list: %s", err.Error())
+	}
+	return nil
+}
+
+func hasCrtListEntry(list []crtListEntry, entry crtListEntry) bool {
+	for _, e := range list {
+		if e == entry {
+			return true
+		}
+	}
+	return false
+}
+
+func countCrtListEntries(list []crtListEntry, certPath string) int {
+	count := 0
+	for _, e := range list {
+		if e.CertPath == certPath {
+			count++
+		}
+	}
+	return count
+}
+
+// UpdateCertificates pushes the new and changed certificates to the running
+// HAProxy through the runtime API. HAProxy is only reloaded if anything else
+// in the configuration changed, or the runtime API failed.
+func (h *HAProxyManager) UpdateCertificates() error {
+	h.reloadMutex.Lock()
+	count, err := h.updateCertificates()
+	h.reloadMutex.Unlock()
+
+	if err == errConfigChanged {
+		log.Infof("The HAProxy configuration has changed, going to reload")
+		return h.Reload()
+	}
+	if err != nil {
+		log.Warnf("Could not update the certificates through the runtime API, going to reload: %s", err.Error())
+		DefaultMetrics.AddCounter("dockerlb_haproxy_certificate_update_failures_total",
+			"Total number of failed certificate updates through the runtime API.", nil, 1)
+		return h.Reload()
+	}
+
+	if count > 0 {
+		log.Infof("Updated %d certificates through the runtime API", count)
+		DefaultMetrics.AddCounter("dockerlb_haproxy_certificate_updates_total",
+			"Total number of certificates updated through the runtime API.", nil, float64(count))
+	}
+	return nil
+}
+
+// updateCertificates brings the certificates and the crt-list of the running
+// HAProxy in line with the current configuration, returning the number of
+// certificates that were loaded
+func (h *HAProxyManager) updateCertificates() (int, error) {
+	h.mutex.Lock()
+	loadedConfig, loadedCrtList := h.loadedConfig, h.loadedCrtList
+	certs := make(map[string][]byte)
+	for path, data := range h.loadedCerts {
+		certs[path] = data
+	}
+	h.mutex.Unlock()
+	if loadedConfig == nil {
+		return 0, errConfigChanged
+	}
+
+	contents, err := h.computeConfig()
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(contents, loadedConfig) {
+		return 0, errConfigChanged
+	}
+	h.mutex.Lock()
+	crtList := h.crtList
+	h.mutex.Unlock()
+
+	// The entries of the crt-list can only be removed by their certificate,
+	// so it must not be ambiguous
+	var removed []crtListEntry
+	for _, entry := range loadedCrtList {
+		if !hasCrtListEntry(crtList, entry) {
+			if countCrtListEntries(loadedCrtList, entry.CertPath) > 1 || countCrtListEntries(crtList, entry.CertPath) > 0 {
+				return 0, errConfigChanged
+			}
+			removed = append(removed, entry)
+		}
+	}
+
+	// Add the new entries before removing the previous ones, so the domains
+	// always have a certificate, eg. when replacing a self-signed one
+	count := 0
+	for _, entry := range crtList {
+		data, err := ioutil.ReadFile(entry.CertPath)
+		if err != nil {
+			return count, fmt.Errorf("Could not read certificate %s: %s", entry.CertPath, err.Error())
+		}
+
+		loaded, ok := certs[entry.CertPath]
+		if !ok {
+			err = h.runtime.NewCertificate(entry.CertPath)
+			if err != nil {
+				return count, err
+			}
+		}
+		if !ok || !bytes.Equal(loaded, data) {
+			err = h.runtime.SetCertificate(entry.CertPath, data)
+			if err != nil {
+				return count, err
+			}
+			certs[entry.CertPath] = data
+			count++
+
+			// The certificate is replaced without its OCSP response, so staple
+			// the one on disk if it is still there
+			if response, err := ioutil.ReadFile(entry.CertPath + ".ocsp"); err == nil {
+				err = h.runtime.SetOCSPResponse(response)
+				if err != nil {
+					log.Warnf("Could not update the OCSP response of %s: %s", entry.CertPath, err.Error())
+				}
+			}
+		}
+
+		if !hasCrtListEntry(loadedCrtList, entry) {
+			err = h.runtime.AddCrtListEntry(h.crtListPath, entry.String())
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+
+	for _, entry := range removed {
+		err = h.runtime.DeleteCrtListEntry(h.crtListPath, entry.CertPath)
+		if err == nil {
+			err = h.runtime.DeleteCertificate(entry.CertPath)
+		}
+		if err != nil {
+			return count, err
+		}
+		delete(certs, entry.CertPath)
+	}
+
+	h.mutex.Lock()
+	h.loadedCrtList = crtList
+	h.loadedCerts = certs
+	h.mutex.Unlock()
+
+	return count, h.writeCrtList(crtList)
+}
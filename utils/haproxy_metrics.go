@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type haproxyStatField struct {
+	field   string
+	name    string
+	help    string
+	counter bool
+}
+
+// The fields from `show stat` that are exported as metrics
+var haproxyStatFields = []haproxyStatField{
+	{"scur", "current_sessions", "Current number of active sessions.", false},
+	{"smax", "max_sessions", "Maximum observed number of active sessions.", false},
+	{"stot", "sessions_total", "Total number of sessions.", true},
+	{"rate", "current_session_rate", "Current number of sessions per second over last elapsed second.", false},
+	{"bin", "bytes_in_total", "Current total of incoming bytes.", true},
+	{"bout", "bytes_out_total", "Current total of outgoing bytes.", true},
+	{"ereq", "request_errors_total", "Total of request errors.", true},
+	{"econ", "connection_errors_total", "Total of connection errors.", true},
+	{"eresp", "response_errors_total", "Total of response errors.", true},
+	{"qcur", "current_queue", "Current number of queued requests.", false},
+	{"rtime", "response_time_average_seconds", "Avg. HTTP response time for last 1024 successful connections.", false},
+}
+
+var haproxyStatTypes = map[string]string{
+	"0": "frontend",
+	"1": "backend",
+	"2": "server",
+}
+
+// RegisterMetrics registers the collectors that export the HAProxy traffic
+// statistics and the manager internals in the given registry
+func (h *HAProxyManager) RegisterMetrics(registry *MetricsRegistry) {
+	registry.RegisterCollector(h.collectMetrics)
+}
+
+func (h *HAProxyManager) collectMetrics(w *MetricsWriter) {
+	if h.proc == nil {
+		return
+	}
+
+	stats, err := h.runtime.ShowStat()
+	if err != nil {
+		log.Warnf("Could not collect HAProxy statistics: %s", err.Error())
+		w.Gauge("haproxy_up", "Was the last scrape of HAProxy successful.", nil, 0)
+		return
+	}
+	w.Gauge("haproxy_up", "Was the last scrape of HAProxy successful.", nil, 1)
+
+	h.mutex.Lock()
+	backendLabels := h.backendLabels
+	h.mutex.Unlock()
+
+	for _, row := range stats {
+		kind, ok := haproxyStatTypes[row["type"]]
+		if !ok {
+			continue
+		}
+
+		labels := map[string]string{"proxy": row["pxname"]}
+		if kind == "server" {
+			labels["server"] = row["svname"]
+		}
+		if kind != "frontend" {
+			for k, v := range backendLabels[row["pxname"]] {
+				labels[k] = v
+			}
+		}
+		if kind == "server" {
+			for k, v := range backendLabels[row["pxname"]+"/"+row["svname"]] {
+				labels[k] = v
+			}
+		}
+
+		prefix := "haproxy_" + kind + "_"
+		for _, f := range haproxyStatFields {
+			sv, ok := row[f.field]
+			if !ok || sv == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(sv, 64)
+			if err != nil {
+				continue
+			}
+			if f.field == "rtime" {
+				v = v / 1000
+			}
+
+			if f.counter {
+				w.Counter(prefix+f.name, f.help, labels, v)
+			} else {
+				w.Gauge(prefix+f.name, f.help, labels, v)
+			}
+		}
+
+		for _, code := range []string{"1xx", "2xx", "3xx", "4xx", "5xx", "other"} {
+			sv := row["hrsp_"+code]
+			if sv == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(sv, 64)
+			if err != nil {
+				continue
+			}
+
+			codeLabels := map[string]string{"code": code}
+			for k, v := range labels {
+				codeLabels[k] = v
+			}
+			w.Counter(prefix+"http_responses_total", "Total of HTTP responses.", codeLabels, v)
+		}
+
+		up := 0.0
+		if strings.HasPrefix(row["status"], "UP") || row["status"] == "OPEN" {
+			up = 1
+		}
+		w.Gauge(prefix+"status", "Current status of the proxy or server (1 = UP/OPEN).", labels, up)
+	}
+}
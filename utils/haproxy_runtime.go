@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// HAProxyRuntime is a client to the HAProxy runtime API, exposed through the
+// stats socket
+type HAProxyRuntime struct {
+	socketPath string
+	timeout    time.Duration
+}
+
+func CreateHAProxyRuntime(socketPath string) *HAProxyRuntime {
+	return &HAProxyRuntime{
+		socketPath: socketPath,
+		timeout:    10 * time.Second,
+	}
+}
+
+// Execute sends the given command to the runtime API and returns the response
+func (r *HAProxyRuntime) Execute(command string) (string, error) {
+	conn, err := net.DialTimeout("unix", r.socketPath, r.timeout)
+	if err != nil {
+		return "", fmt.Errorf("Could not connect to HAProxy socket: %s", err.Error())
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(r.timeout))
+	_, err = conn.Write([]byte(command + "\n"))
+	if err != nil {
+		return "", fmt.Errorf("Could not send command to HAProxy: %s", err.Error())
+	}
+
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("Could not read response from HAProxy: %s", err.Error())
+	}
+
+	return string(data), nil
+}
+
+// ShowStat returns the output of the `show stat` command, as one map of
+// field name to value for every proxy/server record
+func (r *HAProxyRuntime) ShowStat() ([]map[string]string, error) {
+	resp, err := r.Execute("show stat")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStatCSV(resp)
+}
+
+// SetOCSPResponse replaces the OCSP response stapled to the certificate it
+// refers to
+func (r *HAProxyRuntime) SetOCSPResponse(response []byte) error {
+	resp, err := r.Execute("set ssl ocsp-response " + base64.StdEncoding.EncodeToString(response))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(resp, "updated") {
+		return fmt.Errorf("Could not update OCSP response: %s", strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+// expect executes the command, failing unless the response contains the
+// given marker of success
+func (r *HAProxyRuntime) expect(command string, marker string) error {
+	resp, err := r.Execute(command)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(resp, marker) {
+		return fmt.Errorf("%s", strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+// payloadCommand appends the given payload to the command. The payload ends
+// at the first empty line, so the empty lines of the payload are dropped.
+func payloadCommand(command string, payload []byte) string {
+	lines := []string{command + " <<"}
+	for _, line := range strings.Split(string(payload), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// NewCertificate creates an empty certificate with the given path, that can
+// then be set and added to a crt-list
+func (r *HAProxyRuntime) NewCertificate(path string) error {
+	err := r.expect("new ssl cert "+path, "New empty certificate")
+	if err != nil {
+		return fmt.Errorf("Could not create certificate %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// SetCertificate replaces the certificate with the given path with the PEM
+// bundle, and commits the change
+func (r *HAProxyRuntime) SetCertificate(path string, data []byte) error {
+	err := r.expect(payloadCommand("set ssl cert "+path, data), "Transaction")
+	if err == nil {
+		err = r.expect("commit ssl cert "+path, "Success!")
+	}
+	if err != nil {
+		r.Execute("abort ssl cert " + path)
+		return fmt.Errorf("Could not update certificate %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// DeleteCertificate removes the certificate with the given path, which must
+// no longer be used by any crt-list
+func (r *HAProxyRuntime) DeleteCertificate(path string) error {
+	err := r.expect("del ssl cert "+path, "deleted")
+	if err != nil {
+		return fmt.Errorf("Could not delete certificate %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// AddCrtListEntry appends the given line to the crt-list
+func (r *HAProxyRuntime) AddCrtListEntry(crtList string, entry string) error {
+	err := r.expect(payloadCommand("add ssl crt-list "+crtList, []byte(entry)), "Success!")
+	if err != nil {
+		return fmt.Errorf("Could not add %s to the crt-list: %s", entry, err.Error())
+	}
+	return nil
+}
+
+// DeleteCrtListEntry removes the entry of the given certificate from the
+// crt-list
+func (r *HAProxyRuntime) DeleteCrtListEntry(crtList string, certPath string) error {
+	err := r.expect("del ssl crt-list "+crtList+" "+certPath, "deleted")
+	if err != nil {
+		return fmt.Errorf("Could not remove %s from the crt-list: %s", certPath, err.Error())
+	}
+	return nil
+}
+
+func parseStatCSV(data string) ([]map[string]string, error) {
+	var ret []map[string]string
+
+	data = strings.TrimPrefix(strings.TrimSpace(data), "# ")
+	if data == "" {
+		return nil, nil
+	}
+
+	rd := csv.NewReader(strings.NewReader(data))
+	rd.FieldsPerRecord = -1
+	records, err := rd.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse HAProxy stats: %s", err.Error())
+	}
+
+	header := records[0]
+	for _, rec := range records[1:] {
+		row := make(map[string]string)
+		for i, v := range rec {
+			if i < len(header) && header[i] != "" {
+				row[header[i]] = v
+			}
+		}
+		ret = append(ret, row)
+	}
+
+	return ret, nil
+}
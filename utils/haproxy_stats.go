@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HAProxyStatsConfig configures the HAProxy statistics page, that is exposed
+// on a dedicated admin listener
+type HAProxyStatsConfig struct {
+	Enabled      bool
+	Bind         string
+	URI          string
+	User         string
+	Password     string
+	AllowedCIDRs []string
+}
+
+// LoadHAProxyStatsConfig loads the statistics page configuration from the
+// `HAPROXY_STATS_*` environment variables. If no password is given, a random
+// one is generated and persisted in the config directory.
+func LoadHAProxyStatsConfig(configDir string) (*HAProxyStatsConfig, error) {
+	cfg := &HAProxyStatsConfig{
+		Enabled: false,
+		Bind:    "127.0.0.1:8404",
+		URI:     "/",
+		User:    "haproxy",
+	}
+
+	sv := os.Getenv("HAPROXY_STATS")
+	if sv == "yes" || sv == "true" || sv == "on" || sv == "1" {
+		cfg.Enabled = true
+	}
+	if !cfg.Enabled {
+		return cfg, nil
+	}
+
+	if sv := os.Getenv("HAPROXY_STATS_BIND"); sv != "" {
+		cfg.Bind = sv
+	}
+	if sv := os.Getenv("HAPROXY_STATS_URI"); sv != "" {
+		cfg.URI = normalizePath(sv)
+	}
+	if sv := os.Getenv("HAPROXY_STATS_USER"); sv != "" {
+		cfg.User = sv
+	}
+	cfg.Password = os.Getenv("HAPROXY_STATS_PASSWORD")
+	if sv := os.Getenv("HAPROXY_STATS_PASSWORD_FILE"); sv != "" && cfg.Password == "" {
+		data, err := ioutil.ReadFile(sv)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read stats password file: %s", err.Error())
+		}
+		cfg.Password = strings.TrimSpace(string(data))
+	}
+	if sv := os.Getenv("HAPROXY_STATS_ALLOW"); sv != "" {
+		for _, cidr := range strings.Split(sv, ",") {
+			cfg.AllowedCIDRs = append(cfg.AllowedCIDRs, strings.TrimSpace(cidr))
+		}
+	}
+
+	if cfg.Password == "" {
+		secret, err := loadOrCreateSecret(configDir + "/stats.secret")
+		if err != nil {
+			return nil, err
+		}
+		cfg.Password = secret
+		log.Infof("Using the generated stats password from %s/stats.secret", configDir)
+	}
+
+	return cfg, cfg.validate()
+}
+
+// statsUnsafeChars are the characters that HAProxy would read as a separator,
+// a comment, a quote or an escape in the stats settings
+const statsUnsafeChars = " \t\r\n#\"'\\"
+
+func (c *HAProxyStatsConfig) validate() error {
+	_, port, err := net.SplitHostPort(c.Bind)
+	if err != nil {
+		return fmt.Errorf("Invalid stats bind address '%s': %s", c.Bind, err.Error())
+	}
+	if strings.ContainsAny(c.Bind, statsUnsafeChars) {
+		return fmt.Errorf("Invalid stats bind address '%s'", c.Bind)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("Invalid stats bind port '%s'", port)
+	}
+	if strings.ContainsAny(c.User, ":"+statsUnsafeChars) || strings.ContainsAny(c.Password, statsUnsafeChars) {
+		return fmt.Errorf("The stats credentials cannot contain whitespace, '#', quotes or '\\'")
+	}
+	if strings.ContainsAny(c.URI, statsUnsafeChars) {
+		return fmt.Errorf("Invalid stats URI '%s'", c.URI)
+	}
+	for _, cidr := range c.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			if net.ParseIP(cidr) == nil {
+				return fmt.Errorf("Invalid stats source address '%s'", cidr)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *HAProxyStatsConfig) listenLines() []string {
+	lines := []string{
+		"listen stats",
+		"  bind " + c.Bind,
+		"  mode http",
+	}
+	if len(c.AllowedCIDRs) > 0 {
+		lines = append(lines,
+			"  acl stats_allowed src "+strings.Join(c.AllowedCIDRs, " "),
+			"  http-request deny deny_status 403 if !stats_allowed",
+		)
+	}
+	lines = append(lines,
+		"  stats enable",
+		"  stats uri "+c.URI,
+		"  stats refresh 10s",
+		fmt.Sprintf("  stats auth %s:%s", c.User, c.Password),
+		"",
+	)
+	return lines
+}
+
+// loadOrCreateSecret reads the secret from the given file, or generates a new
+// random one if the file is missing
+func loadOrCreateSecret(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("Could not read secret: %s", err.Error())
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Could not generate secret: %s", err.Error())
+	}
+	secret := hex.EncodeToString(buf)
+
+	err = ioutil.WriteFile(filename, []byte(secret), 0600)
+	if err != nil {
+		return "", fmt.Errorf("Could not write secret: %s", err.Error())
+	}
+
+	return secret, nil
+}
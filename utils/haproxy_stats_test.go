@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHAProxyStatsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := LoadHAProxyStatsConfig(dir)
+	if err != nil || cfg.Enabled {
+		t.Fatalf("Expected the stats page to be disabled by default (%v)", err)
+	}
+
+	// A random password is generated once and kept across restarts
+	reset := setTestEnv(map[string]string{"HAPROXY_STATS": "yes", "HAPROXY_STATS_URI": "stats"})
+	cfg, err = LoadHAProxyStatsConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Enabled || cfg.URI != "/stats" || cfg.User != "haproxy" || cfg.Password == "" {
+		t.Errorf("Unexpected stats config %+v", cfg)
+	}
+	again, err := LoadHAProxyStatsConfig(dir)
+	if err != nil || again.Password != cfg.Password {
+		t.Errorf("Expected the generated password to be reused (%v)", err)
+	}
+	reset()
+
+	passwordFile := filepath.Join(dir, "password")
+	ioutil.WriteFile(passwordFile, []byte("s3cret\n"), 0600)
+	reset = setTestEnv(map[string]string{
+		"HAPROXY_STATS":               "on",
+		"HAPROXY_STATS_BIND":          "0.0.0.0:9000",
+		"HAPROXY_STATS_USER":          "admin",
+		"HAPROXY_STATS_PASSWORD_FILE": passwordFile,
+		"HAPROXY_STATS_ALLOW":         "10.0.0.0/8, 192.168.1.1",
+	})
+	cfg, err = LoadHAProxyStatsConfig(dir)
+	reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.Join([]string{
+		"listen stats",
+		"  bind 0.0.0.0:9000",
+		"  mode http",
+		"  acl stats_allowed src 10.0.0.0/8 192.168.1.1",
+		"  http-request deny deny_status 403 if !stats_allowed",
+		"  stats enable",
+		"  stats uri /",
+		"  stats refresh 10s",
+		"  stats auth admin:s3cret",
+		"",
+	}, "\n")
+	if lines := strings.Join(cfg.listenLines(), "\n"); lines != expect {
+		t.Errorf("Unexpected stats section:\n%s", lines)
+	}
+
+	// The values that would break out of the stats section are refused
+	for name, value := range map[string]string{
+		"HAPROXY_STATS_PASSWORD": "foo#bar",
+		"HAPROXY_STATS_USER":     "admin\"",
+		"HAPROXY_STATS_URI":      "/stats\\",
+		"HAPROXY_STATS_BIND":     "localhost",
+		"HAPROXY_STATS_ALLOW":    "10.0.0.0/8 #",
+	} {
+		reset = setTestEnv(map[string]string{"HAPROXY_STATS": "yes", name: value})
+		if _, err := LoadHAProxyStatsConfig(dir); err == nil {
+			t.Errorf("Expected %s='%s' to be rejected", name, value)
+		}
+		reset()
+	}
+	for _, bind := range []string{"127.0.0.1:8404 #", "127.0.0.1:8404\n", "127.0.0.1:http", "127.0.0.1:0", "127.0.0.1:65536", ":-1"} {
+		cfg := &HAProxyStatsConfig{Bind: bind, URI: "/", User: "haproxy", Password: "secret"}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Expected the bind address %q to be rejected", bind)
+		}
+	}
+	for _, password := range []string{"foo'bar", "foo\\bar", "foo\nbar", "foo bar"} {
+		cfg := &HAProxyStatsConfig{Bind: "127.0.0.1:8404", URI: "/", User: "haproxy", Password: password}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Expected the password %q to be rejected", password)
+		}
+	}
+}
@@ -1,7 +1,13 @@
 package utils
 
 import (
+	"bufio"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -11,7 +17,7 @@ func (p *TestCertificateProvider) GetSelfSigned(domain string) (string, error) {
 	return fmt.Sprintf("<self:%s>", domain), nil
 }
 
-func (p *TestCertificateProvider) GetCertificateForDomain(domain string) (string, error) {
+func (p *TestCertificateProvider) GetCertificateForDomain(domain string, opts CertificateOptions) (string, error) {
 	return fmt.Sprintf("<letsencrypt:%s>", domain), nil
 }
 
@@ -19,6 +25,13 @@ func (p *TestCertificateProvider) GetAuthServicePort(ssl bool) int {
 	return 1234
 }
 
+func (p *TestCertificateProvider) GetDomainsToReissue() []string {
+	return nil
+}
+
+func (p *TestCertificateProvider) SetUpdateHandler(handler func(domain string)) {
+}
+
 func TestTemplateCreation(t *testing.T) {
 	haCfg := HAProxyManagerConfig{
 		Certificates:           &TestCertificateProvider{},
@@ -27,6 +40,8 @@ func TestTemplateCreation(t *testing.T) {
 	}
 
 	mgr := CreateHAProxyManager(haCfg)
+	mgr.errorsPath, _ = ioutil.TempDir("", "docker-lb-test")
+	defer os.RemoveAll(mgr.errorsPath)
 	mgr.state = &HAProxyState{
 		Endpoints: []ProxyEndpoint{
 			ProxyEndpoint{
@@ -55,3 +70,477 @@ func TestTemplateCreation(t *testing.T) {
 
 	fmt.Print(string(cfg))
 }
+
+// configSections splits the given configuration into its sections, by the
+// line that starts them
+func configSections(config []byte) map[string][]string {
+	sections := make(map[string][]string)
+	var name string
+	for _, line := range strings.Split(string(config), "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			name = line
+			continue
+		}
+		sections[name] = append(sections[name], strings.TrimSpace(line))
+	}
+	return sections
+}
+
+func hasConfigLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTLSFrontend(t *testing.T) {
+	mgr := CreateHAProxyManager(HAProxyManagerConfig{
+		Certificates: &TestCertificateProvider{},
+		BinaryPath:   "/usr/local/sbin/haproxy",
+	})
+	mgr.errorsPath, _ = ioutil.TempDir("", "docker-lb-test")
+	defer os.RemoveAll(mgr.errorsPath)
+	mgr.state = &HAProxyState{
+		Endpoints: []ProxyEndpoint{
+			ProxyEndpoint{
+				FrontendDomain: "foo.com",
+				BackendIP:      "1.2.3.4",
+				BackendPort:    80,
+				SSLAutoCert:    true,
+			},
+		},
+	}
+
+	cfg, err := mgr.computeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := configSections(cfg)
+
+	// The TCP frontend must not inherit any HTTP option
+	tlsIn := sections["frontend tls-in"]
+	for _, line := range []string{
+		"mode tcp",
+		"bind 0.0.0.0:443",
+		"use_backend be_challenge_tlsalpn if { req.ssl_alpn acme-tls/1 }",
+		"default_backend be_https_loopback",
+	} {
+		if !hasConfigLine(tlsIn, line) {
+			t.Errorf("Expected '%s' in the tls-in frontend, got %q", line, tlsIn)
+		}
+	}
+	for _, section := range []string{"defaults", "frontend tls-in", "backend be_challenge_tlsalpn", "backend be_https_loopback"} {
+		for _, line := range sections[section] {
+			if strings.Contains(line, "httplog") || strings.Contains(line, "forwardfor") || strings.Contains(line, "http-server-close") {
+				t.Errorf("Expected no HTTP option in %s, got '%s'", section, line)
+			}
+		}
+	}
+
+	// Everything else reaches the HTTPS frontend through the proxy protocol
+	if !hasConfigLine(sections["backend be_https_loopback"], "server https-in abns@https-in send-proxy-v2") {
+		t.Errorf("Expected the loopback to the HTTPS frontend, got %q", sections["backend be_https_loopback"])
+	}
+	for _, section := range []string{"frontend http-in", "frontend https-in"} {
+		for _, line := range []string{"mode http", "option httplog", "option http-server-close", "option forwardfor"} {
+			if !hasConfigLine(sections[section], line) {
+				t.Errorf("Expected '%s' in %s, got %q", line, section, sections[section])
+			}
+		}
+	}
+	if !hasConfigLine(sections["frontend https-in"], "bind abns@https-in accept-proxy ssl crt-list "+mgr.crtListPath) {
+		t.Errorf("Expected the HTTPS frontend to accept the proxy protocol, got %q", sections["frontend https-in"])
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pagesDir := filepath.Join(tmpDir, "pages")
+	os.MkdirAll(filepath.Join(pagesDir, "foo.com"), 0700)
+	ioutil.WriteFile(filepath.Join(pagesDir, "foo.com", "404.html"), []byte("custom 404"), 0600)
+
+	haCfg := HAProxyManagerConfig{
+		Certificates:  &TestCertificateProvider{},
+		BinaryPath:    "/usr/local/sbin/haproxy",
+		ErrorPagesDir: pagesDir,
+	}
+
+	mgr := CreateHAProxyManager(haCfg)
+	mgr.errorsPath = filepath.Join(tmpDir, "errors")
+	mgr.state = &HAProxyState{
+		Endpoints: []ProxyEndpoint{
+			ProxyEndpoint{
+				FrontendDomain: "foo.com",
+				BackendIP:      "1.2.3.4",
+				BackendPort:    80,
+			},
+		},
+	}
+
+	cfg, err := mgr.computeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expect := range []string{
+		"http-errors errors_default",
+		"http-errors errors_foo_com",
+		"errorfiles errors_foo_com",
+		"default_backend be_notfound",
+		"http-request return status 404 errorfiles errors_foo_com if host_nf1",
+	} {
+		if !strings.Contains(string(cfg), expect) {
+			t.Errorf("Expected config to contain '%s'", expect)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(mgr.errorsPath, "errors_foo_com", "404.http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "HTTP/1.0 404 Not Found\r\n") || !strings.HasSuffix(string(data), "\r\n\r\ncustom 404") {
+		t.Errorf("Unexpected error file contents: %q", string(data))
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(mgr.errorsPath, "errors_foo_com", "503.http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "foo.com &middot; docker-lb") {
+		t.Errorf("Expected the built-in 503 page, got %q", string(data))
+	}
+}
+
+func TestErrorPageNames(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The two domains have the same name once sanitized
+	pagesDir := filepath.Join(tmpDir, "pages")
+	domains := []string{"foo-bar.com", "foo.bar.com"}
+	var endpoints []ProxyEndpoint
+	for i, domain := range domains {
+		os.MkdirAll(filepath.Join(pagesDir, domain), 0700)
+		ioutil.WriteFile(filepath.Join(pagesDir, domain, "404.html"), []byte("404 of "+domain), 0600)
+		endpoints = append(endpoints, ProxyEndpoint{
+			FrontendDomain: domain,
+			BackendIP:      fmt.Sprintf("1.2.3.%d", i+1),
+			BackendPort:    80,
+			ContainerName:  fmt.Sprintf("web_%d", i+1),
+			ServiceName:    "web",
+			Order:          -1,
+		})
+	}
+
+	mgr := CreateHAProxyManager(HAProxyManagerConfig{
+		Certificates:  &TestCertificateProvider{},
+		ErrorPagesDir: pagesDir,
+	})
+	mgr.errorsPath = filepath.Join(tmpDir, "errors")
+	mgr.state = &HAProxyState{Endpoints: endpoints}
+
+	cfg, err := mgr.computeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := configSections(cfg)
+
+	names := make(map[string]bool)
+	for i, domain := range domains {
+		// The backend of the domain uses its error pages
+		var name string
+		for section, lines := range sections {
+			if !strings.HasPrefix(section, "backend ") || !hasConfigLine(lines, fmt.Sprintf("server web_%d 1.2.3.%d:80", i+1, i+1)) {
+				continue
+			}
+			for _, line := range lines {
+				if strings.HasPrefix(line, "errorfiles ") {
+					name = strings.TrimPrefix(line, "errorfiles ")
+				}
+			}
+		}
+		if name == "" || names[name] {
+			t.Fatalf("Expected a unique error section for %s, got '%s'", domain, name)
+		}
+		names[name] = true
+		if _, ok := sections["http-errors "+name]; !ok {
+			t.Errorf("Expected the error section %s to be defined", name)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(mgr.errorsPath, name, "404.http"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(data), "\r\n\r\n404 of "+domain) {
+			t.Errorf("Expected the 404 page of %s, got %q", domain, string(data))
+		}
+	}
+}
+
+func TestStableBackendNames(t *testing.T) {
+	endpoints := []ProxyEndpoint{
+		ProxyEndpoint{
+			FrontendDomain: "foo.com",
+			FrontendPath:   "/api/v1",
+			BackendIP:      "1.2.3.4",
+			BackendPort:    80,
+			ContainerName:  "api_1",
+			ServiceName:    "api",
+			Order:          -1,
+		},
+		ProxyEndpoint{
+			FrontendDomain: "foo.com",
+			FrontendPath:   "/api/v1",
+			BackendIP:      "1.2.3.5",
+			BackendPort:    80,
+			ContainerName:  "api_2",
+			ServiceName:    "api",
+			Order:          -1,
+		},
+		ProxyEndpoint{
+			FrontendDomain: "foo.com",
+			BackendIP:      "1.2.3.6",
+			BackendPort:    8080,
+			ContainerName:  "web_1",
+			ServiceName:    "web",
+			Order:          -1,
+		},
+	}
+
+	errorsPath, _ := ioutil.TempDir("", "docker-lb-test")
+	defer os.RemoveAll(errorsPath)
+
+	compute := func(eps []ProxyEndpoint) string {
+		mgr := CreateHAProxyManager(HAProxyManagerConfig{
+			Certificates: &TestCertificateProvider{},
+		})
+		mgr.errorsPath = errorsPath
+		mgr.state = &HAProxyState{Endpoints: eps}
+		cfg, err := mgr.computeConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(cfg)
+	}
+
+	cfg := compute(endpoints)
+	for _, expect := range []string{
+		"backend be_foo_com_api_v1_api",
+		"  server api_1 1.2.3.4:80",
+		"  server api_2 1.2.3.5:80",
+		"backend be_foo_com_root_web",
+		"  use_backend be_foo_com_api_v1_api if host_fe0 host_fe0_url0",
+	} {
+		if !strings.Contains(cfg, expect) {
+			t.Errorf("Expected config to contain '%s'", expect)
+		}
+	}
+
+	reversed := []ProxyEndpoint{endpoints[2], endpoints[1], endpoints[0]}
+	if compute(reversed) != cfg {
+		t.Errorf("Expected the same config regardless of the endpoint order")
+	}
+}
+
+func TestTLSPolicies(t *testing.T) {
+	tuning := DefaultHAProxyTuning()
+	tuning.TLSPolicy = "intermediate"
+	tuning.TLSPolicies = map[string]TLSPolicy{
+		"legacy": TLSPolicy{MinVersion: "TLSv1.0", Ciphers: "HIGH:!aNULL"},
+	}
+	if err := tuning.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	errorsPath, _ := ioutil.TempDir("", "docker-lb-test")
+	defer os.RemoveAll(errorsPath)
+
+	mgr := CreateHAProxyManager(HAProxyManagerConfig{
+		Certificates: &TestCertificateProvider{},
+		Tuning:       &tuning,
+	})
+	mgr.errorsPath = errorsPath
+	mgr.state = &HAProxyState{
+		Endpoints: []ProxyEndpoint{
+			{FrontendDomain: "foo.com", BackendIP: "1.2.3.4", BackendPort: 80, SSLAutoCert: true, SSLPolicy: "modern"},
+			{FrontendDomain: "bar.com", BackendIP: "1.2.3.4", BackendPort: 80, SSLAutoCert: true},
+			{FrontendDomain: "baz.com", BackendIP: "1.2.3.4", BackendPort: 80, SSLAutoCert: true, SSLPolicy: "legacy"},
+			{FrontendDomain: "qux.com", BackendIP: "1.2.3.4", BackendPort: 80, SSLAutoCert: true, SSLPolicy: "unknown"},
+		},
+	}
+	cfg, err := mgr.computeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expect := range []string{
+		"  ssl-default-bind-options ssl-min-ver TLSv1.2",
+		"  ssl-default-bind-ciphers ECDHE-ECDSA-AES128-GCM-SHA256:",
+		"  ssl-default-bind-ciphersuites TLS_AES_128_GCM_SHA256:",
+		"  bind abns@https-in accept-proxy ssl crt-list " + mgr.crtListPath,
+	} {
+		if !strings.Contains(string(cfg), expect) {
+			t.Errorf("Expected config to contain '%s'", expect)
+		}
+	}
+
+	var crtList []string
+	for _, entry := range mgr.crtList {
+		crtList = append(crtList, entry.String())
+	}
+	expected := []string{
+		"<letsencrypt:bar.com>",
+		"<letsencrypt:baz.com> [ssl-min-ver TLSv1.0 ciphers HIGH:!aNULL] baz.com",
+		"<letsencrypt:foo.com> [ssl-min-ver TLSv1.3 ciphersuites TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256] foo.com",
+		"<letsencrypt:qux.com>",
+	}
+	if strings.Join(crtList, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected crt-list:\n%s", strings.Join(crtList, "\n"))
+	}
+
+	tuning.TLSPolicy = "unknown"
+	if err := tuning.validate(); err == nil {
+		t.Errorf("Expected an unknown global policy to be rejected")
+	}
+}
+
+// testPathProvider serves the certificates from the given paths
+type testPathProvider struct {
+	TestCertificateProvider
+	paths map[string]string
+}
+
+func (p *testPathProvider) GetCertificateForDomain(domain string, opts CertificateOptions) (string, error) {
+	return p.paths[domain], nil
+}
+
+// serveTestRuntime is a stand-in of the HAProxy runtime API, that records the
+// commands it receives
+func serveTestRuntime(t *testing.T, socketPath string) chan string {
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			r := bufio.NewReader(conn)
+			line, _ := r.ReadString('\n')
+			command := strings.TrimSpace(line)
+			if strings.HasSuffix(command, "<<") {
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == "\n" {
+						break
+					}
+				}
+			}
+			commands <- strings.TrimSpace(strings.TrimSuffix(command, "<<"))
+
+			switch {
+			case strings.HasPrefix(command, "new ssl cert"):
+				conn.Write([]byte("New empty certificate store\n"))
+			case strings.HasPrefix(command, "set ssl cert"):
+				conn.Write([]byte("Transaction created\n"))
+			case strings.HasPrefix(command, "del "):
+				conn.Write([]byte("deleted!\n"))
+			default:
+				conn.Write([]byte("Success!\n"))
+			}
+			conn.Close()
+		}
+	}()
+	return commands
+}
+
+func TestUpdateCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certs := &testPathProvider{paths: map[string]string{
+		"foo.com": filepath.Join(dir, "selfsigned-foo.com.pem"),
+		"bar.com": filepath.Join(dir, "bar.com.pem"),
+	}}
+	for _, path := range certs.paths {
+		ioutil.WriteFile(path, []byte("old"), 0600)
+	}
+	mgr := CreateHAProxyManager(HAProxyManagerConfig{Certificates: certs})
+	mgr.errorsPath = filepath.Join(dir, "errors")
+	mgr.cfgPath = filepath.Join(dir, "haproxy.conf")
+	mgr.crtListPath = filepath.Join(dir, "crt-list.txt")
+	mgr.runtime = CreateHAProxyRuntime(filepath.Join(dir, "haproxy.sock"))
+	mgr.state = &HAProxyState{
+		Endpoints: []ProxyEndpoint{
+			{FrontendDomain: "foo.com", BackendIP: "1.2.3.4", BackendPort: 80, SSLAutoCert: true},
+			{FrontendDomain: "bar.com", BackendIP: "1.2.3.4", BackendPort: 80, SSLAutoCert: true},
+		},
+	}
+	if err := mgr.writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	commands := serveTestRuntime(t, filepath.Join(dir, "haproxy.sock"))
+
+	// The certificate of foo.com replaces its self-signed one, and the one of
+	// bar.com is renewed, as an ECDSA and RSA pair
+	certs.paths["foo.com"] = filepath.Join(dir, "foo.com.pem")
+	ioutil.WriteFile(certs.paths["foo.com"], []byte("new"), 0600)
+	os.Remove(certs.paths["bar.com"])
+	ioutil.WriteFile(certs.paths["bar.com"]+".ecdsa", []byte("new"), 0600)
+	ioutil.WriteFile(certs.paths["bar.com"]+".rsa", []byte("new"), 0600)
+
+	if count, err := mgr.updateCertificates(); err != nil || count != 3 {
+		t.Fatalf("Expected 3 certificates to be updated, got %d (%v)", count, err)
+	}
+	close(commands)
+
+	var got []string
+	for command := range commands {
+		got = append(got, strings.Replace(command, dir+"/", "", -1))
+	}
+	crtList := "crt-list.txt"
+	expected := []string{
+		"new ssl cert bar.com.pem.ecdsa", "set ssl cert bar.com.pem.ecdsa", "commit ssl cert bar.com.pem.ecdsa",
+		"add ssl crt-list " + crtList,
+		"new ssl cert bar.com.pem.rsa", "set ssl cert bar.com.pem.rsa", "commit ssl cert bar.com.pem.rsa",
+		"add ssl crt-list " + crtList,
+		"new ssl cert foo.com.pem", "set ssl cert foo.com.pem", "commit ssl cert foo.com.pem",
+		"add ssl crt-list " + crtList,
+		"del ssl crt-list " + crtList + " bar.com.pem", "del ssl cert bar.com.pem",
+		"del ssl crt-list " + crtList + " selfsigned-foo.com.pem", "del ssl cert selfsigned-foo.com.pem",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected runtime commands:\n%s", strings.Join(got, "\n"))
+	}
+	if data, _ := ioutil.ReadFile(mgr.crtListPath); !strings.Contains(string(data), "foo.com.pem\n") ||
+		strings.Contains(string(data), "selfsigned") {
+		t.Errorf("Expected the crt-list to be updated, got:\n%s", data)
+	}
+
+	// Adding a domain changes the rest of the configuration
+	mgr.state.Endpoints = append(mgr.state.Endpoints,
+		ProxyEndpoint{FrontendDomain: "baz.com", BackendIP: "1.2.3.4", BackendPort: 80})
+	if _, err := mgr.updateCertificates(); err != errConfigChanged {
+		t.Errorf("Expected a reload to be needed, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TLSPolicy restricts the protocol versions and the ciphers accepted by the
+// HTTPS frontend, either for all the domains or for some of them
+type TLSPolicy struct {
+	MinVersion   string `json:"min_version"`
+	MaxVersion   string `json:"max_version"`
+	Ciphers      string `json:"ciphers"`
+	CipherSuites string `json:"ciphersuites"`
+}
+
+// The built-in policies, following the Mozilla server side TLS guidelines
+var tlsPolicyPresets = map[string]TLSPolicy{
+	"modern": TLSPolicy{
+		MinVersion:   "TLSv1.3",
+		CipherSuites: "TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256",
+	},
+	"intermediate": TLSPolicy{
+		MinVersion: "TLSv1.2",
+		Ciphers: "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:" +
+			"ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:" +
+			"DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384",
+		CipherSuites: "TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256",
+	},
+	"old": TLSPolicy{
+		MinVersion: "TLSv1.0",
+		Ciphers: "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:" +
+			"ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:" +
+			"DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384:DHE-RSA-CHACHA20-POLY1305:" +
+			"ECDHE-ECDSA-AES128-SHA256:ECDHE-RSA-AES128-SHA256:ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES128-SHA:" +
+			"ECDHE-ECDSA-AES256-SHA384:ECDHE-RSA-AES256-SHA384:ECDHE-ECDSA-AES256-SHA:ECDHE-RSA-AES256-SHA:" +
+			"DHE-RSA-AES128-SHA256:DHE-RSA-AES256-SHA256:AES128-GCM-SHA256:AES256-GCM-SHA384:" +
+			"AES128-SHA256:AES256-SHA256:AES128-SHA:AES256-SHA:DES-CBC3-SHA",
+		CipherSuites: "TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256",
+	},
+}
+
+var (
+	tlsVersions  = []string{"SSLv3", "TLSv1.0", "TLSv1.1", "TLSv1.2", "TLSv1.3"}
+	cipherFormat = regexp.MustCompile(`^[A-Za-z0-9_+!@=:.-]+$`)
+)
+
+func isValidTLSVersion(v string) bool {
+	for _, version := range tlsVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *TLSPolicy) validate() error {
+	if p.MinVersion != "" && !isValidTLSVersion(p.MinVersion) {
+		return fmt.Errorf("Invalid minimum TLS version '%s'", p.MinVersion)
+	}
+	if p.MaxVersion != "" && !isValidTLSVersion(p.MaxVersion) {
+		return fmt.Errorf("Invalid maximum TLS version '%s'", p.MaxVersion)
+	}
+	if p.Ciphers != "" && !cipherFormat.MatchString(p.Ciphers) {
+		return fmt.Errorf("Invalid cipher list '%s'", p.Ciphers)
+	}
+	if p.CipherSuites != "" && !cipherFormat.MatchString(p.CipherSuites) {
+		return fmt.Errorf("Invalid cipher suites '%s'", p.CipherSuites)
+	}
+	return nil
+}
+
+// versionOptions returns the options restricting the protocol versions
+func (p *TLSPolicy) versionOptions() []string {
+	var opts []string
+	if p.MinVersion != "" {
+		opts = append(opts, "ssl-min-ver "+p.MinVersion)
+	}
+	if p.MaxVersion != "" {
+		opts = append(opts, "ssl-max-ver "+p.MaxVersion)
+	}
+	return opts
+}
+
+// globalLines returns the `ssl-default-bind-*` settings of the policy, which
+// apply to all the domains without a policy of their own
+func (p *TLSPolicy) globalLines() []string {
+	var lines []string
+	if opts := p.versionOptions(); len(opts) > 0 {
+		lines = append(lines, "  ssl-default-bind-options "+strings.Join(opts, " "))
+	}
+	if p.Ciphers != "" {
+		lines = append(lines, "  ssl-default-bind-ciphers "+p.Ciphers)
+	}
+	if p.CipherSuites != "" {
+		lines = append(lines, "  ssl-default-bind-ciphersuites "+p.CipherSuites)
+	}
+	return lines
+}
+
+// crtListOptions returns the options of the policy in a crt-list entry
+func (p *TLSPolicy) crtListOptions() string {
+	opts := p.versionOptions()
+	if p.Ciphers != "" {
+		opts = append(opts, "ciphers "+p.Ciphers)
+	}
+	if p.CipherSuites != "" {
+		opts = append(opts, "ciphersuites "+p.CipherSuites)
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(opts, " ") + "]"
+}
+
+// tlsPolicy looks up the policy with the given name, with the custom policies
+// taking precedence over the built-in ones
+func (t *HAProxyTuning) tlsPolicy(name string) (TLSPolicy, bool) {
+	if p, ok := t.TLSPolicies[name]; ok {
+		return p, true
+	}
+	p, ok := tlsPolicyPresets[name]
+	return p, ok
+}
+
+// crtListEntry is a line of the generated crt-list
+type crtListEntry struct {
+	CertPath string
+	Options  string
+	SNI      string
+}
+
+func (e crtListEntry) String() string {
+	line := e.CertPath
+	if e.Options != "" {
+		line += " " + e.Options
+	}
+	if e.SNI != "" {
+		line += " " + e.SNI
+	}
+	return line
+}
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type HAProxyTimeouts struct {
+	Connect       string `json:"connect"`
+	Client        string `json:"client"`
+	Server        string `json:"server"`
+	Tunnel        string `json:"tunnel"`
+	HTTPKeepAlive string `json:"http_keep_alive"`
+	HTTPRequest   string `json:"http_request"`
+	Queue         string `json:"queue"`
+	Tarpit        string `json:"tarpit"`
+}
+
+// HAProxyTuning contains the values used in the `global` and `defaults`
+// sections of the generated configuration
+type HAProxyTuning struct {
+	LogTarget     string          `json:"log_target"`
+	MaxConn       int             `json:"maxconn"`
+	NbThread      int             `json:"nbthread"`
+	DHParam       int             `json:"dh_param"`
+	Backlog       int             `json:"backlog"`
+	DefaultServer string          `json:"default_server"`
+	Timeouts      HAProxyTimeouts `json:"timeouts"`
+
+	// The name of the TLS policy applied to all the domains, and the custom
+	// policies that can be given to the domains besides the built-in ones
+	TLSPolicy   string               `json:"tls_policy"`
+	TLSPolicies map[string]TLSPolicy `json:"tls_policies"`
+}
+
+var timeoutFormat = regexp.MustCompile(`^[0-9]+(us|ms|s|m|h|d)?$`)
+
+// IsValidTimeout checks if the given string is a valid HAProxy time value
+func IsValidTimeout(v string) bool {
+	return timeoutFormat.MatchString(v)
+}
+
+func DefaultHAProxyTuning() HAProxyTuning {
+	return HAProxyTuning{
+		LogTarget:     "stdout local0 info",
+		MaxConn:       4096,
+		NbThread:      0,
+		DHParam:       2048,
+		Backlog:       10000,
+		DefaultServer: "inter 3s rise 2 fall 3",
+		Timeouts: HAProxyTimeouts{
+			Connect:       "5s",
+			Client:        "60s",
+			Server:        "60s",
+			Tunnel:        "3600s",
+			HTTPKeepAlive: "1s",
+			HTTPRequest:   "60s",
+			Queue:         "80s",
+			Tarpit:        "30s",
+		},
+	}
+}
+
+// LoadHAProxyTuning starts from the default tuning values, overrides them
+// with the values in the given JSON file (if it exists) and then with the
+// values from the `HAPROXY_*` environment variables.
+func LoadHAProxyTuning(configFile string) (HAProxyTuning, error) {
+	tuning := DefaultHAProxyTuning()
+
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err == nil {
+			err = json.Unmarshal(data, &tuning)
+			if err != nil {
+				return tuning, fmt.Errorf("Could not parse %s: %s", configFile, err.Error())
+			}
+		} else if !os.IsNotExist(err) {
+			return tuning, fmt.Errorf("Could not read %s: %s", configFile, err.Error())
+		}
+	}
+
+	strVars := map[string]*string{
+		"HAPROXY_LOG_TARGET":              &tuning.LogTarget,
+		"HAPROXY_DEFAULT_SERVER":          &tuning.DefaultServer,
+		"HAPROXY_TLS_POLICY":              &tuning.TLSPolicy,
+		"HAPROXY_TIMEOUT_CONNECT":         &tuning.Timeouts.Connect,
+		"HAPROXY_TIMEOUT_CLIENT":          &tuning.Timeouts.Client,
+		"HAPROXY_TIMEOUT_SERVER":          &tuning.Timeouts.Server,
+		"HAPROXY_TIMEOUT_TUNNEL":          &tuning.Timeouts.Tunnel,
+		"HAPROXY_TIMEOUT_HTTP_KEEP_ALIVE": &tuning.Timeouts.HTTPKeepAlive,
+		"HAPROXY_TIMEOUT_HTTP_REQUEST":    &tuning.Timeouts.HTTPRequest,
+		"HAPROXY_TIMEOUT_QUEUE":           &tuning.Timeouts.Queue,
+		"HAPROXY_TIMEOUT_TARPIT":          &tuning.Timeouts.Tarpit,
+	}
+	for name, ptr := range strVars {
+		if sv := os.Getenv(name); sv != "" {
+			*ptr = sv
+		}
+	}
+
+	intVars := map[string]*int{
+		"HAPROXY_MAXCONN":  &tuning.MaxConn,
+		"HAPROXY_NBTHREAD": &tuning.NbThread,
+		"HAPROXY_DH_PARAM": &tuning.DHParam,
+		"HAPROXY_BACKLOG":  &tuning.Backlog,
+	}
+	for name, ptr := range intVars {
+		if sv := os.Getenv(name); sv != "" {
+			v, err := strconv.Atoi(sv)
+			if err != nil {
+				return tuning, fmt.Errorf("The value of %s is not numeric: %s", name, sv)
+			}
+			*ptr = v
+		}
+	}
+
+	return tuning, tuning.validate()
+}
+
+func (t *HAProxyTuning) validate() error {
+	timeouts := map[string]string{
+		"connect":         t.Timeouts.Connect,
+		"client":          t.Timeouts.Client,
+		"server":          t.Timeouts.Server,
+		"tunnel":          t.Timeouts.Tunnel,
+		"http-keep-alive": t.Timeouts.HTTPKeepAlive,
+		"http-request":    t.Timeouts.HTTPRequest,
+		"queue":           t.Timeouts.Queue,
+		"tarpit":          t.Timeouts.Tarpit,
+	}
+	for name, v := range timeouts {
+		if !IsValidTimeout(v) {
+			return fmt.Errorf("Invalid value for timeout %s: '%s'", name, v)
+		}
+	}
+
+	// These values are written verbatim in the configuration, so they cannot
+	// start a new line or a comment
+	if strings.ContainsAny(t.LogTarget, "\r\n#") {
+		return fmt.Errorf("Invalid log target '%s'", t.LogTarget)
+	}
+	if strings.ContainsAny(t.DefaultServer, "\r\n#") {
+		return fmt.Errorf("Invalid default-server options '%s'", t.DefaultServer)
+	}
+
+	if t.MaxConn <= 0 {
+		return fmt.Errorf("The maxconn value must be positive")
+	}
+	if t.NbThread < 0 {
+		return fmt.Errorf("The nbthread value cannot be negative")
+	}
+
+	for name, p := range t.TLSPolicies {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("Invalid TLS policy %s: %s", name, err.Error())
+		}
+	}
+	if _, ok := t.tlsPolicy(t.TLSPolicy); t.TLSPolicy != "" && !ok {
+		return fmt.Errorf("Unknown TLS policy '%s'", t.TLSPolicy)
+	}
+
+	return nil
+}
+
+func (t *HAProxyTuning) globalLines() []string {
+	lines := []string{
+		"  log " + t.LogTarget,
+		fmt.Sprintf("  maxconn %d", t.MaxConn),
+	}
+	if t.NbThread > 0 {
+		lines = append(lines, fmt.Sprintf("  nbthread %d", t.NbThread))
+	}
+	if t.DHParam > 0 {
+		lines = append(lines, fmt.Sprintf("  tune.ssl.default-dh-param %d", t.DHParam))
+	}
+	if p, ok := t.tlsPolicy(t.TLSPolicy); ok {
+		lines = append(lines, p.globalLines()...)
+	}
+	return lines
+}
+
+func (t *HAProxyTuning) defaultsLines() []string {
+	lines := []string{
+		"  log     global",
+		"  timeout connect         " + t.Timeouts.Connect,
+		"  timeout client          " + t.Timeouts.Client,
+		"  timeout server          " + t.Timeouts.Server,
+		"  timeout tunnel          " + t.Timeouts.Tunnel,
+		"  timeout http-keep-alive " + t.Timeouts.HTTPKeepAlive,
+		"  timeout http-request    " + t.Timeouts.HTTPRequest,
+		"  timeout queue           " + t.Timeouts.Queue,
+		"  timeout tarpit          " + t.Timeouts.Tarpit,
+		"  option  dontlognull",
+	}
+	if t.Backlog > 0 {
+		lines = append(lines, fmt.Sprintf("  backlog %d", t.Backlog))
+	}
+	if t.DefaultServer != "" {
+		lines = append(lines, "  default-server "+t.DefaultServer)
+	}
+	return lines
+}
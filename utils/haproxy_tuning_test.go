@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setTestEnv(vars map[string]string) func() {
+	for name, value := range vars {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range vars {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestHAProxyTuning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tuning, err := LoadHAProxyTuning(filepath.Join(dir, "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tuning.MaxConn != 4096 || tuning.Timeouts.Client != "60s" {
+		t.Errorf("Expected the default tuning without a config file, got %+v", tuning)
+	}
+
+	// The environment takes precedence over the config file
+	configFile := filepath.Join(dir, "haproxy.json")
+	ioutil.WriteFile(configFile, []byte(`{"maxconn": 100, "log_target": "127.0.0.1 local1", "timeouts": {"client": "30s"}}`), 0600)
+	reset := setTestEnv(map[string]string{"HAPROXY_MAXCONN": "200", "HAPROXY_TIMEOUT_SERVER": "2m"})
+	tuning, err = LoadHAProxyTuning(configFile)
+	reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tuning.MaxConn != 200 || tuning.LogTarget != "127.0.0.1 local1" || tuning.Timeouts.Client != "30s" ||
+		tuning.Timeouts.Server != "2m" || tuning.Timeouts.Connect != "5s" {
+		t.Errorf("Unexpected tuning %+v", tuning)
+	}
+
+	tests := []struct {
+		env   map[string]string
+		valid bool
+	}{
+		{map[string]string{"HAPROXY_NBTHREAD": "4"}, true},
+		{map[string]string{"HAPROXY_TLS_POLICY": "modern"}, true},
+		{map[string]string{"HAPROXY_DEFAULT_SERVER": "inter 5s check-ssl"}, true},
+		{map[string]string{"HAPROXY_MAXCONN": "many"}, false},
+		{map[string]string{"HAPROXY_MAXCONN": "0"}, false},
+		{map[string]string{"HAPROXY_NBTHREAD": "-1"}, false},
+		{map[string]string{"HAPROXY_TIMEOUT_CLIENT": "10 s"}, false},
+		{map[string]string{"HAPROXY_TLS_POLICY": "missing"}, false},
+		{map[string]string{"HAPROXY_LOG_TARGET": "stdout local0\n  stats socket /tmp/admin.sock level admin"}, false},
+		{map[string]string{"HAPROXY_LOG_TARGET": "stdout local0\r"}, false},
+		{map[string]string{"HAPROXY_DEFAULT_SERVER": "inter 3s # comment"}, false},
+		{map[string]string{"HAPROXY_DEFAULT_SERVER": "inter 3s\nlisten admin"}, false},
+	}
+	for _, test := range tests {
+		reset := setTestEnv(test.env)
+		_, err := LoadHAProxyTuning("")
+		reset()
+		if test.valid && err != nil {
+			t.Errorf("Expected %v to be valid: %s", test.env, err.Error())
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Expected %v to be rejected", test.env)
+		}
+	}
+
+	ioutil.WriteFile(configFile, []byte(`{"tls_policies": {"custom": {"min_version": "TLSv9"}}}`), 0600)
+	if _, err := LoadHAProxyTuning(configFile); err == nil {
+		t.Errorf("Expected an invalid TLS policy in the config file to be rejected")
+	}
+}
@@ -1,14 +1,27 @@
 package utils
 
+type HAPServerRecord struct {
+	Name      string
+	Container string
+	Port      int
+	Host      string
+}
+
 type HAPBackendRecord struct {
-	Index int
-	Port  int
-	Host  string
-	Order int
+	Name    string
+	Domain  string
+	Service string
+	Servers []*HAPServerRecord
+	Order   int
 
 	// Needed for URL rewriting
 	PathBe string
 	PathFe string
+
+	// Per-route timeout overrides
+	TimeoutServer  string
+	TimeoutConnect string
+	TimeoutTunnel  string
 }
 
 type HAPMappingRecord struct {
@@ -18,10 +31,16 @@ type HAPMappingRecord struct {
 }
 
 type HAPFrontendRecord struct {
-	Index   int
-	Domain  string
-	SSL     bool
-	Mapping []*HAPMappingRecord
+	Index      int
+	Domain     string
+	SSL        bool
+	ErrorPages string
+	Challenge  string
+	CertSecret string
+	Issuer     string
+	KeyType    string
+	TLSPolicy  string
+	Mapping    []*HAPMappingRecord
 }
 
 // Sorting helpers
@@ -34,5 +53,75 @@ func (s byOrder) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 func (s byOrder) Less(i, j int) bool {
-	return s[i].Backend.Order < s[j].Backend.Order
+	if s[i].Backend.Order != s[j].Backend.Order {
+		return s[i].Backend.Order < s[j].Backend.Order
+	}
+	if s[i].Path != s[j].Path {
+		return s[i].Path < s[j].Path
+	}
+	return s[i].Backend.Name < s[j].Backend.Name
+}
+
+type byName []*HAPBackendRecord
+
+func (s byName) Len() int {
+	return len(s)
+}
+func (s byName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s byName) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
+
+type byServerName []*HAPServerRecord
+
+func (s byServerName) Len() int {
+	return len(s)
+}
+func (s byServerName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s byServerName) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
+
+type byDomain []*HAPFrontendRecord
+
+func (s byDomain) Len() int {
+	return len(s)
+}
+func (s byDomain) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s byDomain) Less(i, j int) bool {
+	if s[i].Domain != s[j].Domain {
+		return s[i].Domain < s[j].Domain
+	}
+	return !s[i].SSL && s[j].SSL
+}
+
+type byEndpoint []ProxyEndpoint
+
+func (s byEndpoint) Len() int {
+	return len(s)
+}
+func (s byEndpoint) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s byEndpoint) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	if a.FrontendDomain != b.FrontendDomain {
+		return a.FrontendDomain < b.FrontendDomain
+	}
+	if a.FrontendPath != b.FrontendPath {
+		return a.FrontendPath < b.FrontendPath
+	}
+	if a.ServiceName != b.ServiceName {
+		return a.ServiceName < b.ServiceName
+	}
+	if a.BackendIP != b.BackendIP {
+		return a.BackendIP < b.BackendIP
+	}
+	return a.BackendPort < b.BackendPort
 }
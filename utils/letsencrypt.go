@@ -2,15 +2,62 @@ package utils
 
 import (
 	"crypto"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
 
 	"github.com/go-acme/lego/v3/certcrypto"
 	"github.com/go-acme/lego/v3/certificate"
-	"github.com/go-acme/lego/v3/challenge/http01"
+	"github.com/go-acme/lego/v3/challenge/dns01"
 	"github.com/go-acme/lego/v3/lego"
 	"github.com/go-acme/lego/v3/registration"
 )
 
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeDNS01     = "dns-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// IsValidChallenge checks if the given string is a supported challenge type
+func IsValidChallenge(v string) bool {
+	return v == ChallengeHTTP01 || v == ChallengeDNS01 || v == ChallengeTLSALPN01
+}
+
+// KeyTypeDual issues both an ECDSA and an RSA certificate for every domain
+const KeyTypeDual = "dual"
+
+// IsValidKeyType checks if the given string is a supported key type
+func IsValidKeyType(v string) bool {
+	switch certcrypto.KeyType(v) {
+	case KeyTypeDual, certcrypto.EC256, certcrypto.EC384, certcrypto.RSA2048, certcrypto.RSA4096, certcrypto.RSA8192:
+		return true
+	}
+	return false
+}
+
+// keyTypeVariants returns the key types of the certificates to issue for the
+// given key type
+func keyTypeVariants(keyType string) []certcrypto.KeyType {
+	if keyType == KeyTypeDual {
+		return []certcrypto.KeyType{certcrypto.EC256, certcrypto.RSA2048}
+	}
+	return []certcrypto.KeyType{certcrypto.KeyType(keyType)}
+}
+
+// keyTypeSuffix returns the suffix HAProxy expects in the name of the files
+// of a multi-cert bundle
+func keyTypeSuffix(keyType certcrypto.KeyType) string {
+	if keyType == certcrypto.EC256 || keyType == certcrypto.EC384 {
+		return ".ecdsa"
+	}
+	return ".rsa"
+}
+
 // You'll need a user or account type that implements acme.User
 type acmeUser struct {
 	Email        string
@@ -28,18 +75,58 @@ func (u *acmeUser) GetPrivateKey() crypto.PrivateKey {
 	return u.key
 }
 
-func (p *DefaultCertificateProvider) getCertificateLetsEncrypt(domain string) (*Certificate, error) {
+// acmeHTTPClient creates the HTTP client used for talking to the ACME server,
+// trusting the custom CA roots if configured
+func (p *DefaultCertificateProvider) acmeHTTPClient() (*http.Client, error) {
+	var roots *x509.CertPool = nil
+
+	if len(p.config.CACertificates) > 0 {
+		roots = x509.NewCertPool()
+		for _, filename := range p.config.CACertificates {
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read CA certificate: %s", err.Error())
+			}
+			if !roots.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("Could not load CA certificates from %s", filename)
+			}
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   15 * time.Second,
+			ResponseHeaderTimeout: 15 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig: &tls.Config{
+				RootCAs: roots,
+			},
+		},
+	}, nil
+}
+
+func (p *DefaultCertificateProvider) getCertificateLetsEncrypt(domain string, challengeType string, keyType certcrypto.KeyType) (*Certificate, error) {
+	p.mutex.Lock()
 	myUser := acmeUser{
 		Email:        p.config.Email,
-		Registration: p.userRegistration,
+		Registration: p.registrations[p.config.CADirURL],
 		key:          p.userKey,
 	}
+	p.mutex.Unlock()
 	config := lego.NewConfig(&myUser)
+	config.CADirURL = p.config.CADirURL
+	config.Certificate.KeyType = keyType
 
-	// This CA URL is configured for a local dev instance of Boulder running in Docker in a VM.
-	// config.CADirURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
-	config.CADirURL = "https://acme-v02.api.letsencrypt.org/directory"
-	config.Certificate.KeyType = certcrypto.RSA2048
+	httpClient, err := p.acmeHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	config.HTTPClient = httpClient
 
 	// A client facilitates communication with the CA server.
 	client, err := lego.NewClient(config)
@@ -47,26 +134,64 @@ func (p *DefaultCertificateProvider) getCertificateLetsEncrypt(domain string) (*
 		return nil, fmt.Errorf("Could not create lego client: %s", err.Error())
 	}
 
-	// We specify an http port of 5002 and an tls port of 5001 on all interfaces
-	// because we aren't running as root and can't bind a listener to port 80 and 443
-	// (used later when we attempt to pass challenges). Keep in mind that you still
-	// need to proxy challenge traffic to port 5002 and 5001.
-	err = client.Challenge.SetHTTP01Provider(
-		http01.NewProviderServer("", fmt.Sprintf("%d", p.config.AuthPortHTTP)))
-	if err != nil {
-		return nil, fmt.Errorf("Could not start HTTP server: %s", err.Error())
+	switch challengeType {
+	case ChallengeDNS01:
+		provider, err := NewDNSChallengeProviderByName(p.config.DNSProvider)
+		if err != nil {
+			return nil, err
+		}
+
+		var opts []dns01.ChallengeOption
+		if len(p.config.DNSResolvers) > 0 {
+			opts = append(opts, dns01.AddRecursiveNameservers(dns01.ParseNameservers(p.config.DNSResolvers)))
+		}
+		err = client.Challenge.SetDNS01Provider(provider, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("Could not set DNS provider: %s", err.Error())
+		}
+
+	case ChallengeTLSALPN01:
+		// The HTTPS frontend forwards the `acme-tls/1` connections to the
+		// responder
+		err = client.Challenge.SetTLSALPN01Provider(p.config.Responder.TLSALPN01())
+		if err != nil {
+			return nil, fmt.Errorf("Could not set TLS-ALPN provider: %s", err.Error())
+		}
+
+	default:
+		// HAProxy forwards the challenge requests to the responder, since we
+		// are not running as root and can't bind a listener to port 80
+		err = client.Challenge.SetHTTP01Provider(p.config.Responder.HTTP01())
+		if err != nil {
+			return nil, fmt.Errorf("Could not set HTTP provider: %s", err.Error())
+		}
 	}
 
-	// New users will need to register
-	if p.userRegistration == nil {
-		reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	// New users will need to register, separately on every ACME server
+	if myUser.Registration == nil {
+		var reg *registration.Resource
+		if p.config.EABKeyID != "" {
+			reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+				TermsOfServiceAgreed: true,
+				Kid:                  p.config.EABKeyID,
+				HmacEncoded:          p.config.EABHMACKey,
+			})
+		} else {
+			reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		}
 		if err != nil {
 			return nil, fmt.Errorf("Could not register: %s", err.Error())
 		}
-		p.userRegistration = reg
+		myUser.Registration = reg
 
 		// Save the registration snapshot on disk
+		p.mutex.Lock()
+		p.registrations[p.config.CADirURL] = reg
+		if len(p.registrations) == 1 {
+			p.contact = p.config.Email
+		}
 		err = p.saveState()
+		p.mutex.Unlock()
 		if err != nil {
 			return nil, err
 		}
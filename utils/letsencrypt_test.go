@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-acme/lego/v3/lego"
+	"github.com/go-acme/lego/v3/registration"
+)
+
+func createTestACMEConfig(t *testing.T) (DefaultCertificateProviderConfig, func()) {
+	configDir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultCertificateProviderConfig{
+		ConfigDir:    configDir,
+		Email:        "test@example.com",
+		Organization: "Test",
+	}
+	return config, func() { os.RemoveAll(configDir) }
+}
+
+func TestRegistrationMigration(t *testing.T) {
+	config, cleanup := createTestACMEConfig(t)
+	defer cleanup()
+	if _, err := CreateDefaultCertificateProvider(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// A state saved by an earlier version, with a single registration
+	stateFile := filepath.Join(config.ConfigDir, "state.json")
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state map[string]interface{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	delete(state, "registrations")
+	state["registration"] = map[string]interface{}{"uri": "https://acme.example/acct/1"}
+	data, _ = json.Marshal(state)
+	ioutil.WriteFile(stateFile, data, 0600)
+
+	// The registration was always made on the Let's Encrypt production server
+	p, err := CreateDefaultCertificateProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := p.registrations[lego.LEDirectoryProduction]
+	if reg == nil || reg.URI != "https://acme.example/acct/1" || len(p.registrations) != 1 {
+		t.Fatalf("Expected the legacy registration to be migrated, got %+v", p.registrations)
+	}
+
+	// The registrations of other CAs are kept, and the legacy field is still
+	// written for downgrades
+	p.registrations["https://ca.example/directory"] = &registration.Resource{URI: "https://ca.example/acct/2"}
+	p.registrations[lego.LEDirectoryProduction] = &registration.Resource{URI: "https://acme.example/acct/3"}
+	if err := p.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	var saved persistenceFile
+	data, _ = ioutil.ReadFile(stateFile)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Registration == nil || saved.Registration.URI != "https://acme.example/acct/3" {
+		t.Errorf("Expected the legacy field to be kept for downgrades, got %+v", saved.Registration)
+	}
+
+	// A stale legacy field does not override the migrated registration
+	saved.Registration = &registration.Resource{URI: "https://acme.example/acct/1"}
+	data, _ = json.Marshal(saved)
+	ioutil.WriteFile(stateFile, data, 0600)
+	p, err = CreateDefaultCertificateProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.registrations) != 2 || p.registrations[lego.LEDirectoryProduction].URI != "https://acme.example/acct/3" ||
+		p.registrations["https://ca.example/directory"].URI != "https://ca.example/acct/2" {
+		t.Errorf("Unexpected registrations %+v", p.registrations)
+	}
+}
+
+func TestExternalAccountBinding(t *testing.T) {
+	config, cleanup := createTestACMEConfig(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		kid, hmac string
+		valid     bool
+	}{
+		{"", "", true},
+		{"kid-1", "c2VjcmV0", true},
+		{"kid-1", "", false},
+		{"", "c2VjcmV0", false},
+	} {
+		config.EABKeyID = test.kid
+		config.EABHMACKey = test.hmac
+		_, err := CreateDefaultCertificateProvider(config)
+		if test.valid && err != nil {
+			t.Errorf("Expected EAB '%s'/'%s' to be accepted: %s", test.kid, test.hmac, err.Error())
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Expected EAB '%s'/'%s' to be rejected", test.kid, test.hmac)
+		}
+	}
+}
+
+func TestCustomCARoots(t *testing.T) {
+	config, cleanup := createTestACMEConfig(t)
+	defer cleanup()
+	p, err := CreateDefaultCertificateProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// The test server is not trusted by default
+	client, err := p.acmeHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(server.URL); err == nil {
+		t.Fatalf("Expected the test server not to be trusted")
+	}
+
+	rootFile := filepath.Join(config.ConfigDir, "root.pem")
+	ioutil.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	p.config.CACertificates = []string{rootFile}
+	client, err = p.acmeHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected the custom root to be trusted: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	invalidFile := filepath.Join(config.ConfigDir, "invalid.pem")
+	ioutil.WriteFile(invalidFile, []byte("not a certificate"), 0600)
+	for _, filename := range []string{invalidFile, filepath.Join(config.ConfigDir, "missing.pem")} {
+		p.config.CACertificates = []string{rootFile, filename}
+		if _, err := p.acmeHTTPClient(); err == nil {
+			t.Errorf("Expected %s to be rejected", filepath.Base(filename))
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const leaderLock = "leader"
+
+type LockManagerConfig struct {
+	// The storage shared by all the nodes, and the name of this node
+	Storage Storage
+	NodeID  string
+
+	// How long a lock is held by a node that stopped refreshing it
+	TTL time.Duration
+}
+
+// LockManager implements leases over the shared storage, that are used for
+// electing the leader of the nodes and for making sure only one node issues
+// the certificate of a domain
+type LockManager struct {
+	config LockManagerConfig
+	mutex  sync.Mutex
+	held   map[string]bool
+	leader bool
+}
+
+type lockRecord struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+func CreateLockManager(config LockManagerConfig) *LockManager {
+	if config.NodeID == "" {
+		config.NodeID, _ = os.Hostname()
+	}
+	if config.TTL == 0 {
+		config.TTL = time.Minute
+	}
+	return &LockManager{
+		config: config,
+		held:   make(map[string]bool),
+	}
+}
+
+func lockKey(name string) string {
+	return "locks/" + strings.Replace(name, "*", "_", -1)
+}
+
+// TryLock acquires or extends the lock with the given name, returning false
+// if it is held by another node
+func (m *LockManager) TryLock(name string) (bool, error) {
+	key := lockKey(name)
+	data, version, err := m.config.Storage.LoadVersion(key)
+	if err != nil && err != ErrKeyNotFound {
+		return false, fmt.Errorf("Could not read lock %s: %s", name, err.Error())
+	}
+	if err == nil {
+		var rec lockRecord
+		if json.Unmarshal(data, &rec) == nil && rec.Owner != m.config.NodeID && time.Now().Before(rec.Expires) {
+			return false, nil
+		}
+	}
+
+	data, err = json.Marshal(lockRecord{
+		Owner:   m.config.NodeID,
+		Expires: time.Now().Add(m.config.TTL),
+	})
+	if err != nil {
+		return false, fmt.Errorf("Could not marshal lock: %s", err.Error())
+	}
+	ok, err := m.config.Storage.CompareAndSwap(key, data, version)
+	if err != nil {
+		return false, fmt.Errorf("Could not acquire lock %s: %s", name, err.Error())
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if ok {
+		m.held[name] = true
+	} else {
+		delete(m.held, name)
+	}
+	return ok, nil
+}
+
+// Unlock releases the lock with the given name, if held by this node
+func (m *LockManager) Unlock(name string) error {
+	m.mutex.Lock()
+	delete(m.held, name)
+	m.mutex.Unlock()
+
+	// Retry if the lock is being extended at the same time
+	key := lockKey(name)
+	for i := 0; i < 3; i++ {
+		data, version, err := m.config.Storage.LoadVersion(key)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read lock %s: %s", name, err.Error())
+		}
+		var rec lockRecord
+		if json.Unmarshal(data, &rec) == nil && (rec.Owner != m.config.NodeID || !time.Now().Before(rec.Expires)) {
+			return nil
+		}
+
+		// An expired lock is the same as a missing one
+		data, _ = json.Marshal(lockRecord{Owner: m.config.NodeID})
+		ok, err := m.config.Storage.CompareAndSwap(key, data, version)
+		if err != nil {
+			return fmt.Errorf("Could not release lock %s: %s", name, err.Error())
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("Could not release lock %s: the lock keeps changing", name)
+}
+
+// extend extends the lock with the given name only if this node still holds
+// it, unlike TryLock it never takes a released or expired lock
+func (m *LockManager) extend(name string) (bool, error) {
+	key := lockKey(name)
+	data, version, err := m.config.Storage.LoadVersion(key)
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Could not read lock %s: %s", name, err.Error())
+	}
+	var rec lockRecord
+	if json.Unmarshal(data, &rec) != nil || rec.Owner != m.config.NodeID || !time.Now().Before(rec.Expires) {
+		return false, nil
+	}
+
+	data, err = json.Marshal(lockRecord{
+		Owner:   m.config.NodeID,
+		Expires: time.Now().Add(m.config.TTL),
+	})
+	if err != nil {
+		return false, fmt.Errorf("Could not marshal lock: %s", err.Error())
+	}
+	ok, err := m.config.Storage.CompareAndSwap(key, data, version)
+	if err != nil {
+		return false, fmt.Errorf("Could not extend lock %s: %s", name, err.Error())
+	}
+	return ok, nil
+}
+
+// Leader returns the node that currently holds the leadership, or an empty
+// string if no node is running
+func (m *LockManager) Leader() (string, error) {
+	data, err := m.config.Storage.Load(lockKey(leaderLock))
+	if err == ErrKeyNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Could not read lock %s: %s", leaderLock, err.Error())
+	}
+	var rec lockRecord
+	if json.Unmarshal(data, &rec) != nil || !time.Now().Before(rec.Expires) {
+		return "", nil
+	}
+	return rec.Owner, nil
+}
+
+// IsLeader checks if this node is currently the leader
+func (m *LockManager) IsLeader() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.leader
+}
+
+// refresh extends the locks held by this node, and tries to become the leader
+func (m *LockManager) refresh() {
+	var names []string
+
+	m.mutex.Lock()
+	for name := range m.held {
+		if name != leaderLock {
+			names = append(names, name)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, name := range names {
+		// The lock might have been released meanwhile
+		m.mutex.Lock()
+		held := m.held[name]
+		m.mutex.Unlock()
+		if !held {
+			continue
+		}
+
+		ok, err := m.extend(name)
+		if err != nil {
+			log.Warnf("Could not extend lock %s: %s", name, err.Error())
+			continue
+		}
+
+		m.mutex.Lock()
+		if !ok && m.held[name] {
+			log.Warnf("Lost lock %s", name)
+			delete(m.held, name)
+		}
+		m.mutex.Unlock()
+	}
+
+	leader, err := m.TryLock(leaderLock)
+	if err != nil {
+		log.Warnf("Could not run the leader election: %s", err.Error())
+	}
+
+	m.mutex.Lock()
+	if leader != m.leader {
+		if leader {
+			log.Infof("Node %s is now the leader", m.config.NodeID)
+		} else {
+			log.Infof("Node %s is no longer the leader", m.config.NodeID)
+		}
+	}
+	m.leader = leader
+	m.mutex.Unlock()
+}
+
+// Start starts the background thread that keeps the locks of this node from
+// expiring, and runs the leader election
+func (m *LockManager) Start() {
+	m.refresh()
+	go func() {
+		for {
+			time.Sleep(m.config.TTL / 3)
+			m.refresh()
+		}
+	}()
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockManager(t *testing.T) {
+	server := httptest.NewServer(newTestConsul())
+	defer server.Close()
+
+	storage := CreateConsulStorage(ConsulStorageConfig{Address: server.URL, Prefix: "docker-lb"})
+	a := CreateLockManager(LockManagerConfig{Storage: storage, NodeID: "a", TTL: 200 * time.Millisecond})
+	b := CreateLockManager(LockManagerConfig{Storage: storage, NodeID: "b", TTL: 200 * time.Millisecond})
+
+	if ok, err := a.TryLock("issue/foo.com"); !ok || err != nil {
+		t.Fatalf("Expected the first node to lock the domain (%v)", err)
+	}
+	if ok, _ := a.TryLock("issue/foo.com"); !ok {
+		t.Fatalf("Expected the first node to extend its lock")
+	}
+	if ok, _ := b.TryLock("issue/foo.com"); ok {
+		t.Fatalf("Expected the second node to not lock the domain")
+	}
+	a.Unlock("issue/foo.com")
+	if ok, _ := b.TryLock("issue/foo.com"); !ok {
+		t.Fatalf("Expected the second node to lock the released domain")
+	}
+
+	// Only one node is the leader, until it stops refreshing its lease
+	a.refresh()
+	b.refresh()
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("Expected the first node to be the only leader")
+	}
+	if leader, err := b.Leader(); leader != "a" || err != nil {
+		t.Fatalf("Expected the first node to be reported as the leader, got '%s' (%v)", leader, err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if leader, _ := b.Leader(); leader != "" {
+		t.Fatalf("Expected no leader once the lease expired, got '%s'", leader)
+	}
+	b.refresh()
+	if !b.IsLeader() {
+		t.Fatalf("Expected the second node to take over the expired leadership")
+	}
+	a.refresh()
+	if a.IsLeader() {
+		t.Fatalf("Expected the first node to no longer be the leader")
+	}
+}
+
+func TestUnlockDuringRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := CreateFileStorage(FileStorageConfig{Dir: dir})
+	a := CreateLockManager(LockManagerConfig{Storage: storage, NodeID: "a", TTL: time.Minute})
+	b := CreateLockManager(LockManagerConfig{Storage: storage, NodeID: "b", TTL: time.Minute})
+
+	// A released lock is never taken again by the refresh
+	for i := 0; i < 50; i++ {
+		if ok, err := a.TryLock("issue/foo.com"); !ok || err != nil {
+			t.Fatalf("Expected the first node to lock the domain (%v)", err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			a.Unlock("issue/foo.com")
+		}()
+		go func() {
+			defer wg.Done()
+			a.refresh()
+		}()
+		wg.Wait()
+		a.refresh()
+
+		if ok, _ := b.TryLock("issue/foo.com"); !ok {
+			t.Fatalf("Expected the second node to lock the released domain (iteration %d)", i)
+		}
+		b.Unlock("issue/foo.com")
+	}
+}
@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricsRegistry is a minimal registry of counters and gauges that can be
+// exposed in the Prometheus text exposition format
+type MetricsRegistry struct {
+	mutex      sync.Mutex
+	families   map[string]*metricFamily
+	collectors []MetricsCollector
+}
+
+// MetricsCollector is called on every scrape to emit metrics that are computed
+// on-demand (eg. from the HAProxy stats socket)
+type MetricsCollector func(w *MetricsWriter)
+
+type metricFamily struct {
+	name    string
+	kind    string
+	help    string
+	samples map[string]*metricSample
+}
+
+type metricSample struct {
+	labels map[string]string
+	value  float64
+}
+
+// DefaultMetrics is the registry used by all docker-lb components
+var DefaultMetrics = CreateMetricsRegistry()
+
+func CreateMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		families: make(map[string]*metricFamily),
+	}
+}
+
+func (r *MetricsRegistry) family(name, kind, help string) *metricFamily {
+	f, ok := r.families[name]
+	if !ok {
+		f = &metricFamily{name, kind, help, make(map[string]*metricSample)}
+		r.families[name] = f
+	}
+	return f
+}
+
+func (f *metricFamily) sample(labels map[string]string) *metricSample {
+	key := formatLabels(labels)
+	s, ok := f.samples[key]
+	if !ok {
+		s = &metricSample{labels, 0}
+		f.samples[key] = s
+	}
+	return s
+}
+
+// AddCounter increments the counter with the given name and labels
+func (r *MetricsRegistry) AddCounter(name, help string, labels map[string]string, value float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.family(name, "counter", help).sample(labels).value += value
+}
+
+// SetGauge sets the value of the gauge with the given name and labels
+func (r *MetricsRegistry) SetGauge(name, help string, labels map[string]string, value float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.family(name, "gauge", help).sample(labels).value = value
+}
+
+// DeleteGauge removes the gauge with the given name and labels
+func (r *MetricsRegistry) DeleteGauge(name string, labels map[string]string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if f, ok := r.families[name]; ok {
+		delete(f.samples, formatLabels(labels))
+	}
+}
+
+// RegisterCollector registers a function to be called on every scrape
+func (r *MetricsRegistry) RegisterCollector(c MetricsCollector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Render writes all the metrics in the Prometheus text format
+func (r *MetricsRegistry) Render(out io.Writer) error {
+	w := &MetricsWriter{CreateMetricsRegistry()}
+
+	r.mutex.Lock()
+	for name, f := range r.families {
+		wf := w.registry.family(name, f.kind, f.help)
+		for key, s := range f.samples {
+			wf.samples[key] = &metricSample{s.labels, s.value}
+		}
+	}
+	collectors := r.collectors
+	r.mutex.Unlock()
+
+	for _, c := range collectors {
+		c(w)
+	}
+
+	return w.registry.writeFamilies(out)
+}
+
+func (r *MetricsRegistry) writeFamilies(out io.Writer) error {
+	var names []string
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := r.families[name]
+		if len(f.samples) == 0 {
+			continue
+		}
+
+		var keys []string
+		for key := range f.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if _, err := fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			value := strconv.FormatFloat(f.samples[key].value, 'g', -1, 64)
+			if _, err := fmt.Fprintf(out, "%s%s %s\n", name, key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Render(w)
+}
+
+// MetricsWriter is given to the collectors in order to emit their metrics
+type MetricsWriter struct {
+	registry *MetricsRegistry
+}
+
+func (w *MetricsWriter) Counter(name, help string, labels map[string]string, value float64) {
+	w.registry.family(name, "counter", help).sample(labels).value = value
+}
+
+func (w *MetricsWriter) Gauge(name, help string, labels map[string]string, value float64) {
+	w.registry.family(name, "gauge", help).sample(labels).value = value
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(labels[name])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	r := CreateMetricsRegistry()
+	r.AddCounter("test_requests_total", "Total requests.", map[string]string{"code": "200"}, 1)
+	r.AddCounter("test_requests_total", "Total requests.", map[string]string{"code": "200"}, 2)
+	r.AddCounter("test_requests_total", "Total requests.", map[string]string{"code": "500"}, 1)
+	r.SetGauge("test_up", "Is the test up.", nil, 1)
+	r.SetGauge("test_temperature", "The temperature.", map[string]string{"room": "a"}, 21.5)
+	r.DeleteGauge("test_temperature", map[string]string{"room": "a"})
+
+	// Label values are escaped, and the label names are sorted
+	r.RegisterCollector(func(w *MetricsWriter) {
+		w.Gauge("test_info", "Some info.", map[string]string{"name": "a \"quoted\"\nC:\\path", "kind": "x"}, 3)
+	})
+
+	var buf bytes.Buffer
+	if err := r.Render(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.Join([]string{
+		"# HELP test_info Some info.",
+		"# TYPE test_info gauge",
+		`test_info{kind="x",name="a \"quoted\"\nC:\\path"} 3`,
+		"# HELP test_requests_total Total requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{code="200"} 3`,
+		`test_requests_total{code="500"} 1`,
+		"# HELP test_up Is the test up.",
+		"# TYPE test_up gauge",
+		"test_up 1",
+		"",
+	}, "\n")
+	if buf.String() != expect {
+		t.Errorf("Unexpected metrics:\n%s", buf.String())
+	}
+
+	// The collected metrics do not stick in the registry
+	buf.Reset()
+	r.collectors = nil
+	r.Render(&buf)
+	if strings.Contains(buf.String(), "test_info") {
+		t.Errorf("Expected the collected metrics not to be kept")
+	}
+}
+
+func TestParseStatCSV(t *testing.T) {
+	rows, err := parseStatCSV("# pxname,svname,scur,type,\n" +
+		"http-in,FRONTEND,3,0,\n" +
+		"be_foo,srv1,1,2,extra\n" +
+		"be_foo,BACKEND,,1,\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 rows, got %d", len(rows))
+	}
+	if rows[0]["pxname"] != "http-in" || rows[0]["scur"] != "3" || rows[0]["type"] != "0" {
+		t.Errorf("Unexpected first row %+v", rows[0])
+	}
+	if _, ok := rows[1][""]; ok || rows[1]["svname"] != "srv1" {
+		t.Errorf("Expected the values without a header to be dropped, got %+v", rows[1])
+	}
+	if v, ok := rows[2]["scur"]; !ok || v != "" {
+		t.Errorf("Expected the empty values to be kept, got %+v", rows[2])
+	}
+
+	if rows, err := parseStatCSV("\n"); err != nil || rows != nil {
+		t.Errorf("Expected no rows for an empty response, got %+v (%v)", rows, err)
+	}
+	if _, err := parseStatCSV("# pxname,svname\n\"unterminated,foo\n"); err == nil {
+		t.Errorf("Expected malformed statistics to be rejected")
+	}
+}
+
+func TestCertificateMetrics(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	notBefore := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	notAfter := notBefore.Add(30 * 24 * time.Hour)
+	writeTestCertificate(t, p.certFilePath("foo.com"), notBefore, notAfter)
+	if err := p.reconcileCertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := CreateMetricsRegistry()
+	p.RegisterMetrics(r, IssuerACME)
+
+	// Scraping while the certificates change is safe
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			domain := fmt.Sprintf("bar%d.com", i)
+			writeTestCertificate(t, p.certFilePath(domain), notBefore, notAfter)
+			p.mutex.Lock()
+			p.reconcileCertificates()
+			p.mutex.Unlock()
+		}
+	}()
+	var buf bytes.Buffer
+	for i := 0; i < 20; i++ {
+		buf.Reset()
+		r.Render(&buf)
+	}
+	<-done
+
+	buf.Reset()
+	r.Render(&buf)
+	for _, domain := range []string{"foo.com", "bar0.com", "bar19.com"} {
+		expect := `dockerlb_certificate_expiry_timestamp_seconds{domain="` + domain + `",issuer="acme"} ` +
+			strconv.FormatFloat(float64(notAfter.Unix()), 'g', -1, 64)
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("Expected the expiry of %s, got:\n%s", domain, buf.String())
+		}
+	}
+}
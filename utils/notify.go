@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The events notified about the certificates
+const (
+	EventIssued        = "issued"
+	EventRenewed       = "renewed"
+	EventIssueFailed   = "issue_failed"
+	EventRenewalFailed = "renewal_failed"
+	EventExpiring      = "expiring"
+)
+
+// Notification describes an event of a certificate
+type Notification struct {
+	Event   string    `json:"event"`
+	Domain  string    `json:"domain"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+func (n Notification) String() string {
+	return fmt.Sprintf("Certificate for %s: %s", n.Domain, n.Message)
+}
+
+// NotificationSink delivers the notifications to a destination
+type NotificationSink interface {
+	Send(n Notification) error
+}
+
+// WebhookSink posts the notifications as JSON to the given URL
+type WebhookSink struct {
+	URL string
+}
+
+func (s *WebhookSink) Send(n Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("Could not marshal notification: %s", err.Error())
+	}
+	return postNotification(s.URL, data)
+}
+
+// SlackSink posts the notifications to a Slack-compatible incoming webhook
+type SlackSink struct {
+	URL string
+}
+
+func (s *SlackSink) Send(n Notification) error {
+	data, err := json.Marshal(map[string]string{"text": "[docker-lb] " + n.String()})
+	if err != nil {
+		return fmt.Errorf("Could not marshal notification: %s", err.Error())
+	}
+	return postNotification(s.URL, data)
+}
+
+func postNotification(url string, data []byte) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// SMTPSink sends the notifications by e-mail
+type SMTPSink struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (s *SMTPSink) Send(n Notification) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, strings.Split(s.Addr, ":")[0])
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, s.To, []byte(s.message(n)))
+}
+
+// headerLineBreaks removes the line breaks that would end a header field of
+// the e-mail, and start another one
+var headerLineBreaks = strings.NewReplacer("\r", "", "\n", "")
+
+// message composes the e-mail of the given notification. The subject is
+// encoded, since the domain might contain non-ASCII characters.
+func (s *SMTPSink) message(n Notification) string {
+	subject := fmt.Sprintf("[docker-lb] Certificate %s for %s", strings.Replace(n.Event, "_", " ", -1), n.Domain)
+	return strings.Join([]string{
+		"From: " + s.From,
+		"To: " + strings.Join(s.To, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", headerLineBreaks.Replace(subject)),
+		"Date: " + n.Time.Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		n.String(),
+		"",
+	}, "\r\n")
+}
+
+type NotifierConfig struct {
+	Sinks []NotificationSink
+
+	// The same event of a domain is only notified once within the window, and
+	// at most the given number of notifications are sent per hour
+	DedupWindow time.Duration
+	RateLimit   int
+}
+
+// Notifier sends the notifications to all the sinks, dropping the duplicate
+// ones and the ones over the rate limit
+type Notifier struct {
+	config NotifierConfig
+	mutex  sync.Mutex
+	sent   map[string]time.Time
+	recent []time.Time
+}
+
+func CreateNotifier(config NotifierConfig) *Notifier {
+	if config.DedupWindow == 0 {
+		config.DedupWindow = 24 * time.Hour
+	}
+	if config.RateLimit == 0 {
+		config.RateLimit = 20
+	}
+	return &Notifier{
+		config: config,
+		sent:   make(map[string]time.Time),
+	}
+}
+
+// allow checks if the notification should be sent, and records it if so
+func (n *Notifier) allow(event string, domain string, now time.Time) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	key := event + "/" + domain
+	if last, ok := n.sent[key]; ok && now.Sub(last) < n.config.DedupWindow {
+		return false
+	}
+
+	var recent []time.Time
+	for _, t := range n.recent {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	n.recent = recent
+	if len(n.recent) >= n.config.RateLimit {
+		log.Warnf("Dropping notification %s of %s, over the rate limit", event, domain)
+		DefaultMetrics.AddCounter("dockerlb_notifications_dropped_total",
+			"Total number of notifications dropped by the rate limit.", nil, 1)
+		return false
+	}
+
+	n.sent[key] = now
+	n.recent = append(n.recent, now)
+	return true
+}
+
+// Notify sends the given event of the domain to all the sinks in the
+// background. It does nothing on a nil notifier.
+func (n *Notifier) Notify(event string, domain string, message string) {
+	if n == nil || len(n.config.Sinks) == 0 {
+		return
+	}
+
+	notification := Notification{
+		Event:   event,
+		Domain:  domain,
+		Message: message,
+		Time:    time.Now(),
+	}
+	if !n.allow(event, domain, notification.Time) {
+		return
+	}
+
+	for _, sink := range n.config.Sinks {
+		go func(sink NotificationSink) {
+			err := sink.Send(notification)
+			if err != nil {
+				log.Errorf("Could not send notification: %s", err.Error())
+				DefaultMetrics.AddCounter("dockerlb_notification_failures_total",
+					"Total number of notifications that could not be sent.", nil, 1)
+			}
+		}(sink)
+	}
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSink records the notifications it receives
+type testSink chan Notification
+
+func (s testSink) Send(n Notification) error {
+	s <- n
+	return nil
+}
+
+// serveTestSMTP is a minimal stand-in of an SMTP server, that sends the body
+// of the first message it receives to the channel
+func serveTestSMTP(t *testing.T, messages chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost ESMTP\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				conn.Write([]byte("250 OK\r\n"))
+			case "DATA":
+				conn.Write([]byte("354 Go ahead\r\n"))
+				var body []string
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					body = append(body, line)
+				}
+				messages <- strings.Join(body, "")
+				conn.Write([]byte("250 OK\r\n"))
+			case "QUIT":
+				conn.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNotifier(t *testing.T) {
+	requests := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests <- body
+	}))
+	defer server.Close()
+
+	messages := make(chan string, 1)
+	n := CreateNotifier(NotifierConfig{
+		Sinks: []NotificationSink{
+			&WebhookSink{URL: server.URL + "/webhook"},
+			&SlackSink{URL: server.URL + "/slack"},
+			&SMTPSink{Addr: serveTestSMTP(t, messages), From: "lb@example.com", To: []string{"ops@example.com"}},
+		},
+		RateLimit: 2,
+	})
+	n.Notify(EventIssueFailed, "foo.com", "rate limited")
+
+	var webhook, slack map[string]interface{}
+	for i := 0; i < 2; i++ {
+		select {
+		case body := <-requests:
+			if _, ok := body["text"]; ok {
+				slack = body
+			} else {
+				webhook = body
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the webhooks to be called")
+		}
+	}
+	if webhook["event"] != EventIssueFailed || webhook["domain"] != "foo.com" {
+		t.Errorf("Unexpected webhook payload %v", webhook)
+	}
+	if slack["text"] != "[docker-lb] Certificate for foo.com: rate limited" {
+		t.Errorf("Unexpected Slack payload %v", slack)
+	}
+	select {
+	case msg := <-messages:
+		if !strings.Contains(msg, "Subject: [docker-lb] Certificate issue failed for foo.com") {
+			t.Errorf("Unexpected e-mail %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an e-mail to be sent")
+	}
+
+	// The same event is only sent once, and the rate limit applies to the rest
+	now := time.Now()
+	if n.allow(EventIssueFailed, "foo.com", now) {
+		t.Errorf("Expected the duplicate notification to be dropped")
+	}
+	if !n.allow(EventIssueFailed, "bar.com", now) {
+		t.Errorf("Expected the notification of another domain to be sent")
+	}
+	if n.allow(EventExpiring, "foo.com", now) {
+		t.Errorf("Expected the notification over the rate limit to be dropped")
+	}
+	if !n.allow(EventExpiring, "foo.com", now.Add(time.Hour)) {
+		t.Errorf("Expected the rate limit to be reset after an hour")
+	}
+}
+
+func TestSMTPSubject(t *testing.T) {
+	sink := &SMTPSink{From: "lb@example.com", To: []string{"ops@example.com"}}
+
+	// The line breaks cannot add header fields
+	msg := sink.message(Notification{Event: EventIssued, Domain: "foo.com\r\nBcc: evil@example.com", Time: time.Now()})
+	header := msg[:strings.Index(msg, "\r\n\r\n")]
+	for _, line := range strings.Split(header, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Fatalf("Expected the line breaks of the subject to be removed, got %q", header)
+		}
+	}
+	if !strings.Contains(header, "Subject: [docker-lb] Certificate issued for foo.comBcc: evil@example.com") {
+		t.Errorf("Unexpected header %q", header)
+	}
+
+	// Non-ASCII domains are encoded
+	msg = sink.message(Notification{Event: EventIssued, Domain: "b\u00fccher.example", Time: time.Now()})
+	if !strings.Contains(msg, "Subject: =?utf-8?q?[docker-lb]_Certificate_issued_for_b=C3=BCcher.example?=\r\n") {
+		t.Errorf("Expected the subject to be encoded, got %q", msg)
+	}
+}
+
+func TestExpiryNotification(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	sink := make(testSink, 10)
+	p.config.Notifier = CreateNotifier(NotifierConfig{Sinks: []NotificationSink{sink}})
+
+	notBefore := time.Now().Add(-80 * 24 * time.Hour).UTC().Truncate(time.Second)
+	for _, domain := range []string{"foo.com", "bar.com", "baz.com"} {
+		notAfter := notBefore.Add(90 * 24 * time.Hour)
+		if domain == "baz.com" {
+			notAfter = notBefore.Add(180 * 24 * time.Hour)
+		}
+		cert := writeTestCertificate(t, p.certFilePath(domain), notBefore, notAfter)
+		p.certificates[domain] = p.newIssuedCertificate(cert)
+	}
+	p.certificates["bar.com"].OrphanedSince = time.Now()
+
+	p.checkExpiry()
+	select {
+	case n := <-sink:
+		if n.Event != EventExpiring || n.Domain != "foo.com" {
+			t.Errorf("Expected foo.com to be expiring, got %v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a notification")
+	}
+
+	// Checking again does not repeat the notification
+	p.checkExpiry()
+	select {
+	case n := <-sink:
+		t.Errorf("Unexpected notification %v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,365 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+type OCSPStaplerConfig struct {
+	// The glob patterns of the PEM bundles to staple OCSP responses for
+	Patterns []string
+
+	// How often to check if the responses need to be refreshed
+	CheckInterval time.Duration
+}
+
+// OCSPStapler keeps an up to date OCSP response next to every certificate,
+// where HAProxy expects to find it (<bundle>.ocsp)
+type OCSPStapler struct {
+	config        OCSPStaplerConfig
+	client        *http.Client
+	mutex         sync.Mutex
+	status        map[string]*ocspStatus
+	updateHandler func(certFile string, response []byte)
+	trigger       chan struct{}
+}
+
+type ocspStatus struct {
+	Domain      string
+	NextUpdate  time.Time
+	Failures    int
+	NextAttempt time.Time
+
+	// The modification time of the certificate, so the response is fetched
+	// again as soon as the certificate is renewed
+	ModTime time.Time
+}
+
+func CreateOCSPStapler(config OCSPStaplerConfig) *OCSPStapler {
+	if config.CheckInterval == 0 {
+		config.CheckInterval = 10 * time.Minute
+	}
+
+	return &OCSPStapler{
+		config:  config,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		status:  make(map[string]*ocspStatus),
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// SetUpdateHandler registers the function to call every time the OCSP
+// response of a certificate is refreshed
+func (s *OCSPStapler) SetUpdateHandler(handler func(certFile string, response []byte)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.updateHandler = handler
+}
+
+// Start starts the thread that refreshes the OCSP responses
+func (s *OCSPStapler) Start() {
+	go func() {
+		for {
+			s.refresh()
+			select {
+			case <-time.After(s.config.CheckInterval):
+			case <-s.trigger:
+			}
+		}
+	}()
+}
+
+// Refresh makes the stapler check the certificates right away, eg. after some
+// of them were renewed
+func (s *OCSPStapler) Refresh() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// readCertificateChain parses all the certificates in the given PEM file
+func readCertificateChain(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse certificate in %s: %s", filename, err.Error())
+			}
+			chain = append(chain, cert)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("No certificate found in %s", filename)
+	}
+
+	return chain, nil
+}
+
+// ocspRefreshDate returns when the given response should be refreshed, half
+// way through its validity
+func ocspRefreshDate(resp *ocsp.Response) time.Time {
+	if resp.NextUpdate.IsZero() {
+		return resp.ThisUpdate.Add(12 * time.Hour)
+	}
+	return resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+}
+
+func (s *OCSPStapler) listCertificates() []string {
+	var files []string
+	for _, pattern := range s.config.Patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, filename := range matches {
+			if !strings.HasPrefix(filepath.Base(filename), "selfsigned-") {
+				files = append(files, filename)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// refresh fetches the OCSP responses that are missing or about to expire
+func (s *OCSPStapler) refresh() {
+	files := s.listCertificates()
+
+	seen := make(map[string]bool)
+	for _, filename := range files {
+		seen[filename] = true
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+
+		s.mutex.Lock()
+		st, ok := s.status[filename]
+		if !ok {
+			st = &ocspStatus{}
+			s.status[filename] = st
+		}
+		if !info.ModTime().Equal(st.ModTime) {
+			st.ModTime = info.ModTime()
+			st.Failures = 0
+			st.NextAttempt = time.Time{}
+		}
+		skip := time.Now().Before(st.NextAttempt)
+		s.mutex.Unlock()
+		if skip {
+			continue
+		}
+
+		err = s.refreshCertificate(filename, st)
+
+		s.mutex.Lock()
+		if err != nil {
+			st.Failures++
+			st.NextAttempt = time.Now().Add(retryBackoff(st.Failures))
+			log.Errorf("Could not refresh OCSP response of %s (Retrying at %s): %s",
+				filename, st.NextAttempt.Format(time.RFC3339), err.Error())
+			DefaultMetrics.AddCounter("dockerlb_ocsp_fetch_failures_total",
+				"Total number of failed OCSP response fetches.",
+				map[string]string{"domain": st.Domain}, 1)
+		} else {
+			st.Failures = 0
+		}
+		s.mutex.Unlock()
+	}
+
+	// Forget the certificates that are gone
+	s.mutex.Lock()
+	for filename := range s.status {
+		if !seen[filename] {
+			delete(s.status, filename)
+		}
+	}
+	s.mutex.Unlock()
+}
+
+// refreshCertificate fetches the OCSP response of the given certificate, if
+// the one on disk is missing, stale or about to expire
+func (s *OCSPStapler) refreshCertificate(filename string, st *ocspStatus) error {
+	chain, err := readCertificateChain(filename)
+	if err != nil {
+		return err
+	}
+	leaf := chain[0]
+	if len(leaf.OCSPServer) == 0 {
+		// Nothing to do for certificates without a responder
+		s.mutex.Lock()
+		st.NextAttempt = time.Now().Add(24 * time.Hour)
+		s.mutex.Unlock()
+		return nil
+	}
+	s.mutex.Lock()
+	st.Domain = leaf.Subject.CommonName
+	if len(leaf.DNSNames) > 0 {
+		st.Domain = leaf.DNSNames[0]
+	}
+	s.mutex.Unlock()
+
+	issuer, err := s.findIssuer(chain)
+	if err != nil {
+		return err
+	}
+
+	// Check if the existing response is still good
+	ocspFile := filename + ".ocsp"
+	if data, err := ioutil.ReadFile(ocspFile); err == nil {
+		resp, err := ocsp.ParseResponseForCert(data, leaf, issuer)
+		if err == nil && time.Now().Before(ocspRefreshDate(resp)) {
+			s.mutex.Lock()
+			st.NextUpdate = resp.NextUpdate
+			st.NextAttempt = ocspRefreshDate(resp)
+			s.mutex.Unlock()
+			return nil
+		}
+		if err != nil {
+			// HAProxy refuses to load responses of other certificates
+			log.Warnf("Removing OCSP response of %s that does not match the certificate", filename)
+			os.Remove(ocspFile)
+		}
+	}
+
+	data, resp, err := s.fetchResponse(leaf, issuer)
+	if err != nil {
+		return err
+	}
+	if resp.Status == ocsp.Revoked {
+		log.Errorf("Certificate %s has been revoked at %s", filename, resp.RevokedAt.Format(time.RFC3339))
+	}
+
+	// Write atomically, since HAProxy might be reading the previous one
+	err = ioutil.WriteFile(ocspFile+".tmp", data, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not write %s: %s", ocspFile, err.Error())
+	}
+	err = os.Rename(ocspFile+".tmp", ocspFile)
+	if err != nil {
+		return fmt.Errorf("Could not write %s: %s", ocspFile, err.Error())
+	}
+
+	s.mutex.Lock()
+	st.NextUpdate = resp.NextUpdate
+	st.NextAttempt = ocspRefreshDate(resp)
+	handler := s.updateHandler
+	s.mutex.Unlock()
+
+	log.Infof("Updated OCSP response of %s (Next update: %s)", filename, resp.NextUpdate.Format(time.RFC3339))
+	if handler != nil {
+		handler(filename, data)
+	}
+
+	return nil
+}
+
+// findIssuer returns the issuer of the leaf certificate, either from the
+// bundle or from the URL in the certificate
+func (s *OCSPStapler) findIssuer(chain []*x509.Certificate) (*x509.Certificate, error) {
+	leaf := chain[0]
+	for _, cert := range chain[1:] {
+		if leaf.CheckSignatureFrom(cert) == nil {
+			return cert, nil
+		}
+	}
+
+	for _, url := range leaf.IssuingCertificateURL {
+		resp, err := s.client.Get(url)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		if cert, err := x509.ParseCertificate(data); err == nil {
+			return cert, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Could not find the issuer of the certificate")
+}
+
+// fetchResponse requests the OCSP response of the given certificate from the
+// responders listed in it
+func (s *OCSPStapler) fetchResponse(leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not create OCSP request: %s", err.Error())
+	}
+
+	var lastErr error
+	for _, server := range leaf.OCSPServer {
+		httpResp, err := s.client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+		if err != nil {
+			lastErr = fmt.Errorf("Could not contact OCSP responder: %s", err.Error())
+			continue
+		}
+		data, err := ioutil.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("Could not read OCSP response: %s", err.Error())
+			continue
+		}
+		if httpResp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("OCSP responder failed with status %d", httpResp.StatusCode)
+			continue
+		}
+
+		resp, err := ocsp.ParseResponseForCert(data, leaf, issuer)
+		if err != nil {
+			lastErr = fmt.Errorf("Could not parse OCSP response: %s", err.Error())
+			continue
+		}
+		return data, resp, nil
+	}
+
+	return nil, nil, lastErr
+}
+
+// RegisterMetrics registers a collector that exports the expiry timestamps of
+// the OCSP responses in the given registry
+func (s *OCSPStapler) RegisterMetrics(registry *MetricsRegistry) {
+	registry.RegisterCollector(func(w *MetricsWriter) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		for _, st := range s.status {
+			if st.Domain != "" && !st.NextUpdate.IsZero() {
+				w.Gauge("dockerlb_ocsp_next_update_timestamp_seconds",
+					"The time the stapled OCSP response expires, in seconds since epoch.",
+					map[string]string{"domain": st.Domain}, float64(st.NextUpdate.Unix()))
+			}
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPStapler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, _ := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDer)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		data, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, _ := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(4 * 24 * time.Hour),
+		}, caKey)
+		w.Write(resp)
+	}))
+	defer server.Close()
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"foo.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{server.URL},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, &template, ca, &priv.PublicKey, caKey)
+	bundle := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})...)
+	ioutil.WriteFile(dir+"/foo.com.pem", bundle, 0600)
+
+	s := CreateOCSPStapler(OCSPStaplerConfig{Patterns: []string{dir + "/*.pem"}})
+	var updated []byte
+	s.SetUpdateHandler(func(certFile string, response []byte) {
+		updated = response
+	})
+
+	s.refresh()
+	data, err := ioutil.ReadFile(dir + "/foo.com.pem.ocsp")
+	if err != nil {
+		t.Fatalf("Expected the OCSP response to be written: %s", err.Error())
+	}
+	if string(updated) != string(data) {
+		t.Errorf("Expected the update handler to receive the new response")
+	}
+
+	// Fresh responses are not fetched again
+	s.status = make(map[string]*ocspStatus)
+	s.refresh()
+	if requests != 1 {
+		t.Errorf("Expected a single OCSP request, got %d", requests)
+	}
+
+	// A renewed certificate gets a new response right away
+	template.SerialNumber = big.NewInt(3)
+	der, _ = x509.CreateCertificate(rand.Reader, &template, ca, &priv.PublicKey, caKey)
+	renewed := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})...)
+	ioutil.WriteFile(dir+"/foo.com.pem", renewed, 0600)
+	os.Remove(dir + "/foo.com.pem.ocsp")
+	leaf, _ := x509.ParseCertificate(der)
+
+	s.refresh()
+	if requests != 2 {
+		t.Errorf("Expected the response of the renewed certificate to be fetched, got %d requests", requests)
+	}
+	data, _ = ioutil.ReadFile(dir + "/foo.com.pem.ocsp")
+	if _, err := ocsp.ParseResponseForCert(data, leaf, ca); err != nil {
+		t.Errorf("Expected the response of the renewed certificate: %s", err.Error())
+	}
+	if string(updated) != string(data) {
+		t.Errorf("Expected the update handler to receive the response of the renewed certificate")
+	}
+}
@@ -0,0 +1,394 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	sealedBlockType = "DOCKER-LB ENCRYPTED DATA"
+	keyringKey      = "keyring.json"
+)
+
+type SecretBoxConfig struct {
+	// The storage of the wrapped data keys, and the file with the passphrase
+	// the key encryption key is derived from (eg. a docker secret)
+	Storage        Storage
+	PassphraseFile string
+}
+
+// SecretBox implements the envelope encryption of the data at rest. The data
+// is encrypted with random data keys, that are themselves encrypted with a
+// key derived from the passphrase and stored in the keyring file.
+type SecretBox struct {
+	config  SecretBoxConfig
+	mutex   sync.Mutex
+	salt    []byte
+	kek     []byte
+	keys    map[string][]byte
+	current string
+}
+
+type keyringFile struct {
+	Salt    string            `json:"salt"`
+	Keys    map[string]string `json:"keys"`
+	Current string            `json:"current"`
+}
+
+func CreateSecretBox(config SecretBoxConfig) (*SecretBox, error) {
+	passphrase, err := readPassphrase(config.PassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &SecretBox{
+		config: config,
+		keys:   make(map[string][]byte),
+	}
+
+	data, err := config.Storage.Load(keyringKey)
+	if err == ErrKeyNotFound {
+		log.Warnf("Keyring is missing from %s, creating a new one", config.Storage)
+		var created bool
+		created, err = b.create(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			return b, nil
+		}
+
+		// Another node created the keyring in the meantime, use that one
+		data, err = config.Storage.Load(keyringKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read keyring: %s", err.Error())
+	}
+
+	err = b.load(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// load unlocks the data keys of the given keyring file with the passphrase
+func (b *SecretBox) load(data []byte, passphrase []byte) error {
+	var keyring keyringFile
+	err := json.Unmarshal(data, &keyring)
+	if err != nil {
+		return fmt.Errorf("Could not parse keyring: %s", err.Error())
+	}
+	b.salt, err = base64.StdEncoding.DecodeString(keyring.Salt)
+	if err != nil {
+		return fmt.Errorf("Could not parse keyring: %s", err.Error())
+	}
+	b.kek, err = deriveKey(passphrase, b.salt)
+	if err != nil {
+		return err
+	}
+
+	for id, wrapped := range keyring.Keys {
+		sealed, err := base64.StdEncoding.DecodeString(wrapped)
+		if err != nil {
+			return fmt.Errorf("Could not parse keyring: %s", err.Error())
+		}
+		key, err := aesGCMOpen(b.kek, sealed)
+		if err != nil {
+			return fmt.Errorf("Could not unlock the keyring, is the passphrase correct?")
+		}
+		b.keys[id] = key
+	}
+	if _, ok := b.keys[keyring.Current]; !ok {
+		return fmt.Errorf("The keyring has no current key")
+	}
+	b.current = keyring.Current
+
+	return nil
+}
+
+// create generates a keyring with a new data key and stores it, unless the
+// keyring was created by another node in the meantime
+func (b *SecretBox) create(passphrase []byte) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.setPassphrase(passphrase)
+	if err != nil {
+		return false, err
+	}
+	id, key, err := generateKey()
+	if err != nil {
+		return false, err
+	}
+	b.current = id
+	b.keys[id] = key
+
+	data, err := b.encode()
+	if err != nil {
+		return false, err
+	}
+	ok, err := b.config.Storage.CompareAndSwap(keyringKey, data, 0)
+	if err != nil {
+		return false, fmt.Errorf("Could not write keyring: %s", err.Error())
+	}
+	if !ok {
+		b.keys = make(map[string][]byte)
+		b.current = ""
+	}
+	return ok, nil
+}
+
+// readPassphrase reads the passphrase from the given file, ignoring the
+// trailing new line
+func readPassphrase(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read passphrase: %s", err.Error())
+	}
+	data = bytes.TrimRight(data, "\r\n")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("The passphrase in %s is empty", filename)
+	}
+	return data, nil
+}
+
+func deriveKey(passphrase []byte, salt []byte) ([]byte, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Could not derive key: %s", err.Error())
+	}
+	return key, nil
+}
+
+func aesGCMSeal(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func aesGCMOpen(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Encrypted data is truncated")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// encode wraps the data keys with the key encryption key. It must be called
+// while holding the mutex.
+func (b *SecretBox) encode() ([]byte, error) {
+	keyring := keyringFile{
+		Salt:    base64.StdEncoding.EncodeToString(b.salt),
+		Keys:    make(map[string]string),
+		Current: b.current,
+	}
+	for id, key := range b.keys {
+		wrapped, err := aesGCMSeal(b.kek, key)
+		if err != nil {
+			return nil, fmt.Errorf("Could not wrap key: %s", err.Error())
+		}
+		keyring.Keys[id] = base64.StdEncoding.EncodeToString(wrapped)
+	}
+
+	data, err := json.Marshal(keyring)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal keyring: %s", err.Error())
+	}
+	return data, nil
+}
+
+// save writes the keyring file. It must be called while holding the mutex.
+func (b *SecretBox) save() error {
+	data, err := b.encode()
+	if err != nil {
+		return err
+	}
+	err = b.config.Storage.Store(keyringKey, data)
+	if err != nil {
+		return fmt.Errorf("Could not write keyring: %s", err.Error())
+	}
+	return nil
+}
+
+// setPassphrase derives a new key encryption key from the given passphrase.
+// It must be called while holding the mutex.
+func (b *SecretBox) setPassphrase(passphrase []byte) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("Could not generate salt: %s", err.Error())
+	}
+	kek, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	b.salt = salt
+	b.kek = kek
+	return nil
+}
+
+// AddKey generates a new data key and uses it for encrypting from now on,
+// keeping the previous keys for decrypting the existing data
+func (b *SecretBox) AddKey() (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	id, key, err := generateKey()
+	if err != nil {
+		return "", err
+	}
+
+	b.current = id
+	b.keys[b.current] = key
+	return b.current, b.save()
+}
+
+// generateKey returns a new random data key, along with its ID
+func generateKey() (string, []byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, fmt.Errorf("Could not generate key: %s", err.Error())
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, fmt.Errorf("Could not generate key: %s", err.Error())
+	}
+	return hex.EncodeToString(id), key, nil
+}
+
+// RemoveOldKeys drops all the data keys but the current one, once all the
+// data has been encrypted again
+func (b *SecretBox) RemoveOldKeys() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for id := range b.keys {
+		if id != b.current {
+			delete(b.keys, id)
+		}
+	}
+	return b.save()
+}
+
+// ChangePassphrase wraps the data keys with the passphrase in the given file
+func (b *SecretBox) ChangePassphrase(passphraseFile string) error {
+	passphrase, err := readPassphrase(passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err = b.setPassphrase(passphrase)
+	if err != nil {
+		return err
+	}
+	return b.save()
+}
+
+// IsSealed checks if the given data was encrypted by a secret box
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN "+sealedBlockType+"-----"))
+}
+
+// Seal encrypts the given data with the current data key
+func (b *SecretBox) Seal(data []byte) ([]byte, error) {
+	b.mutex.Lock()
+	id, key := b.current, b.keys[b.current]
+	b.mutex.Unlock()
+
+	sealed, err := aesGCMSeal(key, data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encrypt data: %s", err.Error())
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    sealedBlockType,
+		Headers: map[string]string{"Key-Id": id},
+		Bytes:   sealed,
+	}), nil
+}
+
+// Open decrypts the data encrypted by Seal
+func (b *SecretBox) Open(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != sealedBlockType {
+		return nil, fmt.Errorf("Data is not encrypted")
+	}
+
+	b.mutex.Lock()
+	key, ok := b.keys[block.Headers["Key-Id"]]
+	b.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Data is encrypted with unknown key '%s'", block.Headers["Key-Id"])
+	}
+
+	plaintext, err := aesGCMOpen(key, block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt data: %s", err.Error())
+	}
+	return plaintext, nil
+}
+
+// Reseal encrypts again with the current data key all the encrypted data in
+// the storage, returning the number of keys changed
+func (b *SecretBox) Reseal() (int, error) {
+	keys, err := b.config.Storage.List("")
+	if err != nil {
+		return 0, fmt.Errorf("Could not list keys: %s", err.Error())
+	}
+
+	count := 0
+	for _, key := range keys {
+		data, err := b.config.Storage.Load(key)
+		if err != nil {
+			return count, fmt.Errorf("Could not read %s: %s", key, err.Error())
+		}
+		if !IsSealed(data) {
+			continue
+		}
+		plaintext, err := b.Open(data)
+		if err != nil {
+			return count, fmt.Errorf("Could not decrypt %s: %s", key, err.Error())
+		}
+		sealed, err := b.Seal(plaintext)
+		if err != nil {
+			return count, err
+		}
+		err = b.config.Storage.Store(key, sealed)
+		if err != nil {
+			return count, fmt.Errorf("Could not write %s: %s", key, err.Error())
+		}
+		count++
+	}
+	return count, nil
+}
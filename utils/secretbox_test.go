@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecretBox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passFile := filepath.Join(dir, "passphrase")
+	ioutil.WriteFile(passFile, []byte("secret\n"), 0600)
+	config := SecretBoxConfig{
+		Storage:        CreateFileStorage(FileStorageConfig{Dir: dir}),
+		PassphraseFile: passFile,
+	}
+
+	box, err := CreateSecretBox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := box.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) {
+		t.Fatalf("Expected the data to be sealed, got %s", sealed)
+	}
+
+	// The keyring can be opened again with the same passphrase only
+	box2, err := CreateSecretBox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := box2.Open(sealed); err != nil || string(data) != "hello" {
+		t.Fatalf("Expected to decrypt the data, got %q (%v)", data, err)
+	}
+	ioutil.WriteFile(passFile, []byte("wrong"), 0600)
+	if _, err := CreateSecretBox(config); err == nil {
+		t.Fatalf("Expected the wrong passphrase to be rejected")
+	}
+
+	// Rotation encrypts again the data with the new key and passphrase
+	ioutil.WriteFile(filepath.Join(dir, "data"), sealed, 0600)
+	newPassFile := filepath.Join(dir, "passphrase.new")
+	ioutil.WriteFile(newPassFile, []byte("new secret"), 0600)
+
+	box2.AddKey()
+	if count, err := box2.Reseal(); err != nil || count != 1 {
+		t.Fatalf("Expected one file to be encrypted again, got %d (%v)", count, err)
+	}
+	box2.RemoveOldKeys()
+	if err := box2.ChangePassphrase(newPassFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := box.Open(sealed); err != nil {
+		t.Fatalf("Expected the previous instance to still open its data")
+	}
+
+	config.PassphraseFile = newPassFile
+	box3, err := CreateSecretBox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resealed, _ := ioutil.ReadFile(filepath.Join(dir, "data"))
+	if data, err := box3.Open(resealed); err != nil || string(data) != "hello" {
+		t.Fatalf("Expected to decrypt the rotated data, got %q (%v)", data, err)
+	}
+	if _, err := box3.Open(sealed); err == nil {
+		t.Fatalf("Expected the previous key to be removed")
+	}
+}
+
+// racingStorage hides the keyring the first time it is read, as if another
+// node created it right after
+type racingStorage struct {
+	*FileStorage
+	loaded bool
+}
+
+func (s *racingStorage) Load(key string) ([]byte, error) {
+	if key == keyringKey && !s.loaded {
+		s.loaded = true
+		return nil, ErrKeyNotFound
+	}
+	return s.FileStorage.Load(key)
+}
+
+func TestSecretBoxKeyringRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passFile := filepath.Join(dir, "passphrase")
+	ioutil.WriteFile(passFile, []byte("secret\n"), 0600)
+	storage := CreateFileStorage(FileStorageConfig{Dir: dir})
+	box, err := CreateSecretBox(SecretBoxConfig{Storage: storage, PassphraseFile: passFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := box.Seal([]byte("hello"))
+	keyring, _ := storage.Load(keyringKey)
+
+	// The keyring of the other node is used instead of being overwritten
+	box2, err := CreateSecretBox(SecretBoxConfig{Storage: &racingStorage{FileStorage: storage}, PassphraseFile: passFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := box2.Open(sealed); err != nil || string(data) != "hello" {
+		t.Fatalf("Expected to decrypt the data, got %q (%v)", data, err)
+	}
+	if data, _ := storage.Load(keyringKey); string(data) != string(keyring) {
+		t.Fatalf("Expected the keyring not to be replaced")
+	}
+}
+
+func TestEncryptedCertificateProvider(t *testing.T) {
+	p, cleanup := createTestCertificateProvider(t)
+	defer cleanup()
+
+	// A certificate and state stored in plain text by an earlier version
+	notBefore := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	writeTestCertificate(t, p.certFilePath("foo.com"), notBefore, notBefore.Add(30*24*time.Hour))
+	plain, _ := ioutil.ReadFile(p.certFilePath("foo.com"))
+
+	passFile := filepath.Join(p.config.ConfigDir, "passphrase")
+	ioutil.WriteFile(passFile, []byte("secret"), 0600)
+	box, err := CreateSecretBox(SecretBoxConfig{
+		Storage:        p.config.Storage,
+		PassphraseFile: passFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := p.config
+	config.Encryption = box
+	config.RuntimeDir = filepath.Join(p.config.ConfigDir, "runtime")
+	p2, err := CreateDefaultCertificateProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{"state.json", "cert/foo.com.pem"} {
+		data, _ := ioutil.ReadFile(filepath.Join(p.config.ConfigDir, filename))
+		if !IsSealed(data) {
+			t.Errorf("Expected %s to be encrypted", filename)
+		}
+	}
+	if data, _ := ioutil.ReadFile(p2.certFilePath("foo.com")); string(data) != string(plain) {
+		t.Errorf("Expected the certificate to be decrypted into the runtime directory")
+	}
+	if _, ok := p2.certificates["foo.com"]; !ok {
+		t.Errorf("Expected the decrypted certificate to be tracked")
+	}
+
+	// The state cannot be loaded without the passphrase
+	os.RemoveAll(config.RuntimeDir)
+	if _, err := CreateDefaultCertificateProvider(p.config); err == nil {
+		t.Fatalf("Expected the encrypted state to require the passphrase")
+	}
+	if _, err := CreateDefaultCertificateProvider(config); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(p2.certFilePath("foo.com")); string(data) != string(plain) {
+		t.Errorf("Expected the certificate to be decrypted again after a restart")
+	}
+}
+
+func TestEncryptedInternalCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A CA stored in plain text by an earlier version
+	config := InternalCertificateProviderConfig{Dir: filepath.Join(dir, "ca"), Organization: "Test"}
+	p, err := CreateInternalCertificateProvider(config, &TestCertificateProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, err := p.GetCertificateForDomain("app.internal", CertificateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := ioutil.ReadFile(certPath)
+
+	passFile := filepath.Join(dir, "passphrase")
+	ioutil.WriteFile(passFile, []byte("secret"), 0600)
+	box, err := CreateSecretBox(SecretBoxConfig{
+		Storage:        CreateFileStorage(FileStorageConfig{Dir: dir}),
+		PassphraseFile: passFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encConfig := config
+	encConfig.Storage = CreateFileStorage(FileStorageConfig{Dir: config.Dir})
+	encConfig.Encryption = box
+	encConfig.RuntimeDir = filepath.Join(dir, "runtime")
+	p2, err := CreateInternalCertificateProvider(encConfig, &TestCertificateProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p2.root.Equal(p.root) || !p2.intermediate.Equal(p.intermediate) {
+		t.Errorf("Expected the existing CA to be kept")
+	}
+	certPath2, err := p2.GetCertificateForDomain("app.internal", CertificateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(certPath2); certPath2 == certPath || string(data) != string(plain) {
+		t.Errorf("Expected the certificate to be decrypted into the runtime directory")
+	}
+	for _, name := range []string{"root.key", "root.pem", "intermediate.key", "intermediate.pem", "cert/app.internal.pem"} {
+		data, _ := ioutil.ReadFile(filepath.Join(config.Dir, name))
+		if !IsSealed(data) {
+			t.Errorf("Expected %s to be encrypted", name)
+		}
+	}
+
+	// The CA cannot be loaded without the passphrase
+	os.RemoveAll(encConfig.RuntimeDir)
+	if _, err := CreateInternalCertificateProvider(config, &TestCertificateProvider{}); err == nil {
+		t.Fatalf("Expected the encrypted CA to require the passphrase")
+	}
+	p3, err := CreateInternalCertificateProvider(encConfig, &TestCertificateProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p3.GetCertificateForDomain("app.internal", CertificateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(certPath2); string(data) != string(plain) {
+		t.Errorf("Expected the certificate to be decrypted again after a restart")
+	}
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrKeyNotFound is returned by the storage when loading a missing key
+var ErrKeyNotFound = errors.New("Key not found")
+
+// Storage keeps the state and the certificates of the providers. Keys are
+// slash-separated paths, eg. "cert/example.com.pem".
+type Storage interface {
+	Load(key string) ([]byte, error)
+	Store(key string, data []byte) error
+	Delete(key string) error
+
+	// List returns the keys under the given prefix, recursively
+	List(prefix string) ([]string, error)
+
+	// Watch calls the handler every time the keys under the given prefix are
+	// changed, possibly by another node sharing the storage
+	Watch(prefix string, handler func())
+
+	// LoadVersion also returns the version of the key, and CompareAndSwap
+	// only stores the data if the key still has the given version, or is
+	// missing when the version is zero
+	LoadVersion(key string) ([]byte, uint64, error)
+	CompareAndSwap(key string, data []byte, version uint64) (bool, error)
+}
+
+type FileStorageConfig struct {
+	Dir string
+
+	// How often to check the files for changes made by other nodes, eg. when
+	// the directory is shared over NFS
+	PollInterval time.Duration
+}
+
+// FileStorage stores the keys as files in a local directory
+type FileStorage struct {
+	config FileStorageConfig
+	mutex  sync.Mutex
+}
+
+func CreateFileStorage(config FileStorageConfig) *FileStorage {
+	if config.PollInterval == 0 {
+		config.PollInterval = 10 * time.Second
+	}
+	return &FileStorage{config: config}
+}
+
+func (s *FileStorage) path(key string) string {
+	return filepath.Join(s.config.Dir, filepath.FromSlash(key))
+}
+
+func (s *FileStorage) Load(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrKeyNotFound
+	}
+	return data, err
+}
+
+func (s *FileStorage) Store(key string, data []byte) error {
+	filename := s.path(key)
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpFile := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+func (s *FileStorage) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStorage) List(prefix string) ([]string, error) {
+	var keys []string
+
+	// Only walk the directory of the prefix
+	root := s.config.Dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = s.path(prefix[:i])
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.config.Dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+
+	sort.Strings(keys)
+	return keys, err
+}
+
+// LoadVersion uses the modification time of the file as its version
+func (s *FileStorage) LoadVersion(key string) ([]byte, uint64, error) {
+	info, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := s.Load(key)
+	return data, uint64(info.ModTime().UnixNano()), err
+}
+
+// CompareAndSwap is only atomic between the nodes when creating a key, since
+// the file system has no way to check the version and write in one step
+func (s *FileStorage) CompareAndSwap(key string, data []byte, version uint64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	filename := s.path(key)
+	if version == 0 {
+		err := os.MkdirAll(filepath.Dir(filename), 0700)
+		if err != nil {
+			return false, err
+		}
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		_, err = f.Write(data)
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		return err == nil, err
+	}
+
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if uint64(info.ModTime().UnixNano()) != version {
+		return false, nil
+	}
+	return true, s.Store(key, data)
+}
+
+// snapshot returns the modification times of the files under the prefix
+func (s *FileStorage) snapshot(prefix string) map[string]time.Time {
+	files := make(map[string]time.Time)
+	keys, _ := s.List(prefix)
+	for _, key := range keys {
+		if info, err := os.Stat(s.path(key)); err == nil {
+			files[key] = info.ModTime()
+		}
+	}
+	return files
+}
+
+func (s *FileStorage) Watch(prefix string, handler func()) {
+	go func() {
+		last := s.snapshot(prefix)
+		for {
+			time.Sleep(s.config.PollInterval)
+
+			current := s.snapshot(prefix)
+			changed := len(current) != len(last)
+			for key, modTime := range current {
+				if !last[key].Equal(modTime) {
+					changed = true
+				}
+			}
+			last = current
+
+			if changed {
+				handler()
+			}
+		}
+	}()
+}
+
+func (s *FileStorage) String() string {
+	return fmt.Sprintf("file:%s", s.config.Dir)
+}
@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ConsulStorageConfig struct {
+	// The address of the Consul agent (eg. "http://127.0.0.1:8500"), the ACL
+	// token and the prefix of all the keys
+	Address string
+	Token   string
+	Prefix  string
+
+	// How long the blocking queries used for watching wait for changes
+	WaitTime time.Duration
+}
+
+// ConsulStorage stores the keys in the Consul KV store, that is shared by all
+// the nodes of the cluster
+type ConsulStorage struct {
+	config ConsulStorageConfig
+	client *http.Client
+}
+
+func CreateConsulStorage(config ConsulStorageConfig) *ConsulStorage {
+	if config.Address == "" {
+		config.Address = "http://127.0.0.1:8500"
+	}
+	if config.WaitTime == 0 {
+		config.WaitTime = 5 * time.Minute
+	}
+	if !strings.Contains(config.Address, "://") {
+		config.Address = "http://" + config.Address
+	}
+	config.Address = strings.TrimSuffix(config.Address, "/")
+	config.Prefix = strings.Trim(config.Prefix, "/")
+
+	return &ConsulStorage{
+		config: config,
+		client: &http.Client{Timeout: config.WaitTime + 30*time.Second},
+	}
+}
+
+// fullKey returns the key in the KV store
+func (s *ConsulStorage) fullKey(key string) string {
+	if s.config.Prefix == "" {
+		return key
+	}
+	return s.config.Prefix + "/" + key
+}
+
+func (s *ConsulStorage) request(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := s.config.Address + "/v1/kv/" + (&url.URL{Path: s.fullKey(key)}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.config.Token != "" {
+		req.Header.Set("X-Consul-Token", s.config.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("Consul responded with %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+func (s *ConsulStorage) Load(key string) ([]byte, error) {
+	resp, err := s.request("GET", key, url.Values{"raw": {""}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load %s: %s", key, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrKeyNotFound
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *ConsulStorage) Store(key string, data []byte) error {
+	resp, err := s.request("PUT", key, nil, data)
+	if err != nil {
+		return fmt.Errorf("Could not store %s: %s", key, err.Error())
+	}
+	defer resp.Body.Close()
+
+	result, _ := ioutil.ReadAll(resp.Body)
+	if strings.TrimSpace(string(result)) != "true" {
+		return fmt.Errorf("Could not store %s", key)
+	}
+	return nil
+}
+
+func (s *ConsulStorage) Delete(key string) error {
+	resp, err := s.request("DELETE", key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("Could not delete %s: %s", key, err.Error())
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *ConsulStorage) List(prefix string) ([]string, error) {
+	resp, err := s.request("GET", prefix, url.Values{"keys": {""}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list %s: %s", prefix, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	var fullKeys []string
+	err = json.NewDecoder(resp.Body).Decode(&fullKeys)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse keys of %s: %s", prefix, err.Error())
+	}
+
+	var keys []string
+	for _, key := range fullKeys {
+		if s.config.Prefix != "" {
+			key = strings.TrimPrefix(key, s.config.Prefix+"/")
+		}
+		// Folders are keys ending in a slash
+		if key != "" && !strings.HasSuffix(key, "/") {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *ConsulStorage) LoadVersion(key string) ([]byte, uint64, error) {
+	resp, err := s.request("GET", key, nil, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not load %s: %s", key, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	var entries []struct {
+		Value       []byte
+		ModifyIndex uint64
+	}
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not parse %s: %s", key, err.Error())
+	}
+	if len(entries) == 0 {
+		return nil, 0, ErrKeyNotFound
+	}
+	return entries[0].Value, entries[0].ModifyIndex, nil
+}
+
+func (s *ConsulStorage) CompareAndSwap(key string, data []byte, version uint64) (bool, error) {
+	resp, err := s.request("PUT", key, url.Values{"cas": {strconv.FormatUint(version, 10)}}, data)
+	if err != nil {
+		return false, fmt.Errorf("Could not store %s: %s", key, err.Error())
+	}
+	defer resp.Body.Close()
+
+	result, _ := ioutil.ReadAll(resp.Body)
+	return strings.TrimSpace(string(result)) == "true", nil
+}
+
+// Watch uses blocking queries, that return as soon as the index of the keys
+// under the prefix changes
+func (s *ConsulStorage) Watch(prefix string, handler func()) {
+	go func() {
+		var index uint64
+		for {
+			query := url.Values{
+				"recurse": {""},
+				"index":   {strconv.FormatUint(index, 10)},
+				"wait":    {fmt.Sprintf("%ds", int(s.config.WaitTime.Seconds()))},
+			}
+			resp, err := s.request("GET", prefix, query, nil)
+			if err != nil {
+				log.Warnf("Could not watch %s: %s", s.fullKey(prefix), err.Error())
+				time.Sleep(10 * time.Second)
+				continue
+			}
+			resp.Body.Close()
+
+			newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+			if err != nil {
+				log.Warnf("Could not watch %s: missing index", s.fullKey(prefix))
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			// The index may go backwards, eg. when the store is restored
+			changed := index != 0 && newIndex != index
+			if newIndex < index {
+				newIndex = 0
+			}
+			index = newIndex
+
+			if changed {
+				handler()
+			}
+		}
+	}()
+}
+
+func (s *ConsulStorage) String() string {
+	return fmt.Sprintf("consul:%s/%s", s.config.Address, s.config.Prefix)
+}
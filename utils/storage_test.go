@@ -0,0 +1,331 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConsul is a stand-in of the Consul KV API
+type testConsul struct {
+	mutex   sync.Mutex
+	index   uint64
+	values  map[string][]byte
+	indexes map[string]uint64
+	changed chan struct{}
+}
+
+func newTestConsul() *testConsul {
+	return &testConsul{
+		index:   1,
+		values:  make(map[string][]byte),
+		indexes: make(map[string]uint64),
+		changed: make(chan struct{}),
+	}
+}
+
+func (c *testConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch r.Method {
+	case "PUT":
+		if sv := query.Get("cas"); sv != "" {
+			cas, _ := strconv.ParseUint(sv, 10, 64)
+			if c.indexes[key] != cas {
+				w.Write([]byte("false"))
+				return
+			}
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		c.notify()
+		c.values[key] = data
+		c.indexes[key] = c.index
+		w.Write([]byte("true"))
+		return
+	case "DELETE":
+		delete(c.values, key)
+		delete(c.indexes, key)
+		c.notify()
+		w.Write([]byte("true"))
+		return
+	}
+
+	// Blocking queries wait for the index to change
+	if sv := query.Get("index"); sv != "" {
+		index, _ := strconv.ParseUint(sv, 10, 64)
+		wait, _ := time.ParseDuration(query.Get("wait"))
+		if index == c.index {
+			changed := c.changed
+			c.mutex.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(wait):
+			}
+			c.mutex.Lock()
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+
+	if _, ok := query["keys"]; ok {
+		var keys []string
+		for k := range c.values {
+			if strings.HasPrefix(k, key) {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		sort.Strings(keys)
+		w.Write([]byte(`["` + strings.Join(keys, `","`) + `"]`))
+		return
+	}
+
+	data, ok := c.values[key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if _, ok := query["raw"]; ok {
+		w.Write(data)
+		return
+	}
+	json.NewEncoder(w).Encode([]map[string]interface{}{
+		{"Key": key, "Value": data, "ModifyIndex": c.indexes[key]},
+	})
+}
+
+// notify wakes up the blocking queries. It must be called while holding the
+// mutex.
+func (c *testConsul) notify() {
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func TestConsulStorage(t *testing.T) {
+	server := httptest.NewServer(newTestConsul())
+	defer server.Close()
+
+	s := CreateConsulStorage(ConsulStorageConfig{
+		Address:  server.URL,
+		Prefix:   "docker-lb",
+		WaitTime: time.Second,
+	})
+
+	if _, err := s.Load("state.json"); err != ErrKeyNotFound {
+		t.Fatalf("Expected missing key, got %v", err)
+	}
+	s.Store("cert/b.pem", []byte("b"))
+	s.Store("cert/a.pem", []byte("a"))
+	s.Store("state.json", []byte("{}"))
+
+	if data, err := s.Load("cert/a.pem"); err != nil || string(data) != "a" {
+		t.Fatalf("Expected to load the key, got %q (%v)", data, err)
+	}
+	if keys, _ := s.List("cert/"); !reflect.DeepEqual(keys, []string{"cert/a.pem", "cert/b.pem"}) {
+		t.Fatalf("Unexpected keys %v", keys)
+	}
+	s.Delete("cert/b.pem")
+	if keys, _ := s.List("cert/"); !reflect.DeepEqual(keys, []string{"cert/a.pem"}) {
+		t.Fatalf("Unexpected keys %v", keys)
+	}
+}
+
+func TestSharedStorage(t *testing.T) {
+	server := httptest.NewServer(newTestConsul())
+	defer server.Close()
+
+	storage := CreateConsulStorage(ConsulStorageConfig{
+		Address:  server.URL,
+		Prefix:   "docker-lb",
+		WaitTime: time.Second,
+	})
+
+	var nodes []*DefaultCertificateProvider
+	for i := 0; i < 2; i++ {
+		configDir, err := ioutil.TempDir("", "docker-lb-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(configDir)
+
+		p, err := CreateDefaultCertificateProvider(DefaultCertificateProviderConfig{
+			ConfigDir:    configDir,
+			Email:        "test@example.com",
+			Organization: "Test",
+			Storage:      storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, p)
+	}
+
+	// The nodes share the same account
+	if !reflect.DeepEqual(nodes[0].userKey, nodes[1].userKey) {
+		t.Fatalf("Expected the nodes to share the account key")
+	}
+
+	updated := make(chan string, 1)
+	nodes[1].SetUpdateHandler(func(domain string) { updated <- domain })
+	storage.Watch(stateKey, nodes[1].storageChanged)
+	time.Sleep(100 * time.Millisecond)
+
+	// A certificate issued by the first node reaches the second
+	notBefore := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	filename := nodes[0].certFilePath("foo.com")
+	cert := writeTestCertificate(t, filename, notBefore, notBefore.Add(30*24*time.Hour))
+	data, _ := ioutil.ReadFile(filename)
+
+	nodes[0].mutex.Lock()
+	nodes[0].writeCertFile(filename, data)
+	nodes[0].certificates["foo.com"] = nodes[0].newIssuedCertificate(cert)
+	nodes[0].saveState()
+	nodes[0].mutex.Unlock()
+
+	select {
+	case domain := <-updated:
+		if domain != "foo.com" {
+			t.Fatalf("Expected an update of foo.com, got %s", domain)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the second node to be notified")
+	}
+
+	nodes[1].mutex.Lock()
+	_, ok := nodes[1].certificates["foo.com"]
+	nodes[1].mutex.Unlock()
+	if !ok {
+		t.Errorf("Expected the certificate to be tracked by the second node")
+	}
+	if local, _ := ioutil.ReadFile(nodes[1].certFilePath("foo.com")); string(local) != string(data) {
+		t.Errorf("Expected the certificate to be copied to the second node")
+	}
+
+	// Purging on the first node removes the certificate from the second
+	if err := nodes[0].Purge("foo.com", false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the second node to be notified")
+	}
+	if _, err := os.Stat(nodes[1].certFilePath("foo.com")); !os.IsNotExist(err) {
+		t.Errorf("Expected the purged certificate to be removed from the second node")
+	}
+}
+
+func TestStateMerge(t *testing.T) {
+	server := httptest.NewServer(newTestConsul())
+	defer server.Close()
+
+	storage := CreateConsulStorage(ConsulStorageConfig{
+		Address:  server.URL,
+		Prefix:   "docker-lb",
+		WaitTime: time.Second,
+	})
+
+	var nodes []*DefaultCertificateProvider
+	for i := 0; i < 2; i++ {
+		configDir, err := ioutil.TempDir("", "docker-lb-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(configDir)
+
+		p, err := CreateDefaultCertificateProvider(DefaultCertificateProviderConfig{
+			ConfigDir:    configDir,
+			Email:        "test@example.com",
+			Organization: "Test",
+			Storage:      storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, p)
+	}
+	save := func(p *DefaultCertificateProvider, change func()) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		change()
+		if err := p.saveState(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The changes of both nodes are kept
+	issueDate := time.Now().Add(-time.Hour)
+	save(nodes[0], func() {
+		nodes[0].certificates["foo.com"] = &issuedCertificate{IssueDate: issueDate, ReissueDate: issueDate.Add(time.Hour)}
+		nodes[0].issuers["foo.com"] = IssuerACME
+		nodes[0].pending["bar.com"] = &pendingCertificate{NextAttempt: time.Now()}
+	})
+	save(nodes[1], func() {
+		nodes[1].pending["baz.com"] = &pendingCertificate{NextAttempt: time.Now()}
+	})
+	if _, ok := nodes[1].certificates["foo.com"]; !ok || nodes[1].pending["bar.com"] == nil || nodes[1].pending["baz.com"] == nil {
+		t.Fatalf("Expected the state of the first node to be merged, got %v %v", nodes[1].certificates, nodes[1].pending)
+	}
+
+	// Cancelled pending certificates are not brought back by a node that has
+	// not seen the cancellation yet
+	nodes[0].SetActiveDomains([]string{"foo.com", "baz.com"})
+	if nodes[0].pending["bar.com"] != nil || nodes[0].pending["baz.com"] == nil {
+		t.Fatalf("Expected bar.com to be cancelled, got %v", nodes[0].pending)
+	}
+	save(nodes[1], func() {})
+	if nodes[1].pending["bar.com"] != nil {
+		t.Errorf("Expected the cancellation to reach the second node")
+	}
+
+	// A pending certificate is dropped once the certificate is issued, even if
+	// the other node saves it in the meantime
+	nodes[1].mutex.Lock()
+	nodes[1].certificates["baz.com"] = &issuedCertificate{IssueDate: time.Now(), ReissueDate: time.Now().Add(time.Hour)}
+	delete(nodes[1].pending, "baz.com")
+	nodes[1].mutex.Unlock()
+	save(nodes[0], func() {
+		nodes[0].issuers["baz.com"] = IssuerACME
+	})
+	save(nodes[1], func() {})
+	if nodes[1].pending["baz.com"] != nil || nodes[1].issuers["baz.com"] != IssuerACME {
+		t.Errorf("Expected the pending certificate to stay dropped, got %v", nodes[1].pending)
+	}
+	save(nodes[0], func() {})
+	if nodes[0].pending["baz.com"] != nil || nodes[0].certificates["baz.com"] == nil {
+		t.Errorf("Expected the issued certificate to replace the pending one, got %v", nodes[0].pending)
+	}
+
+	// Purged certificates are not brought back either, unless they are issued
+	// again afterwards
+	if err := nodes[0].Purge("foo.com", false); err != nil {
+		t.Fatal(err)
+	}
+	save(nodes[1], func() {})
+	if nodes[1].certificates["foo.com"] != nil || nodes[1].issuers["foo.com"] != "" {
+		t.Errorf("Expected the purge to reach the second node")
+	}
+	save(nodes[1], func() {
+		nodes[1].certificates["foo.com"] = &issuedCertificate{IssueDate: time.Now(), ReissueDate: time.Now().Add(time.Hour)}
+	})
+	save(nodes[0], func() {})
+	if nodes[0].certificates["foo.com"] == nil {
+		t.Errorf("Expected the certificate issued again to be kept")
+	}
+}
@@ -6,9 +6,19 @@ import (
 
 type CertificateProvider interface {
 	GetSelfSigned(domain string) (string, error)
-	GetCertificateForDomain(domain string) (string, error)
+	GetCertificateForDomain(domain string, opts CertificateOptions) (string, error)
 	GetAuthServicePort(ssl bool) int
 	GetDomainsToReissue() []string
+	SetUpdateHandler(handler func(domain string))
+}
+
+// CertificateOptions are the per-domain options given when requesting a
+// certificate. Empty values fall back to the provider defaults.
+type CertificateOptions struct {
+	Challenge  string `json:"challenge,omitempty"`
+	CertSecret string `json:"cert_secret,omitempty"`
+	Issuer     string `json:"issuer,omitempty"`
+	KeyType    string `json:"key_type,omitempty"`
 }
 
 type Certificate struct {
@@ -28,7 +38,18 @@ type ProxyEndpoint struct {
 	BackendPort    int    `json:"backend_port"`
 	BackendPath    string `json:"backend_path"`
 	SSLAutoCert    bool   `json:"ssl_autocert"`
+	SSLChallenge   string `json:"ssl_challenge"`
+	SSLCertSecret  string `json:"ssl_cert_secret"`
+	SSLIssuer      string `json:"ssl_issuer"`
+	SSLKeyType     string `json:"ssl_key_type"`
+	SSLPolicy      string `json:"ssl_policy"`
 	Order          int    `json:"order"`
+	ErrorPages     string `json:"error_pages"`
+	TimeoutServer  string `json:"timeout_server"`
+	TimeoutConnect string `json:"timeout_connect"`
+	TimeoutTunnel  string `json:"timeout_tunnel"`
+	ContainerName  string `json:"container_name"`
+	ServiceName    string `json:"service_name"`
 }
 
 type HAProxyState struct {